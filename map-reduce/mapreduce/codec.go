@@ -0,0 +1,208 @@
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// Largest key or value decoded by BinaryCodec. A longer length means the file is corrupt
+	MAX_BINARY_FIELD_SIZE = 1024 * 1024 * 1024
+
+	// Fields longer than this are read as they arrive instead of allocated up front
+	BINARY_FIELD_CHUNK_SIZE = 64 * 1024
+)
+
+// RecordCodec defines how KeyValue records are encoded in intermediate and result files.
+// The same codec must be used by the master and all the workers, so it's sent to
+// workers when they register.
+type RecordCodec interface {
+	// Name identifies the codec when it's sent to workers.
+	Name() string
+	NewEncoder(io.Writer) RecordEncoder
+	NewDecoder(io.Reader) RecordDecoder
+}
+
+type RecordEncoder interface {
+	Encode(*KeyValue) error
+}
+
+// RecordDecoder should return io.EOF when there are no more records to decode.
+type RecordDecoder interface {
+	Decode(*KeyValue) error
+}
+
+// JsonCodec encodes one JSON object per line. It's the default codec.
+type JsonCodec struct{}
+
+// GobCodec encodes records as a gob stream.
+type GobCodec struct{}
+
+// BinaryCodec encodes records as length-prefixed keys and values, using uvarints
+// for the lengths. It's the most compact and fastest of the built-in codecs.
+type BinaryCodec struct{}
+
+var codecs = map[string]RecordCodec{
+	JsonCodec{}.Name():   JsonCodec{},
+	GobCodec{}.Name():    GobCodec{},
+	BinaryCodec{}.Name(): BinaryCodec{},
+}
+
+// CodecByName returns one of the built-in codecs: json, gob or binary.
+func CodecByName(name string) (RecordCodec, bool) {
+	codec, ok := codecs[name]
+	return codec, ok
+}
+
+// Returns the codec used by task.
+func recordCodec(task *Task) RecordCodec {
+	if task.Codec == nil {
+		return JsonCodec{}
+	}
+	return task.Codec
+}
+
+// JSON
+
+func (JsonCodec) Name() string { return "json" }
+
+func (JsonCodec) NewEncoder(w io.Writer) RecordEncoder {
+	return &jsonEncoder{json.NewEncoder(w)}
+}
+
+func (JsonCodec) NewDecoder(r io.Reader) RecordDecoder {
+	return &jsonDecoder{json.NewDecoder(r)}
+}
+
+type jsonEncoder struct{ encoder *json.Encoder }
+
+func (e *jsonEncoder) Encode(kv *KeyValue) error { return e.encoder.Encode(kv) }
+
+type jsonDecoder struct{ decoder *json.Decoder }
+
+func (d *jsonDecoder) Decode(kv *KeyValue) error { return d.decoder.Decode(kv) }
+
+// Gob
+
+func (GobCodec) Name() string { return "gob" }
+
+func (GobCodec) NewEncoder(w io.Writer) RecordEncoder {
+	return &gobEncoder{gob.NewEncoder(w)}
+}
+
+func (GobCodec) NewDecoder(r io.Reader) RecordDecoder {
+	return &gobDecoder{gob.NewDecoder(r)}
+}
+
+type gobEncoder struct{ encoder *gob.Encoder }
+
+func (e *gobEncoder) Encode(kv *KeyValue) error { return e.encoder.Encode(kv) }
+
+type gobDecoder struct{ decoder *gob.Decoder }
+
+// Gob doesn't transmit empty fields, so kv is reset before decoding into it.
+func (d *gobDecoder) Decode(kv *KeyValue) error {
+	*kv = KeyValue{}
+	return d.decoder.Decode(kv)
+}
+
+// Binary
+
+func (BinaryCodec) Name() string { return "binary" }
+
+func (BinaryCodec) NewEncoder(w io.Writer) RecordEncoder {
+	return &binaryEncoder{w, make([]byte, binary.MaxVarintLen64)}
+}
+
+func (BinaryCodec) NewDecoder(r io.Reader) RecordDecoder {
+	if br, ok := r.(*bufio.Reader); ok {
+		return &binaryDecoder{br, make([]byte, 0)}
+	}
+	return &binaryDecoder{bufio.NewReader(r), make([]byte, 0)}
+}
+
+type binaryEncoder struct {
+	w      io.Writer
+	header []byte
+}
+
+func (e *binaryEncoder) Encode(kv *KeyValue) (err error) {
+	if err = e.writeString(kv.Key); err != nil {
+		return err
+	}
+	return e.writeString(kv.Value)
+}
+
+func (e *binaryEncoder) writeString(s string) (err error) {
+	n := binary.PutUvarint(e.header, uint64(len(s)))
+
+	if _, err = e.w.Write(e.header[:n]); err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(e.w, s)
+	return err
+}
+
+type binaryDecoder struct {
+	r      *bufio.Reader
+	buffer []byte
+}
+
+func (d *binaryDecoder) Decode(kv *KeyValue) (err error) {
+	if kv.Key, err = d.readString(); err != nil {
+		return err
+	}
+
+	if kv.Value, err = d.readString(); err == io.EOF {
+		// A key without a value means the file was truncated
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (d *binaryDecoder) readString() (string, error) {
+	length, err := binary.ReadUvarint(d.r)
+
+	if err != nil {
+		return "", err
+	}
+
+	if length > MAX_BINARY_FIELD_SIZE {
+		return "", fmt.Errorf("binary field of %v bytes is larger than %v bytes", length, MAX_BINARY_FIELD_SIZE)
+	}
+
+	// A truncated file may have a bogus length, so long fields only grow with the bytes
+	// actually read
+	if length > BINARY_FIELD_CHUNK_SIZE {
+		var field strings.Builder
+
+		if _, err = io.CopyN(&field, d.r, int64(length)); err != nil {
+			if errors.Is(err, io.EOF) {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		return field.String(), nil
+	}
+
+	if cap(d.buffer) < int(length) {
+		d.buffer = make([]byte, length)
+	}
+	d.buffer = d.buffer[:length]
+
+	if _, err = io.ReadFull(d.r, d.buffer); err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+
+	return string(d.buffer), nil
+}
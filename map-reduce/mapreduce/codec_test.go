@@ -0,0 +1,178 @@
+package mapreduce
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+)
+
+var testCodecs = []RecordCodec{JsonCodec{}, GobCodec{}, BinaryCodec{}}
+
+var testRecords = []KeyValue{
+	{"a", "1"},
+	{"", ""},
+	{"key", ""},
+	{"", "value"},
+	{"line\nbreak", "tab\tand \"quotes\""},
+	{"ação", "日本語"},
+	{string(bytes.Repeat([]byte("k"), 1000)), string(bytes.Repeat([]byte("v"), 100000))},
+}
+
+// Encode records with codec.
+func encodeTestRecords(t testing.TB, codec RecordCodec, records []KeyValue) []byte {
+	var buffer bytes.Buffer
+
+	encoder := codec.NewEncoder(&buffer)
+	for i := range records {
+		if err := encoder.Encode(&records[i]); err != nil {
+			t.Fatalf("%v: failed to encode record %v: %v", codec.Name(), i, err)
+		}
+	}
+	return buffer.Bytes()
+}
+
+// Decode records with codec until an error, which is io.EOF if data ended cleanly.
+func decodeTestRecords(codec RecordCodec, data []byte) (records []KeyValue, err error) {
+	var kv KeyValue
+
+	decoder := codec.NewDecoder(bytes.NewReader(data))
+	for {
+		if err = decoder.Decode(&kv); err != nil {
+			return records, err
+		}
+		records = append(records, kv)
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	for _, codec := range testCodecs {
+		if found, ok := CodecByName(codec.Name()); !ok || found != codec {
+			t.Errorf("CodecByName(%q) = %v, %v", codec.Name(), found, ok)
+		}
+	}
+
+	if _, ok := CodecByName("xml"); ok {
+		t.Error("CodecByName(\"xml\") found a codec")
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range testCodecs {
+		t.Run(codec.Name(), func(t *testing.T) {
+			records, err := decodeTestRecords(codec, encodeTestRecords(t, codec, testRecords))
+
+			if err != io.EOF {
+				t.Fatalf("decode ended with %v, want io.EOF", err)
+			}
+			if len(records) != len(testRecords) {
+				t.Fatalf("decoded %v records, want %v", len(records), len(testRecords))
+			}
+			for i := range records {
+				if records[i] != testRecords[i] {
+					t.Errorf("record %v = %.20q, want %.20q", i, records[i], testRecords[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCodecEmpty(t *testing.T) {
+	for _, codec := range testCodecs {
+		if records, err := decodeTestRecords(codec, nil); err != io.EOF || len(records) != 0 {
+			t.Errorf("%v: decoding nothing = %v records, %v; want io.EOF", codec.Name(), len(records), err)
+		}
+	}
+}
+
+// A file cut in the middle of a record must fail, not end as if it was complete.
+func TestCodecTruncated(t *testing.T) {
+	last := KeyValue{"truncated-key", "truncated-value"}
+
+	for _, codec := range testCodecs {
+		t.Run(codec.Name(), func(t *testing.T) {
+			complete := encodeTestRecords(t, codec, testRecords)
+			data := encodeTestRecords(t, codec, append(append([]KeyValue{}, testRecords...), last))
+
+			for cut := len(complete) + 1; cut < len(data)-1; cut++ {
+				records, err := decodeTestRecords(codec, data[:cut])
+
+				if err == nil || err == io.EOF {
+					t.Fatalf("cut at %v of %v: decode ended with %v", cut, len(data), err)
+				}
+				if len(records) != len(testRecords) {
+					t.Fatalf("cut at %v of %v: decoded %v records, want %v", cut, len(data), len(records), len(testRecords))
+				}
+			}
+		})
+	}
+}
+
+func TestBinaryCodecTruncatedValue(t *testing.T) {
+	// Key "k" without its value
+	_, err := decodeTestRecords(BinaryCodec{}, []byte{1, 'k'})
+
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("decode ended with %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+// A corrupt length must fail the decode instead of allocating it.
+func TestBinaryCodecCorruptLength(t *testing.T) {
+	lengths := map[string][]byte{
+		"huge":      binary.AppendUvarint(nil, math.MaxUint64),
+		"too large": binary.AppendUvarint(nil, MAX_BINARY_FIELD_SIZE+1),
+		"truncated": append(binary.AppendUvarint(nil, MAX_BINARY_FIELD_SIZE), "key"...),
+	}
+
+	for name, data := range lengths {
+		if _, err := decodeTestRecords(BinaryCodec{}, data); err == nil || err == io.EOF {
+			t.Errorf("%v: decode ended with %v", name, err)
+		}
+	}
+}
+
+// Records like the ones of word count: short words and counts.
+func benchmarkRecords(n int) []KeyValue {
+	records := make([]KeyValue, n)
+	for i := range records {
+		records[i] = KeyValue{fmt.Sprintf("word%v", i%5000), fmt.Sprint(i % 100)}
+	}
+	return records
+}
+
+func BenchmarkEncode(b *testing.B) {
+	records := benchmarkRecords(10000)
+
+	for _, codec := range testCodecs {
+		b.Run(codec.Name(), func(b *testing.B) {
+			b.SetBytes(int64(len(encodeTestRecords(b, codec, records))))
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				encodeTestRecords(b, codec, records)
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	records := benchmarkRecords(10000)
+
+	for _, codec := range testCodecs {
+		b.Run(codec.Name(), func(b *testing.B) {
+			data := encodeTestRecords(b, codec, records)
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeTestRecords(codec, data); err != io.EOF {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
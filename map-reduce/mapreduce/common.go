@@ -1,5 +1,7 @@
 package mapreduce
 
+import "time"
+
 // KeyValue is the type used to hold elements of maps and reduces results.
 type KeyValue struct {
 	Key   string
@@ -9,15 +11,123 @@ type KeyValue struct {
 // Task is the exposed struct of the Framework that the calling code should initialize
 // with the specific implementation of the operation.
 type Task struct {
+	// Optional, name under which the MapReduce functions of the task were registered
+	// with RegisterTask. Pool workers build the task of each stage from it.
+	Name string
+
+	// Optional, settings of the MapReduce functions of a registered task. Pool workers
+	// pass the ones of Master to the function registered under Name.
+	Params map[string]string
+
 	// MapReduce functions
 	Map     MapFunc
+	Combine CombineFunc // Optional, runs on the output of each map operation
 	Shuffle ShuffleFunc
 	Reduce  ReduceFunc
 
+	// Replaces Map when the input of map operations is read as records: with Input, or
+	// in the later stages of a pipeline, where it's a result partition of the previous
+	// stage
+	MapRecords MapRecordsFunc
+
+	// Optional, replace Map and MapRecords. They send their records to an Emitter as
+	// they produce them instead of returning them, so a map operation holds at most
+	// MapBufferSize bytes of its result in memory.
+	MapEmit        MapEmitFunc
+	MapRecordsEmit MapRecordsEmitFunc
+
+	// Set along with Shuffle by TypedTask.Apply, which decodes keys before shuffling
+	// them. Keys that can't be decoded fail the map operation instead of Shuffle.
+	typedShuffle func(*Task, string) (int, error)
+
+	// Optional, reads the input of the job in splits instead of InputChan or
+	// InputFilePathChan
+	Input InputFormat
+
 	// Jobs
 	NumReduceJobs int
 	NumMapFiles   int
 
+	// Encoding and compression of intermediate and result files.
+	// nil = JsonCodec, "" = COMPRESSION_NONE
+	Codec       RecordCodec
+	Compression Compression
+
+	// Memory budget (in bytes) used to buffer the result of a map operation before
+	// it's spilled to disk. 0 = DEFAULT_MAP_BUFFER_SIZE
+	MapBufferSize int
+
+	// Memory budget (in bytes) used to hold the map outputs of a reduce partition
+	// while they're merged. Map outputs that don't fit are merged from disk.
+	// 0 = DEFAULT_SORT_BUFFER_SIZE
+	SortBufferSize int
+
+	// Maximum number of sorted files merged at once by a reduce operation. Partitions
+	// with more map outputs are merged in several passes. 0 = DEFAULT_MERGE_FACTOR
+	MergeFactor int
+
+	// Fault tolerance. Master pings workers every HeartbeatInterval and removes
+	// those that don't answer for HeartbeatTimeout.
+	// 0 = DEFAULT_HEARTBEAT_INTERVAL and DEFAULT_HEARTBEAT_TIMEOUT
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+
+	// Deadline of a single map or reduce operation. Workers that don't finish in
+	// time are removed and the operation is scheduled again. 0 = no deadline
+	OperationTimeout time.Duration
+
+	// Number of times an operation can fail with an error, like the ones returned by
+	// the Map and Reduce functions, before the job fails. 0 = DEFAULT_MAX_ATTEMPTS
+	MaxAttempts int
+
+	// Speculative execution. Once SpeculativeThreshold (0..1) of the operations in a
+	// phase are completed, operations running for longer than SpeculativeDelay get a
+	// backup copy on an idle worker. 0 = disabled, 0 = DEFAULT_SPECULATIVE_DELAY
+	SpeculativeThreshold float64
+	SpeculativeDelay     time.Duration
+
+	// How Master hands out operations, set the same on Master and workers. With
+	// SCHEDULER_PULL, workers ask Master for operations over a single connection and
+	// don't accept connections themselves, so LocalStorage can't be used.
+	// "" = SCHEDULER_PUSH
+	Scheduler Scheduler
+
+	// Data locality. An operation waits up to LocalityWait for a free slot on a worker
+	// that holds its input file, or with LocalStorage most of its partition, before it
+	// runs on another worker. 0 = DEFAULT_LOCALITY_WAIT
+	LocalityWait time.Duration
+
+	// Keep intermediate files on the worker that created them. Reducers fetch their
+	// partition from every mapper and workers fetch input files they can't find from
+	// Master, so they don't need to share a filesystem. Each worker should run in
+	// its own working directory.
+	LocalStorage bool
+
+	// Working directories. Intermediate files are kept in ScratchDir and the result of
+	// each reduce job is written to OutputDir, both in a subdirectory named JobId, so
+	// jobs with different ids can share them. A Master only resumes a job from its
+	// journal with the same id, and one without a JobId uses the Name of the task, or
+	// DEFAULT_JOB_ID. Other jobs without one get a new id, in Result.JobId, and their
+	// intermediate files are removed once they're completed.
+	// "" = REDUCE_PATH and RESULT_PATH
+	JobId      string
+	ScratchDir string
+	OutputDir  string
+
+	// Remove the intermediate files of the job once it's completed
+	CleanupScratch bool
+
+	// Optional, writes the result of the job to files in OutputPath. Set on the last
+	// stage of a pipeline. nil = JSONLinesOutput in JOB_MASTER mode, and no files in
+	// the local modes, which only send the result to OutputChan
+	Output OutputFormat
+
+	// Write the output to a single file instead of one for each reduce job
+	MergeOutput bool
+
+	// Sort the output by key across all the output files
+	SortOutput bool
+
 	// Channels for data
 	InputChan  chan []byte
 	OutputChan chan []KeyValue
@@ -27,8 +137,52 @@ type Task struct {
 	OutputFilePathChan chan string
 }
 
+// Scheduler selects how workers get their operations from Master.
+type Scheduler string
+
+const (
+	SCHEDULER_PUSH Scheduler = "push" // Master calls the RPC server of each worker
+	SCHEDULER_PULL Scheduler = "pull" // Workers call Master.RequestTask and Master.ReportTask
+)
+
+// Returns the scheduler of task.
+func taskScheduler(task *Task) Scheduler {
+	if task.Scheduler == "" {
+		return SCHEDULER_PUSH
+	}
+	return task.Scheduler
+}
+
+// Iterator is used to go through all the values of a single key. It's what
+// Reduce and Combine functions receive along with the key being reduced.
+type Iterator interface {
+	// Next returns the next value of the key, or false when there are no values left.
+	Next() (string, bool)
+
+	// Counters returns the user-defined counters of the operation, see Counters.
+	Counters() *Counters
+}
+
+// Emitter receives the records of a map operation as they're produced. Emit fails once
+// a record can't be stored, like when Shuffle sends it to a reduce job that doesn't
+// exist, and the operation then fails with that error. It's not safe for concurrent use.
+type Emitter interface {
+	Emit(KeyValue) error
+
+	// Counters returns the user-defined counters of the operation, see Counters.
+	Counters() *Counters
+}
+
+// Combine and Reduce functions are called once per key, with keys in sorted order.
+// Since they share the same signature, a Reduce function can also be used as
+// a Combine function as long as its output can be reduced again.
+// An error returned by Map, Combine or Reduce fails the operation.
 type (
-	MapFunc     func([]byte) []KeyValue
-	ReduceFunc  func([]KeyValue) []KeyValue
-	ShuffleFunc func(*Task, string) int
+	MapFunc            func([]byte) ([]KeyValue, error)
+	MapRecordsFunc     func([]KeyValue) ([]KeyValue, error)
+	MapEmitFunc        func([]byte, Emitter) error
+	MapRecordsEmitFunc func([]KeyValue, Emitter) error
+	CombineFunc        func(string, Iterator) ([]KeyValue, error)
+	ReduceFunc         func(string, Iterator) ([]KeyValue, error)
+	ShuffleFunc        func(*Task, string) int
 )
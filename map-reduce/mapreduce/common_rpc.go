@@ -1,17 +1,205 @@
 // common_rpc.go defined all the parameters used in RPC between
-// master and workers
+// master and workers, and how they call each other
 package mapreduce
 
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"time"
+)
+
 type RegisterArgs struct {
 	WorkerHostname string
+
+	// Number of operations the worker can run at once. 0 = 1
+	Slots int
+
+	// How the worker gets its operations, it must be the same as Master's
+	Scheduler Scheduler
+
+	// Input files of the job that the worker holds locally
+	LocalInputs []string
+
+	// Set by pool workers, which build the task of each stage from the registered ones,
+	// with the names of the tasks they registered. A Pool registers them again with
+	// their job, JobId, or the first time with a job that isn't one of Jobs, the jobs
+	// the worker already serves.
+	Pool  bool
+	Tasks []string
+	JobId string
+	Jobs  []string
 }
 
 type RegisterReply struct {
-	WorkerId   int
-	ReduceJobs int
+	WorkerId int
+
+	// Workers register again if Master doesn't ping them for this long
+	HeartbeatTimeout time.Duration
+
+	// Intermediate files are kept on workers and fetched over RPC
+	LocalStorage bool
+
+	// Settings of each stage of the job
+	Stages []StageSettings
+
+	// Scheduler of Master. The worker wasn't registered if it's not the worker's one.
+	Scheduler Scheduler
+
+	// Workers that pull operations call Master.Heartbeat this often
+	HeartbeatInterval time.Duration
+}
+
+type StageSettings struct {
+	Name        string            // Registered task of the stage, used by pool workers
+	Params      map[string]string // Settings of the registered task
+	ReduceJobs  int
+	Codec       string
+	Compression Compression
+
+	// The input is read with an InputFormat
+	SplitInput bool
+
+	// Working directories of the stage
+	JobId          string
+	ScratchDir     string
+	OutputDir      string
+	CleanupScratch bool
+}
+
+// The calls between workers and Master carry the JobId of the job, so the ones of pool
+// workers reach the job they belong to.
+
+type PingArgs struct {
+	JobId string
+}
+
+type DoneArgs struct {
+	JobId string
+
+	// The job was completed, rather than failed or cancelled
+	JobCompleted bool
+}
+
+type DecommissionArgs struct {
+	JobId    string
+	WorkerId int
 }
 
 type RunArgs struct {
+	JobId    string // Operations of other jobs are rejected
+	Stage    int
 	Id       int
 	FilePath string
+
+	// Byte range of FilePath read by a map operation, with an InputFormat
+	Offset int64
+	Length int64
+
+	// Location of the output of every map operation, only set on reduce operations.
+	// The hostname is only used when workers store intermediate files locally.
+	MapOutputs []MapOutput
+}
+
+type RunReply struct {
+	// Map outputs that a reduce operation failed to read
+	FetchFailed []MapOutput
+
+	// Built-in and user-defined counters of the operation
+	Counters map[string]int64
+
+	// Size in bytes of each partition of the output of a map operation
+	PartitionSizes []int64
+}
+
+type MapOutput struct {
+	Id             int
+	WorkerHostname string
+}
+
+type TaskKind string
+
+const (
+	TASK_MAP    TaskKind = "map"
+	TASK_REDUCE TaskKind = "reduce"
+	TASK_WAIT   TaskKind = "wait" // Nothing to run yet, ask again
+	TASK_EXIT   TaskKind = "exit" // The job is over
+)
+
+type RequestTaskArgs struct {
+	JobId    string
+	WorkerId int
+}
+
+type RequestTaskReply struct {
+	Kind   TaskKind
+	TaskId int     // Identifies the operation in ReportTask
+	Args   RunArgs // Operation to run with TASK_MAP and TASK_REDUCE
+
+	// With TASK_EXIT, the job was completed rather than failed or cancelled
+	JobCompleted bool
+}
+
+type ReportTaskArgs struct {
+	JobId    string
+	WorkerId int
+	TaskId   int
+	Error    string // Error returned by the operation, "" = it succeeded
+	Reply    RunReply
+}
+
+type HeartbeatArgs struct {
+	JobId    string
+	WorkerId int
+}
+
+type FetchInputArgs struct {
+	JobId    string
+	FilePath string
+
+	// Byte range to read. 0 = the whole file
+	Offset int64
+	Length int
+}
+
+type FetchArgs struct {
+	JobId    string
+	Stage    int
+	MapId    int
+	ReduceId int
+
+	// Byte range to read, see fetchFile
+	Offset int64
+	Length int
+}
+
+type FetchReply struct {
+	Data []byte
+}
+
+// Connect to hostname and call remote procedure, giving up if connecting or waiting for
+// the reply takes longer than timeout.
+func callWithTimeout(hostname string, proc string, args interface{}, reply interface{}, timeout time.Duration) error {
+	var (
+		err    error
+		conn   net.Conn
+		client *rpc.Client
+		call   *rpc.Call
+	)
+
+	if conn, err = net.DialTimeout("tcp", hostname, timeout); err != nil {
+		return err
+	}
+
+	client = rpc.NewClient(conn)
+	defer client.Close()
+
+	call = client.Go(proc, args, reply, make(chan *rpc.Call, 1))
+
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(timeout):
+		return fmt.Errorf("%v timed out after %v", proc, timeout)
+	}
 }
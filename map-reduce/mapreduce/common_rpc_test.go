@@ -0,0 +1,54 @@
+package mapreduce
+
+import (
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testService struct{}
+
+func (testService) Echo(args *string, reply *string) error {
+	*reply = *args
+	return nil
+}
+
+func (testService) Sleep(args *time.Duration, _ *struct{}) error {
+	time.Sleep(*args)
+	return nil
+}
+
+// Returns the address of an RPC server with testService, closed with the test.
+func startTestServer(t *testing.T) string {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Test", testService{}); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go server.Accept(listener)
+	return listener.Addr().String()
+}
+
+func TestCallWithTimeout(t *testing.T) {
+	hostname := startTestServer(t)
+
+	var reply string
+	if err := callWithTimeout(hostname, "Test.Echo", "hello", &reply, time.Second); err != nil || reply != "hello" {
+		t.Errorf("Echo = %q, %v", reply, err)
+	}
+
+	delay := time.Second
+	start := time.Now()
+	err := callWithTimeout(hostname, "Test.Sleep", &delay, new(struct{}), 50*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") || time.Since(start) > delay/2 {
+		t.Errorf("Sleep returned %v after %v, want a timeout", err, time.Since(start))
+	}
+}
@@ -0,0 +1,84 @@
+package mapreduce
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Compression is the algorithm used to compress intermediate and result files.
+// Like the codec, it's sent to workers when they register.
+type Compression string
+
+const (
+	COMPRESSION_NONE Compression = "none"
+	COMPRESSION_GZIP Compression = "gzip"
+	COMPRESSION_ZLIB Compression = "zlib"
+	// Raw deflate with the fastest compression level. It's the cheapest option
+	// available without vendoring third-party codecs such as snappy.
+	COMPRESSION_FAST Compression = "fast"
+)
+
+// ParseCompression returns the Compression with the given name.
+func ParseCompression(name string) (Compression, error) {
+	switch compression := Compression(strings.ToLower(name)); compression {
+	case "", COMPRESSION_NONE:
+		return COMPRESSION_NONE, nil
+	case COMPRESSION_GZIP, COMPRESSION_ZLIB, COMPRESSION_FAST:
+		return compression, nil
+	default:
+		return COMPRESSION_NONE, fmt.Errorf("unknown compression '%v'", name)
+	}
+}
+
+// Returns the compression used by task.
+func taskCompression(task *Task) Compression {
+	if task.Compression == "" {
+		return COMPRESSION_NONE
+	}
+	return task.Compression
+}
+
+// nopWriteCloser is used when data isn't compressed, so closing the
+// compressor doesn't close the underlying writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Wrap w so everything written is compressed. Closing the returned writer
+// flushes the compressed data, but doesn't close w.
+func newCompressor(compression Compression, w io.Writer) (io.WriteCloser, error) {
+	switch compression {
+	case COMPRESSION_NONE:
+		return nopWriteCloser{w}, nil
+	case COMPRESSION_GZIP:
+		return gzip.NewWriter(w), nil
+	case COMPRESSION_ZLIB:
+		return zlib.NewWriter(w), nil
+	case COMPRESSION_FAST:
+		return flate.NewWriter(w, flate.BestSpeed)
+	default:
+		return nil, fmt.Errorf("unknown compression '%v'", compression)
+	}
+}
+
+// Wrap r so everything read is decompressed.
+func newDecompressor(compression Compression, r io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case COMPRESSION_NONE:
+		return io.NopCloser(r), nil
+	case COMPRESSION_GZIP:
+		return gzip.NewReader(r)
+	case COMPRESSION_ZLIB:
+		return zlib.NewReader(r)
+	case COMPRESSION_FAST:
+		return flate.NewReader(r), nil
+	default:
+		return nil, fmt.Errorf("unknown compression '%v'", compression)
+	}
+}
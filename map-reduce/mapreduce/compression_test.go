@@ -0,0 +1,101 @@
+package mapreduce
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testCompressions = []Compression{COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_ZLIB, COMPRESSION_FAST}
+
+func TestParseCompression(t *testing.T) {
+	for _, compression := range testCompressions {
+		if parsed, err := ParseCompression(strings.ToUpper(string(compression))); err != nil || parsed != compression {
+			t.Errorf("ParseCompression(%q) = %v, %v", compression, parsed, err)
+		}
+	}
+
+	if parsed, err := ParseCompression(""); err != nil || parsed != COMPRESSION_NONE {
+		t.Errorf("ParseCompression(\"\") = %v, %v", parsed, err)
+	}
+	if _, err := ParseCompression("snappy"); err == nil {
+		t.Error("ParseCompression(\"snappy\") succeeded")
+	}
+}
+
+// Write records to a record file of task at path and read them back.
+func roundTripRecordFile(t *testing.T, task *Task, path string, records []KeyValue) []KeyValue {
+	writer, err := createRecordFile(task, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range records {
+		if err = writer.write(&records[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writer.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := openFileStream(task, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := readStream(stream)
+	if err = stream.err(); err != nil {
+		t.Fatalf("%v: %v", path, err)
+	}
+	return read
+}
+
+// Record files are read back the same with every codec and compression, and compressed
+// ones are smaller when the records repeat.
+func TestRecordFileCompression(t *testing.T) {
+	var (
+		dir       string = t.TempDir()
+		repeated  []KeyValue
+		plainSize map[string]int64 = make(map[string]int64)
+	)
+
+	for i := 0; i < 1000; i++ {
+		repeated = append(repeated, KeyValue{"word", "1"})
+	}
+
+	for _, compression := range testCompressions {
+		for _, codec := range testCodecs {
+			task := &Task{Codec: codec, Compression: compression}
+
+			for name, records := range map[string][]KeyValue{"records": testRecords, "repeated": repeated, "empty": nil} {
+				path := filepath.Join(dir, fmt.Sprintf("%v-%v-%v", compression, codec.Name(), name))
+
+				if read := roundTripRecordFile(t, task, path, records); fmt.Sprint(read) != fmt.Sprint(records) {
+					t.Errorf("%v, %v: read %v %v, want %v", compression, codec.Name(), len(read), name, len(records))
+				}
+			}
+
+			size := fileSize(filepath.Join(dir, fmt.Sprintf("%v-%v-repeated", compression, codec.Name())))
+			if compression == COMPRESSION_NONE {
+				plainSize[codec.Name()] = size
+			} else if size >= plainSize[codec.Name()] {
+				t.Errorf("%v, %v: compressed file of %v bytes, %v uncompressed", compression, codec.Name(), size, plainSize[codec.Name()])
+			}
+		}
+	}
+}
+
+// A compressed file read without its compression fails instead of returning garbage.
+func TestRecordFileCompressionMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records")
+	roundTripRecordFile(t, &Task{Codec: BinaryCodec{}, Compression: COMPRESSION_GZIP}, path, testRecords)
+
+	stream, err := openFileStream(&Task{Codec: BinaryCodec{}, Compression: COMPRESSION_ZLIB}, path)
+	if err == nil {
+		readStream(stream)
+		err = stream.err()
+	}
+	if err == nil {
+		t.Error("read a gzip file as zlib")
+	}
+}
@@ -0,0 +1,279 @@
+package mapreduce
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Built-in counters, kept by the framework for every operation and job
+const (
+	MAP_INPUT_RECORDS     = "MAP_INPUT_RECORDS"     // Records passed to MapRecords, or chunks of data passed to Map
+	MAP_OUTPUT_RECORDS    = "MAP_OUTPUT_RECORDS"    // Records returned or emitted by the map functions
+	SPILLED_BYTES         = "SPILLED_BYTES"         // Bytes of map results spilled to disk before their final output
+	SHUFFLE_BYTES         = "SHUFFLE_BYTES"         // Bytes of map outputs read by reduce operations
+	REDUCE_INPUT_RECORDS  = "REDUCE_INPUT_RECORDS"  // Values passed to the reduce functions
+	REDUCE_OUTPUT_RECORDS = "REDUCE_OUTPUT_RECORDS" // Records returned by the reduce functions
+	OPERATION_RETRIES     = "OPERATION_RETRIES"     // Operations run again after they failed or their output was lost
+	FAILED_WORKERS        = "FAILED_WORKERS"        // Workers removed by Master
+
+	// Attempts of operations whose data some worker holds, by whether they ran on it
+	DATA_LOCAL_MAPS    = "DATA_LOCAL_MAPS"    // Map attempts run on a worker holding their input file
+	NON_LOCAL_MAPS     = "NON_LOCAL_MAPS"     // Map attempts run on another worker
+	DATA_LOCAL_REDUCES = "DATA_LOCAL_REDUCES" // Reduce attempts run on the worker holding most of their partition
+	NON_LOCAL_REDUCES  = "NON_LOCAL_REDUCES"  // Reduce attempts run on another worker
+)
+
+const (
+	PHASE_MAP    = "map"
+	PHASE_REDUCE = "reduce"
+)
+
+// Counters are named counters that can be updated concurrently. User-defined counters
+// are incremented by the MapReduce functions on the Counters of their Emitter or
+// Iterator, which belong to a single attempt of the operation. They are kept with the
+// counters of the operation, which in the distributed modes are sent to Master, and
+// added up into the Result of the job only if the attempt completes. A nil *Counters
+// ignores increments.
+type Counters struct {
+	mutex  sync.Mutex
+	values map[string]int64
+}
+
+// Add adds delta to the counter name.
+func (counters *Counters) Add(name string, delta int64) {
+	if counters == nil {
+		return
+	}
+
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+
+	if counters.values == nil {
+		counters.values = make(map[string]int64)
+	}
+	counters.values[name] += delta
+}
+
+// Get returns the value of the counter name.
+func (counters *Counters) Get(name string) int64 {
+	if counters == nil {
+		return 0
+	}
+
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	return counters.values[name]
+}
+
+// Values returns a copy of all the counters.
+func (counters *Counters) Values() map[string]int64 {
+	var values map[string]int64 = make(map[string]int64)
+
+	if counters == nil {
+		return values
+	}
+
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+
+	for name, value := range counters.values {
+		values[name] = value
+	}
+	return values
+}
+
+// Add every one of values to the counters.
+func (counters *Counters) addAll(values map[string]int64) {
+	for name, value := range values {
+		counters.Add(name, value)
+	}
+}
+
+// OperationStats describes an operation that was completed.
+type OperationStats struct {
+	Stage    int
+	Phase    string // PHASE_MAP or PHASE_REDUCE
+	Id       int
+	Worker   string // Hostname of the worker that ran it, "" in the local modes
+	Duration time.Duration
+	Counters map[string]int64
+}
+
+// jobStats collects the counters and the stats of the operations of a job.
+type jobStats struct {
+	mutex      sync.Mutex
+	counters   Counters
+	operations []OperationStats
+}
+
+// Add a completed operation.
+func (stats *jobStats) add(operation OperationStats) {
+	stats.counters.addAll(operation.Counters)
+
+	stats.mutex.Lock()
+	stats.operations = append(stats.operations, operation)
+	stats.mutex.Unlock()
+}
+
+// Copy the counters and operations to result.
+func (stats *jobStats) fill(result *Result) {
+	stats.mutex.Lock()
+	result.Operations = append(result.Operations, stats.operations...)
+	stats.mutex.Unlock()
+
+	result.Counters = stats.counters.Values()
+}
+
+// Returns the stats of an operation that started at start, with the counters of the
+// attempt.
+func operationStats(phase string, id int, start time.Time, counters *Counters) OperationStats {
+	return OperationStats{
+		Phase:    phase,
+		Id:       id,
+		Duration: time.Since(start),
+		Counters: counters.Values(),
+	}
+}
+
+// Returns the phase of an operation run by proc.
+func operationPhase(proc string) string {
+	if proc == "Worker.RunMap" {
+		return PHASE_MAP
+	}
+	return PHASE_REDUCE
+}
+
+// Returns the size of the file at path, or 0 if it can't be read.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// countingStream is a recordStream that counts the records read from stream.
+type countingStream struct {
+	recordStream
+	counters *Counters
+	name     string
+}
+
+func (stream *countingStream) next() (kv KeyValue, ok bool) {
+	if kv, ok = stream.recordStream.next(); ok {
+		stream.counters.Add(stream.name, 1)
+	}
+	return kv, ok
+}
+
+// Add the counters and operations of a stage to the result of the job.
+func (result *Result) addStage(stage int, stageResult *Result) {
+	var counters Counters
+
+	result.NumMapOperations += stageResult.NumMapOperations
+	result.NumReduceOperations += stageResult.NumReduceOperations
+
+	for _, operation := range stageResult.Operations {
+		operation.Stage = stage
+		result.Operations = append(result.Operations, operation)
+	}
+
+	counters.addAll(result.Counters)
+	counters.addAll(stageResult.Counters)
+	result.Counters = counters.Values()
+}
+
+// Summary describes the job: its counters, how many attempts ran where their data is,
+// how long its operations took in each stage and phase, and the bytes shuffled to each
+// reduce operation.
+func (result *Result) Summary() string {
+	var (
+		builder strings.Builder
+		names   []string
+	)
+
+	fmt.Fprintf(&builder, "Job completed in %v (Map operations: %v, Reduce operations: %v)\n",
+		result.Duration.Round(time.Millisecond), result.NumMapOperations, result.NumReduceOperations)
+
+	for name := range result.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	builder.WriteString("Counters:\n")
+	for _, name := range names {
+		fmt.Fprintf(&builder, "  %-24v %v\n", name, result.Counters[name])
+	}
+
+	localityRate(&builder, PHASE_MAP, result.Counters[DATA_LOCAL_MAPS], result.Counters[NON_LOCAL_MAPS])
+	localityRate(&builder, PHASE_REDUCE, result.Counters[DATA_LOCAL_REDUCES], result.Counters[NON_LOCAL_REDUCES])
+
+	if len(result.Operations) == 0 {
+		return builder.String()
+	}
+
+	builder.WriteString("Operations:\n")
+	for _, group := range groupOperations(result.Operations) {
+		var total, longest time.Duration
+
+		for _, operation := range group {
+			total += operation.Duration
+			if operation.Duration > longest {
+				longest = operation.Duration
+			}
+		}
+
+		fmt.Fprintf(&builder, "  stage %v %-6v %4v operations, average %v, longest %v\n", group[0].Stage, group[0].Phase,
+			len(group), (total / time.Duration(len(group))).Round(time.Millisecond), longest.Round(time.Millisecond))
+
+		if group[0].Phase == PHASE_REDUCE {
+			builder.WriteString("    shuffled bytes:")
+			for _, operation := range group {
+				fmt.Fprintf(&builder, " %v=%v", operation.Id, operation.Counters[SHUFFLE_BYTES])
+			}
+			builder.WriteString("\n")
+		}
+	}
+
+	return builder.String()
+}
+
+// Write the share of the attempts of a phase that ran on a worker holding their data,
+// if some worker held it.
+func localityRate(builder *strings.Builder, phase string, local int64, other int64) {
+	if local+other == 0 {
+		return
+	}
+
+	fmt.Fprintf(builder, "Locality: %-6v %v/%v attempts data-local (%.1f%%)\n", phase, local, local+other,
+		100*float64(local)/float64(local+other))
+}
+
+// Returns the operations grouped by stage and phase, in order, with the operations of
+// each group sorted by id.
+func groupOperations(operations []OperationStats) (groups [][]OperationStats) {
+	sorted := append([]OperationStats(nil), operations...)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Stage != sorted[j].Stage {
+			return sorted[i].Stage < sorted[j].Stage
+		}
+		if sorted[i].Phase != sorted[j].Phase {
+			return sorted[i].Phase == PHASE_MAP
+		}
+		return sorted[i].Id < sorted[j].Id
+	})
+
+	for i, operation := range sorted {
+		if i == 0 || operation.Stage != sorted[i-1].Stage || operation.Phase != sorted[i-1].Phase {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], operation)
+	}
+
+	return groups
+}
@@ -0,0 +1,93 @@
+package mapreduce
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	var (
+		counters Counters
+		wg       sync.WaitGroup
+	)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				counters.Add("a", 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counters.Get("a") != 1000 || counters.Get("b") != 0 {
+		t.Errorf("a = %v, b = %v; want 1000 and 0", counters.Get("a"), counters.Get("b"))
+	}
+
+	values := counters.Values()
+	values["a"] = 0
+	if counters.Get("a") != 1000 {
+		t.Error("Values didn't return a copy")
+	}
+
+	// A nil *Counters ignores increments
+	var none *Counters
+	none.Add("a", 1)
+	if none.Get("a") != 0 || len(none.Values()) != 0 {
+		t.Error("nil Counters counted")
+	}
+}
+
+// The built-in counters and the ones of the MapReduce functions are added up into the
+// result of the job.
+func TestJobCounters(t *testing.T) {
+	task := newTestWordCountTask(t, 2)
+	task.Combine = func(key string, values Iterator) ([]KeyValue, error) {
+		values.Counters().Add("COMBINED_KEYS", 1)
+		return testSumFunc(key, values)
+	}
+	reduce := task.Reduce
+	task.Reduce = func(key string, values Iterator) ([]KeyValue, error) {
+		values.Counters().Add("REDUCED_KEYS", 1)
+		return reduce(key, values)
+	}
+
+	for _, mode := range []JobMode{JOB_SEQUENTIAL, JOB_PARALLEL} {
+		result, _, err := runTestJob(context.Background(), &Job{Task: task, Mode: mode}, []string{"a b a", "b c", "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]int64{
+			MAP_INPUT_RECORDS:     3,
+			MAP_OUTPUT_RECORDS:    6,
+			REDUCE_INPUT_RECORDS:  5, // Combined by map operation: {a 2} {b 1}, {b 1} {c 1}, {a 1}
+			REDUCE_OUTPUT_RECORDS: 3,
+			"COMBINED_KEYS":       5,
+			"REDUCED_KEYS":        3,
+		}
+		for name, value := range want {
+			if result.Counters[name] != value {
+				t.Errorf("%v: %v = %v, want %v", mode, name, result.Counters[name], value)
+			}
+		}
+		if result.Counters[SHUFFLE_BYTES] == 0 {
+			t.Errorf("%v: no shuffled bytes counted", mode)
+		}
+
+		if len(result.Operations) != 5 {
+			t.Errorf("%v: stats of %v operations, want 5", mode, len(result.Operations))
+		}
+
+		summary := result.Summary()
+		for _, line := range []string{"REDUCED_KEYS", "stage 0 map       3 operations", "stage 0 reduce    2 operations", "shuffled bytes: 0="} {
+			if !strings.Contains(summary, line) {
+				t.Errorf("%v: summary without %q:\n%v", mode, line, summary)
+			}
+		}
+	}
+}
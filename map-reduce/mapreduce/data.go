@@ -1,11 +1,14 @@
 package mapreduce
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,177 +16,194 @@ const (
 	REDUCE_PATH = "reduce/"
 	RESULT_PATH = "result/"
 
+	// Job id of a Master job whose task has no Name
+	DEFAULT_JOB_ID = "default"
+
 	OPEN_FILE_MAX_RETRY = 3
 )
 
-// Returns the name of files created after merge
-func mergeReduceName(idReduce int) string {
-	return fmt.Sprintf("reduce-%v", idReduce)
-}
+// Number of job ids generated by this process
+var numJobIds int64
 
-// Returns the name of files created after map
-func reduceName(idMap int, idReduce int) string {
-	return fmt.Sprintf("reduce-%v-%v", idMap, idReduce)
+// ScratchPath returns the directory where the job keeps its intermediate files. Jobs
+// that run always have a JobId, so it's never ScratchDir itself.
+func (task *Task) ScratchPath() string {
+	var dir string = task.ScratchDir
+	if dir == "" {
+		dir = REDUCE_PATH
+	}
+	return filepath.Join(dir, task.JobId)
 }
 
-// Store result from map operation locally.
-// This will store the result from all the map calls.
-func storeLocal(task *Task, idMapTask int, data []KeyValue) {
-	var (
-		err         error
-		file        *os.File
-		fileEncoder *json.Encoder
-	)
-
-	for r := 0; r < task.NumReduceJobs; r++ {
-		file, err = os.Create(filepath.Join(REDUCE_PATH, reduceName(idMapTask, r)))
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		fileEncoder = json.NewEncoder(file)
-		for _, kv := range data {
-			if task.Shuffle(task, kv.Key) == r {
-				err = fileEncoder.Encode(&kv)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
-		}
-		file.Sync()
-		file.Close()
+// OutputPath returns the directory where the job writes the result of each reduce job.
+func (task *Task) OutputPath() string {
+	var dir string = task.OutputDir
+	if dir == "" {
+		dir = RESULT_PATH
 	}
+	return filepath.Join(dir, task.JobId)
 }
 
-// Merge the result from all the map operations by reduce job id.
-func mergeMapLocal(task *Task, mapCounter int) {
-	var (
-		err              error
-		file             *os.File
-		fileDecoder      *json.Decoder
-		mergeFile        *os.File
-		mergeFileEncoder *json.Encoder
-	)
+// Returns the job id of a Master job without one: the Name of its task, or
+// DEFAULT_JOB_ID. It's the same every time the job runs, so a restarted Master finds
+// the journal of the job.
+func defaultJobId(task *Task) string {
+	if checkJobId(task.Name) == nil {
+		return task.Name
+	}
+	return DEFAULT_JOB_ID
+}
 
-	for r := 0; r < task.NumReduceJobs; r++ {
-		if mergeFile, err = os.Create(filepath.Join(REDUCE_PATH, mergeReduceName(r))); err != nil {
-			log.Fatal(err)
-		}
+// Returns a new job id, unique across the jobs started on this host.
+func newJobId() string {
+	return fmt.Sprintf("job-%v-%v-%v", time.Now().Format("20060102-150405"), os.Getpid(), atomic.AddInt64(&numJobIds, 1))
+}
 
-		mergeFileEncoder = json.NewEncoder(mergeFile)
-
-		for m := 0; m < mapCounter; m++ {
-			for i := 0; i < OPEN_FILE_MAX_RETRY; i++ {
-				if file, err = os.Open(filepath.Join(REDUCE_PATH, reduceName(m, r))); err == nil {
-					break
-				}
-				log.Printf("(%v/%v) Failed to open file %v. Retrying in 1 second...", i+1, OPEN_FILE_MAX_RETRY, filepath.Join(REDUCE_PATH, reduceName(m, r)))
-				time.Sleep(time.Second)
-			}
-
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			if file, err = os.Open(filepath.Join(REDUCE_PATH, reduceName(m, r))); err != nil {
-				log.Fatal(err)
-			}
-
-			fileDecoder = json.NewDecoder(file)
-
-			for {
-				var kv KeyValue
-				err = fileDecoder.Decode(&kv)
-				if err != nil {
-					break
-				}
-
-				mergeFileEncoder.Encode(&kv)
-			}
-			file.Sync()
-			file.Close()
-		}
+// Returns an error if the job id can't be used as the name of a directory. The files
+// of a job are never kept in ScratchDir or OutputDir themselves, since they're removed.
+func checkJobId(jobId string) error {
+	if jobId == "" || jobId == "." || jobId == ".." || strings.ContainsAny(jobId, `/\`) {
+		return fmt.Errorf("invalid job id '%v'", jobId)
+	}
+	return nil
+}
 
-		mergeFile.Sync()
-		mergeFile.Close()
+// Create the working directories of the job.
+func createWorkDirs(task *Task) error {
+	if err := checkJobId(task.JobId); err != nil {
+		return err
 	}
+	if err := os.MkdirAll(task.ScratchPath(), os.ModePerm); err != nil {
+		return err
+	}
+	return os.MkdirAll(task.OutputPath(), os.ModePerm)
 }
 
-// Merge the result from all the map operations by reduce job id.
-func mergeReduceLocal(reduceCounter int) {
-	var (
-		err              error
-		file             *os.File
-		fileDecoder      *json.Decoder
-		mergeFile        *os.File
-		mergeFileEncoder *json.Encoder
-	)
+// Remove the intermediate files of a completed job if the task asks for it.
+func cleanupScratch(task *Task) {
+	if !task.CleanupScratch {
+		return
+	}
 
-	if mergeFile, err = os.Create(filepath.Join(RESULT_PATH, "result-final.txt")); err != nil {
-		log.Fatal(err)
+	if err := os.RemoveAll(task.ScratchPath()); err != nil {
+		log.Println("Failed to remove intermediate files. Error:", err)
 	}
+}
 
-	defer mergeFile.Sync()
-	defer mergeFile.Close()
+// Remove the intermediate files of a stage that isn't the last one of the job, but its
+// journal, which is removed once the job is over.
+func cleanupStageScratch(task *Task) {
+	if !task.CleanupScratch {
+		return
+	}
 
-	mergeFileEncoder = json.NewEncoder(mergeFile)
+	entries, err := os.ReadDir(task.ScratchPath())
+	if err != nil {
+		log.Println("Failed to remove intermediate files. Error:", err)
+		return
+	}
 
-	for r := 0; r < reduceCounter; r++ {
-		for i := 0; i < OPEN_FILE_MAX_RETRY; i++ {
-			if file, err = os.Open(resultFileName(r)); err == nil {
-				break
-			}
-			log.Printf("(%v/%v) Failed to open file %v. Retrying in 1 second...", i+1, OPEN_FILE_MAX_RETRY, resultFileName(r))
-			time.Sleep(time.Second)
+	for _, entry := range entries {
+		if entry.Name() == JOURNAL_FILE {
+			continue
 		}
-
-		if err != nil {
-			log.Fatal(err)
+		if err = os.RemoveAll(filepath.Join(task.ScratchPath(), entry.Name())); err != nil {
+			log.Println("Failed to remove intermediate files. Error:", err)
 		}
+	}
+}
 
-		fileDecoder = json.NewDecoder(file)
+// Returns the name of files created after merge
+func mergeReduceName(idReduce int) string {
+	return fmt.Sprintf("reduce-%v", idReduce)
+}
 
-		for {
-			var kv KeyValue
-			err = fileDecoder.Decode(&kv)
-			if err != nil {
-				break
-			}
+// Returns the name of files created after map
+func reduceName(idMap int, idReduce int) string {
+	return fmt.Sprintf("reduce-%v-%v", idMap, idReduce)
+}
 
-			mergeFileEncoder.Encode(&kv)
-		}
-		file.Sync()
-		file.Close()
+// Returns the name of the directory with all the files created by a map operation
+func mapOutputDir(idMap int) string {
+	return fmt.Sprintf("map-%v", idMap)
+}
+
+// Returns the path of a file created by a map operation, once it's committed
+func mapOutputPath(task *Task, idMap int, idReduce int) string {
+	return filepath.Join(task.ScratchPath(), mapOutputDir(idMap), reduceName(idMap, idReduce))
+}
+
+// Returns the paths of the files created by map operations 0..numMaps-1 for a reduce job
+func mapOutputPaths(task *Task, numMaps int, idReduce int) (paths []string) {
+	paths = make([]string, 0, numMaps)
+	for m := 0; m < numMaps; m++ {
+		paths = append(paths, mapOutputPath(task, m, idReduce))
 	}
+	return paths
 }
 
-// Load data for reduce jobs.
-func loadLocal(idReduce int) (data []KeyValue) {
-	var (
-		err         error
-		file        *os.File
-		fileDecoder *json.Decoder
-	)
+// Run a map operation of task on input and store its result locally.
+// The records are partitioned by reduce job as the map function produces them, in a
+// single pass, and sorted (and combined, if the task defines a Combine function)
+// within each partition, using at most task.MapBufferSize bytes of memory before
+// spilling to disk. The files are committed at once when they are complete, unless ctx
+// is cancelled first. Spilled bytes are counted in counters.
+func mapLocal(ctx context.Context, task *Task, idMapTask int, input mapInput, counters *Counters) (err error) {
+	var buffer *mapOutputBuffer
 
-	if file, err = os.Open(filepath.Join(REDUCE_PATH, mergeReduceName(idReduce))); err != nil {
-		log.Fatal(err)
+	if buffer, err = newMapOutputBuffer(task, idMapTask, counters); err != nil {
+		return err
 	}
 
-	fileDecoder = json.NewDecoder(file)
+	if err = callMap(task, input, buffer.add, counters); err == nil {
+		err = buffer.close()
+	}
 
-	data = make([]KeyValue, 0)
+	if err != nil {
+		buffer.discard()
+		return fmt.Errorf("map %v: %w", idMapTask, err)
+	}
 
-	for {
-		var kv KeyValue
-		if err = fileDecoder.Decode(&kv); err != nil {
-			break
+	// Operations still running when the job is stopped aren't committed
+	if err = ctx.Err(); err != nil {
+		buffer.discard()
+		return err
+	}
+
+	return buffer.commit()
+}
+
+// Write the result files of the reduce operations with the output format of task.
+func writeResultOutput(task *Task, reduceCounter int) error {
+	return writeOutput(task, reduceCounter, func(partition int) (recordStream, error) {
+		file, err := openRecordFileWithRetry(task, resultFileName(task, partition))
+		if err != nil {
+			return nil, err
 		}
+		return &fileStream{file: file}, nil
+	})
+}
 
-		data = append(data, kv)
+// Returns true if all the files created by an operation exist.
+func operationOutputExists(task *Task, proc string, id int) bool {
+	var paths []string
+
+	switch proc {
+	case "Worker.RunMap":
+		for r := 0; r < task.NumReduceJobs; r++ {
+			paths = append(paths, mapOutputPath(task, id, r))
+		}
+	case "Worker.RunReduce":
+		paths = append(paths, resultFileName(task, id))
 	}
 
-	file.Close()
-	return data
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			return false
+		}
+	}
+
+	return true
 }
 
 func RemoveContents(dir string) error {
@@ -208,7 +228,7 @@ func RemoveContents(dir string) error {
 // FanIn is a pattern that will return a channel in which the goroutines generated here will keep
 // writing until the loop is done.
 // This is used to generate the name of all the reduce files.
-func fanReduceFilePath(numReduceJobs int) chan string {
+func fanReduceFilePath(task *Task, numReduceJobs int) chan string {
 	var (
 		outputChan chan string
 		filePath   string
@@ -218,7 +238,7 @@ func fanReduceFilePath(numReduceJobs int) chan string {
 
 	go func() {
 		for i := 0; i < numReduceJobs; i++ {
-			filePath = filepath.Join(REDUCE_PATH, mergeReduceName(i))
+			filePath = filepath.Join(task.ScratchPath(), mergeReduceName(i))
 
 			outputChan <- filePath
 		}
@@ -228,7 +248,94 @@ func fanReduceFilePath(numReduceJobs int) chan string {
 	return outputChan
 }
 
+// fanResultFilePath will return a channel with the paths of the result files of a
+// stage, the map inputs of the next stage of a pipeline.
+func fanResultFilePath(task *Task) chan string {
+	var outputChan chan string = make(chan string)
+
+	go func() {
+		for i := 0; i < task.NumReduceJobs; i++ {
+			outputChan <- resultFileName(task, i)
+		}
+
+		close(outputChan)
+	}()
+	return outputChan
+}
+
+// Returns a channel with splits of the whole files received from filePathChan.
+func wholeFileSplits(filePathChan chan string) chan InputSplit {
+	var outputChan chan InputSplit = make(chan InputSplit)
+
+	go func() {
+		for filePath := range filePathChan {
+			outputChan <- InputSplit{Path: filePath}
+		}
+
+		close(outputChan)
+	}()
+	return outputChan
+}
+
+// Returns a buffered channel with splits.
+func fanSplits(splits []InputSplit) chan InputSplit {
+	var outputChan chan InputSplit = make(chan InputSplit, len(splits))
+
+	for _, split := range splits {
+		outputChan <- split
+	}
+
+	close(outputChan)
+	return outputChan
+}
+
 // Support function to generate the name of result files
-func resultFileName(id int) string {
-	return filepath.Join(RESULT_PATH, fmt.Sprintf("result-%v", id))
+func resultFileName(task *Task, id int) string {
+	return filepath.Join(task.OutputPath(), fmt.Sprintf("result-%v", id))
+}
+
+// Read length bytes of the file at path from offset. Reading past the end of the file
+// returns less data.
+func readChunk(path string, offset int64, length int) (data []byte, err error) {
+	var (
+		n    int
+		file *os.File
+	)
+
+	if file, err = os.Open(path); err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data = make([]byte, length)
+	n, err = file.ReadAt(data, offset)
+
+	if err == io.EOF {
+		err = nil
+	}
+	return data[:n], err
+}
+
+// fetchFile copies a file from another machine to w, one chunk of FETCH_CHUNK_SIZE
+// bytes per call to fetch, so the file is never held in memory as a whole.
+func fetchFile(w io.Writer, args FetchArgs, fetch func(args *FetchArgs, reply *FetchReply) error) error {
+	args.Offset = 0
+	args.Length = FETCH_CHUNK_SIZE
+
+	for {
+		reply := new(FetchReply)
+
+		if err := fetch(&args, reply); err != nil {
+			return err
+		}
+		if _, err := w.Write(reply.Data); err != nil {
+			return err
+		}
+
+		// The last chunk is shorter, and empty if the file ends at a chunk boundary
+		if len(reply.Data) < args.Length {
+			return nil
+		}
+		args.Offset += int64(len(reply.Data))
+	}
 }
@@ -0,0 +1,362 @@
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	DEFAULT_SPLIT_SIZE = 32 * 1024 * 1024
+	INPUT_BUFFER_SIZE  = 64 * 1024
+)
+
+// InputFormat reads the input of a job as records. The input is divided into splits,
+// each one read by a single map operation, which passes its records to MapRecords.
+// Splits are computed where the job is scheduled, and read where the map operation
+// runs, so in the distributed modes both Master and workers should set the same
+// InputFormat on their Task.
+type InputFormat interface {
+	// Splits returns the splits of the input, in order.
+	Splits() ([]InputSplit, error)
+
+	// NewReader returns a reader of the records of split. file holds the contents of
+	// split.Path. Readers may read past the end of the split to complete its last record.
+	NewReader(split InputSplit, file io.ReaderAt) (RecordReader, error)
+}
+
+// pathInput is an InputFormat that reads the files matched by glob patterns.
+type pathInput interface {
+	inputPaths() []string
+}
+
+// RecordReader reads the records of a split.
+type RecordReader interface {
+	// Read reads the next record into kv. Returns io.EOF when there are no records left.
+	Read(kv *KeyValue) error
+}
+
+// InputSplit is a byte range of an input file.
+type InputSplit struct {
+	Path   string
+	Offset int64
+	Length int64 // 0 = up to the end of the file
+}
+
+// String returns the path of the split, followed by its byte range if it's only part of
+// the file.
+func (split InputSplit) String() string {
+	if split.Offset == 0 && split.Length == 0 {
+		return split.Path
+	}
+	return fmt.Sprintf("%v:%v+%v", split.Path, split.Offset, split.Length)
+}
+
+// TextInput reads lines of text files. Files are divided in splits of up to SplitSize
+// bytes, and each line is read by the split it starts in. The key of a record is the
+// path of the file and the offset of the line ("path:offset") and its value is the line,
+// without the line break.
+type TextInput struct {
+	// Paths of the input files, which may be glob patterns
+	Paths []string
+
+	// Maximum size of a split (in bytes). 0 = DEFAULT_SPLIT_SIZE
+	SplitSize int64
+}
+
+func (input *TextInput) Splits() ([]InputSplit, error) {
+	return byteRangeSplits(input.Paths, input.SplitSize)
+}
+
+func (input *TextInput) inputPaths() []string { return input.Paths }
+
+func (input *TextInput) NewReader(split InputSplit, file io.ReaderAt) (RecordReader, error) {
+	return newLineReader(split, file)
+}
+
+// JSONLinesInput reads files with a JSON value per line, divided in splits like
+// TextInput. Blank lines are skipped and lines that aren't valid JSON fail the map
+// operation. Records have the same keys as TextInput, and the JSON value as value.
+type JSONLinesInput struct {
+	// Paths of the input files, which may be glob patterns
+	Paths []string
+
+	// Maximum size of a split (in bytes). 0 = DEFAULT_SPLIT_SIZE
+	SplitSize int64
+}
+
+func (input *JSONLinesInput) Splits() ([]InputSplit, error) {
+	return byteRangeSplits(input.Paths, input.SplitSize)
+}
+
+func (input *JSONLinesInput) inputPaths() []string { return input.Paths }
+
+func (input *JSONLinesInput) NewReader(split InputSplit, file io.ReaderAt) (RecordReader, error) {
+	reader, err := newLineReader(split, file)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonLinesReader{reader}, nil
+}
+
+// CSVInput reads CSV files. Since quoted fields may span lines, files aren't divided
+// and every file is a single split. The key of a record is the path of the file and the
+// number of the row ("path:row", starting at 1) and its value is the JSON array of its
+// fields, which can be decoded with CSVFields.
+type CSVInput struct {
+	// Paths of the input files, which may be glob patterns
+	Paths []string
+
+	// Field delimiter. 0 = ','
+	Comma rune
+
+	// Skip the first row of each file
+	Header bool
+}
+
+func (input *CSVInput) Splits() (splits []InputSplit, err error) {
+	var paths []string
+
+	if paths, err = expandPaths(input.Paths); err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		splits = append(splits, InputSplit{Path: path})
+	}
+
+	return splits, nil
+}
+
+func (input *CSVInput) inputPaths() []string { return input.Paths }
+
+func (input *CSVInput) NewReader(split InputSplit, file io.ReaderAt) (RecordReader, error) {
+	var reader *csvReader = new(csvReader)
+
+	reader.path = split.Path
+	reader.reader = csv.NewReader(bufio.NewReaderSize(sectionFrom(file, 0), INPUT_BUFFER_SIZE))
+	reader.reader.ReuseRecord = true
+	if input.Comma != 0 {
+		reader.reader.Comma = input.Comma
+	}
+
+	if input.Header {
+		if _, err := reader.reader.Read(); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	return reader, nil
+}
+
+// CSVFields decodes the fields of a record read by CSVInput.
+func CSVFields(value string) (fields []string, err error) {
+	err = json.Unmarshal([]byte(value), &fields)
+	return fields, err
+}
+
+// Returns the paths matched by patterns, in order. Every pattern must match a file.
+func expandPaths(patterns []string) (paths []string, err error) {
+	var matches []string
+
+	for _, pattern := range patterns {
+		if matches, err = filepath.Glob(pattern); err != nil {
+			return nil, err
+		}
+
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no input files match '%v'", pattern)
+		}
+
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+
+	return paths, nil
+}
+
+// Divide the files matched by patterns in splits of up to splitSize bytes. Empty files
+// have no splits.
+func byteRangeSplits(patterns []string, splitSize int64) (splits []InputSplit, err error) {
+	var (
+		paths []string
+		info  os.FileInfo
+	)
+
+	if splitSize <= 0 {
+		splitSize = DEFAULT_SPLIT_SIZE
+	}
+
+	if paths, err = expandPaths(patterns); err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		if info, err = os.Stat(path); err != nil {
+			return nil, err
+		}
+
+		for offset := int64(0); offset < info.Size(); offset += splitSize {
+			length := splitSize
+			if offset+length > info.Size() {
+				length = info.Size() - offset
+			}
+			splits = append(splits, InputSplit{path, offset, length})
+		}
+	}
+
+	return splits, nil
+}
+
+// Returns a reader of file starting at offset.
+func sectionFrom(file io.ReaderAt, offset int64) io.Reader {
+	return io.NewSectionReader(file, offset, math.MaxInt64-offset)
+}
+
+// lineReader reads the lines that start within a split.
+type lineReader struct {
+	path   string
+	reader *bufio.Reader
+	offset int64 // Offset of the next line in the file
+	end    int64
+}
+
+// Construct a lineReader for split. The line that starts before the split, if any,
+// belongs to the previous split and is skipped.
+func newLineReader(split InputSplit, file io.ReaderAt) (reader *lineReader, err error) {
+	var skipped string
+
+	reader = new(lineReader)
+	reader.path = split.Path
+	reader.offset = split.Offset
+
+	reader.end = math.MaxInt64
+	if split.Length > 0 {
+		reader.end = split.Offset + split.Length
+	}
+
+	if split.Offset == 0 {
+		reader.reader = bufio.NewReaderSize(sectionFrom(file, 0), INPUT_BUFFER_SIZE)
+		return reader, nil
+	}
+
+	// Starts at the last byte of the previous split, so a line that starts right at
+	// the beginning of this one isn't skipped
+	reader.reader = bufio.NewReaderSize(sectionFrom(file, split.Offset-1), INPUT_BUFFER_SIZE)
+	skipped, err = reader.reader.ReadString('\n')
+	reader.offset = split.Offset - 1 + int64(len(skipped))
+
+	if err == io.EOF {
+		reader.offset = reader.end
+	} else if err != nil {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+func (reader *lineReader) Read(kv *KeyValue) error {
+	if reader.offset >= reader.end {
+		return io.EOF
+	}
+
+	line, err := reader.reader.ReadString('\n')
+
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return err
+	}
+
+	kv.Key = fmt.Sprintf("%v:%v", reader.path, reader.offset)
+	kv.Value = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	reader.offset += int64(len(line))
+
+	return nil
+}
+
+// jsonLinesReader reads the JSON values of a lineReader.
+type jsonLinesReader struct {
+	lines *lineReader
+}
+
+func (reader *jsonLinesReader) Read(kv *KeyValue) (err error) {
+	for {
+		if err = reader.lines.Read(kv); err != nil {
+			return err
+		}
+
+		if strings.TrimSpace(kv.Value) == "" {
+			continue
+		}
+
+		if !json.Valid([]byte(kv.Value)) {
+			return fmt.Errorf("%v: invalid JSON", kv.Key)
+		}
+
+		return nil
+	}
+}
+
+// csvReader reads the rows of a CSV file.
+type csvReader struct {
+	path   string
+	reader *csv.Reader
+	row    int
+}
+
+func (reader *csvReader) Read(kv *KeyValue) error {
+	fields, err := reader.reader.Read()
+	if err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	reader.row++
+	kv.Key = fmt.Sprintf("%v:%v", reader.path, reader.row)
+	kv.Value = string(value)
+
+	return nil
+}
+
+// Read all the records of split with format.
+func readSplit(format InputFormat, split InputSplit, file io.ReaderAt) (records []KeyValue, err error) {
+	var (
+		reader RecordReader
+		kv     KeyValue
+	)
+
+	if reader, err = format.NewReader(split, file); err != nil {
+		return nil, err
+	}
+
+	for {
+		if err = reader.Read(&kv); err != nil {
+			if err == io.EOF {
+				return records, nil
+			}
+			return nil, fmt.Errorf("%v: %w", split, err)
+		}
+		records = append(records, kv)
+	}
+}
+
+// Read all the records of a split of a local file.
+func readLocalSplit(format InputFormat, split InputSplit) ([]KeyValue, error) {
+	file, err := os.Open(split.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readSplit(format, split, file)
+}
@@ -0,0 +1,127 @@
+package mapreduce
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write content to a file in a temporary directory and return its path.
+func writeTestFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Returns the records TextInput must read from content, in order.
+func expectedLines(path string, content string) (records []KeyValue) {
+	var offset int
+
+	for offset < len(content) {
+		line := content[offset:]
+		if end := strings.IndexByte(line, '\n'); end >= 0 {
+			line = line[:end+1]
+		}
+
+		value := strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		records = append(records, KeyValue{fmt.Sprintf("%v:%v", path, offset), value})
+		offset += len(line)
+	}
+
+	return records
+}
+
+// Read all the splits of format, in order.
+func readAllSplits(t *testing.T, format InputFormat) (records []KeyValue) {
+	splits, err := format.Splits()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, split := range splits {
+		splitRecords, err := readLocalSplit(format, split)
+		if err != nil {
+			t.Fatalf("%v: %v", split, err)
+		}
+		records = append(records, splitRecords...)
+	}
+
+	return records
+}
+
+// Every line must be read exactly once, by the split it starts in, whatever the split
+// boundaries are.
+func TestTextInputSplitBoundaries(t *testing.T) {
+	contents := map[string]string{
+		"lines":      "first line\nsecond\n\nfourth line, longer than the others\nx\n",
+		"no-newline": "one\ntwo\nthree",
+		"crlf":       "one\r\ntwo\r\n\r\nfour\r\n",
+		"empty":      "\n\n\n",
+		"single":     "a",
+	}
+
+	for name, content := range contents {
+		path := writeTestFile(t, name+".txt", content)
+		want := expectedLines(path, content)
+
+		for splitSize := int64(1); splitSize <= int64(len(content))+1; splitSize++ {
+			got := readAllSplits(t, &TextInput{Paths: []string{path}, SplitSize: splitSize})
+
+			if len(got) != len(want) {
+				t.Fatalf("%v, split size %v: read %v lines, want %v: %q", name, splitSize, len(got), len(want), got)
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Errorf("%v, split size %v: line %v = %q, want %q", name, splitSize, i, got[i], want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestByteRangeSplits(t *testing.T) {
+	path := writeTestFile(t, "input.txt", strings.Repeat("x", 25))
+	empty := writeTestFile(t, "empty.txt", "")
+
+	splits, err := byteRangeSplits([]string{path, empty}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []InputSplit{{path, 0, 10}, {path, 10, 10}, {path, 20, 5}}
+	if fmt.Sprint(splits) != fmt.Sprint(want) {
+		t.Errorf("splits = %v, want %v", splits, want)
+	}
+}
+
+func TestJSONLinesInputSplitBoundaries(t *testing.T) {
+	content := "{\"a\": 1}\n\n  \n[1, 2, 3]\n\"text\"\n{\"b\": {\"c\": null}}"
+	path := writeTestFile(t, "input.jsonl", content)
+
+	var want []KeyValue
+	for _, kv := range expectedLines(path, content) {
+		if strings.TrimSpace(kv.Value) != "" {
+			want = append(want, kv)
+		}
+	}
+
+	for splitSize := int64(1); splitSize <= int64(len(content)); splitSize++ {
+		got := readAllSplits(t, &JSONLinesInput{Paths: []string{path}, SplitSize: splitSize})
+
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("split size %v: read %q, want %q", splitSize, got, want)
+		}
+	}
+}
+
+func TestJSONLinesInputInvalid(t *testing.T) {
+	path := writeTestFile(t, "input.jsonl", "{\"a\": 1}\n{invalid\n")
+
+	if _, err := readLocalSplit(&JSONLinesInput{Paths: []string{path}}, InputSplit{Path: path}); err == nil {
+		t.Error("invalid JSON line was read")
+	}
+}
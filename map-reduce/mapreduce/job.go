@@ -0,0 +1,148 @@
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// JobMode selects how a Job runs its Task.
+type JobMode string
+
+const (
+	JOB_SEQUENTIAL JobMode = "sequential"
+	JOB_PARALLEL   JobMode = "parallel"
+	JOB_MASTER     JobMode = "master"
+	JOB_WORKER     JobMode = "worker"
+
+	// Long-lived worker serving the jobs of a Pool, see RunPoolWorker. Task is
+	// optional and only holds the settings of the worker, like its Scheduler.
+	JOB_POOL_WORKER JobMode = "pool-worker"
+)
+
+// Job runs a Task in one of the execution modes. Unlike the Run functions, which exit
+// the process on errors, it returns the error that stopped the job, including the
+// ones returned by the Map, Combine and Reduce functions. In the worker modes, SIGTERM
+// decommissions the worker: Master stops scheduling operations on it, and Run returns
+// once the ones it's running are done and their outputs aren't needed anymore.
+type Job struct {
+	Task *Task
+	Mode JobMode
+
+	// Optional, tasks that run after Task as the later stages of a pipeline. The result
+	// partitions of each stage are the map inputs of the next one, read by its MapRecords
+	// function. Only the result of the last stage is sent to its OutputChan or written
+	// with its OutputFormat. Settings that apply to the whole job, like the fault
+	// tolerance ones and LocalStorage, are taken from Task.
+	Stages []*Task
+
+	// Number of goroutines running operations in JOB_PARALLEL mode (0 = number of CPUs)
+	NumWorkers int
+
+	// Address to listen on in JOB_MASTER and the worker modes, and the address of
+	// the Master or Pool in the worker modes
+	Hostname       string
+	MasterHostname string
+
+	// Optional, address of an HTTP server run by the Master in JOB_MASTER mode with
+	// the status of the job: a dashboard on /, JSON on /api/status and Prometheus
+	// metrics on /metrics. "" = disabled
+	StatusAddress string
+
+	// Number of operations a worker runs at once in the worker modes, up to
+	// MAX_WORKER_SLOTS (0 = 1). Like in JOB_PARALLEL mode, the MapReduce functions
+	// must then be safe for concurrent use.
+	Slots int
+
+	// Number of operations a worker runs before an induced failure (0 = no failure)
+	FailAfter int
+}
+
+// Result describes a job that was completed.
+type Result struct {
+	// Job id of the first stage, which names the directories of the job. Not set for
+	// pool workers, which serve several jobs.
+	JobId string
+
+	// Operations run by the job. In the worker modes, the ones run by this worker.
+	NumMapOperations    int
+	NumReduceOperations int
+
+	Duration time.Duration
+
+	// Built-in and user-defined counters of the operations above
+	Counters map[string]int64
+
+	// Operations in the order they were completed. Not set in the worker modes, and
+	// operations completed before Master restarted aren't included.
+	Operations []OperationStats
+}
+
+// Run will run the job until it's completed, fails or ctx is cancelled. Once it's
+// cancelled, no more operations are started, the ones still running aren't committed
+// and workers are stopped. Run returns the error of the context in that case.
+func (job *Job) Run(ctx context.Context) (result *Result, err error) {
+	var (
+		start time.Time = time.Now()
+		tasks []*Task
+		jobId string
+	)
+
+	// Pool workers build the tasks of each job they serve from the registry
+	if job.Mode == JOB_POOL_WORKER {
+		if result, err = runPoolWorker(ctx, job.Task, job.Hostname, job.MasterHostname, job.Slots); err != nil {
+			return nil, err
+		}
+
+		result.Duration = time.Since(start)
+		return result, nil
+	}
+
+	if job.Task == nil {
+		return nil, errors.New("mapreduce: job without a task")
+	}
+
+	// A Master job keeps its job id across runs, so it can be resumed
+	if job.Mode == JOB_MASTER {
+		jobId = defaultJobId(job.Task)
+	}
+
+	if tasks, err = prepareStages(append([]*Task{job.Task}, job.Stages...), jobId); err != nil {
+		return nil, fmt.Errorf("mapreduce: %w", err)
+	}
+
+	switch job.Mode {
+	case JOB_SEQUENTIAL:
+		result, err = runLocal(ctx, tasks, runSequential)
+	case JOB_PARALLEL:
+		result, err = runLocal(ctx, tasks, func(ctx context.Context, task *Task, inputs <-chan mapInput, output chan<- []KeyValue) (*Result, error) {
+			return runParallel(ctx, task, job.NumWorkers, inputs, output)
+		})
+	case JOB_MASTER:
+		result, err = runMaster(ctx, tasks, job.Hostname, job.StatusAddress)
+	case JOB_WORKER:
+		result, err = runWorker(ctx, tasks, job.Hostname, job.MasterHostname, job.Slots, job.FailAfter)
+	default:
+		return nil, fmt.Errorf("mapreduce: unknown job mode '%v'", job.Mode)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	result.JobId = tasks[0].JobId
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// Run the job and exit the process if it fails.
+func runOrExit(job *Job) {
+	result, err := job.Run(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print(result.Summary())
+}
@@ -0,0 +1,72 @@
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Jobs that can't run return an error instead of exiting.
+func TestJobInvalid(t *testing.T) {
+	tests := map[string]*Job{
+		"without a task":       {Mode: JOB_SEQUENTIAL},
+		"with an unknown mode": {Task: &Task{JobId: "job", OutputChan: make(chan []KeyValue)}, Mode: "distributed"},
+		"without an output":    {Task: &Task{JobId: "job", ScratchDir: t.TempDir(), OutputDir: t.TempDir()}, Mode: JOB_SEQUENTIAL},
+		"with an invalid id":   {Task: &Task{JobId: "../job", OutputChan: make(chan []KeyValue)}, Mode: JOB_SEQUENTIAL},
+	}
+
+	for name, job := range tests {
+		if _, err := job.Run(context.Background()); err == nil {
+			t.Errorf("job %v succeeded", name)
+		}
+	}
+}
+
+// Errors of the MapReduce functions stop the job and are returned by Run, in every
+// local mode.
+func TestJobFunctionErrors(t *testing.T) {
+	for _, mode := range []JobMode{JOB_SEQUENTIAL, JOB_PARALLEL} {
+		task := newTestWordCountTask(t, 2)
+		task.Map = func(data []byte) ([]KeyValue, error) {
+			return nil, errors.New("map failed")
+		}
+
+		if _, partitions, err := runTestJob(context.Background(), &Job{Task: task, Mode: mode}, testWordInputs(5)); err == nil || !strings.Contains(err.Error(), "map failed") || len(partitions) != 0 {
+			t.Errorf("%v: job returned %v after sending %v partitions, want the map error", mode, err, len(partitions))
+		}
+
+		task = newTestWordCountTask(t, 2)
+		task.Combine = func(key string, values Iterator) ([]KeyValue, error) {
+			return nil, errors.New("combine failed")
+		}
+
+		if _, _, err := runTestJob(context.Background(), &Job{Task: task, Mode: mode}, testWordInputs(5)); err == nil || !strings.Contains(err.Error(), "combine failed") {
+			t.Errorf("%v: job returned %v, want the combine error", mode, err)
+		}
+	}
+}
+
+// A job whose context is cancelled stops starting operations, returns the error of the
+// context and closes OutputChan.
+func TestJobCancel(t *testing.T) {
+	for _, mode := range []JobMode{JOB_SEQUENTIAL, JOB_PARALLEL} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		task := newTestWordCountTask(t, 2)
+		task.Map = func(data []byte) ([]KeyValue, error) {
+			cancel()
+			return []KeyValue{{"a", "1"}}, nil
+		}
+
+		result, partitions, err := runTestJob(ctx, &Job{Task: task, Mode: mode, NumWorkers: 1}, testWordInputs(20))
+		if !errors.Is(err, context.Canceled) || result != nil || len(partitions) != 0 {
+			t.Errorf("%v: cancelled job returned %v, %v after sending %v partitions", mode, result, err, len(partitions))
+		}
+
+		// Operations still running when the job is stopped aren't committed
+		if names := dirNames(t, task.ScratchPath()); len(names) != 0 {
+			t.Errorf("%v: scratch directory holds %v", mode, names)
+		}
+	}
+}
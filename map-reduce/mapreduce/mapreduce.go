@@ -1,10 +1,15 @@
 package mapreduce
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/rpc"
-	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,64 +20,267 @@ import (
 // Notice that this implementation will store data locally. In the distributed
 // version of mapreduce it's common to store the data in the same worker that computed
 // it and just pass a reference to reduce jobs so they can go grab it.
+// Errors are fatal, use a Job to handle them instead.
 func RunSequential(task *Task) {
+	runOrExit(&Job{Task: task, Mode: JOB_SEQUENTIAL})
+}
+
+func runSequential(ctx context.Context, task *Task, inputs <-chan mapInput, output chan<- []KeyValue) (*Result, error) {
 	var (
-		mapCounter int = 0
-		mapResult  []KeyValue
+		err          error
+		mapCounter   int = 0
+		reduceResult []KeyValue
+		start        time.Time
+		counters     *Counters
+		stats        jobStats
+		result       *Result
 	)
 
 	log.Print("Running RunSequential...")
 
-	_ = os.Mkdir(REDUCE_PATH, os.ModePerm)
-	_ = RemoveContents(REDUCE_PATH)
+	// Inputs are left unread if an operation fails
+	defer discardInputs(inputs)
 
-	for v := range task.InputChan {
-		mapResult = task.Map(v)
-		storeLocal(task, mapCounter, mapResult)
-		mapCounter++
+	if err = createWorkDirs(task); err != nil {
+		return nil, err
 	}
+	_ = RemoveContents(task.ScratchPath())
 
-	mergeMapLocal(task, mapCounter)
+	for v := range inputs {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
 
+		start, counters = time.Now(), new(Counters)
+
+		if err = mapLocal(ctx, task, mapCounter, v, counters); err != nil {
+			return nil, err
+		}
+
+		stats.add(operationStats(PHASE_MAP, mapCounter, start, counters))
+		mapCounter++
+	}
+
+	// Each reduce job merges its partition of every map output
 	for r := 0; r < task.NumReduceJobs; r++ {
-		data := loadLocal(r)
-		task.OutputChan <- task.Reduce(data)
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		start, counters = time.Now(), new(Counters)
+
+		if reduceResult, err = reduceLocal(task, r, mapOutputPaths(task, mapCounter, r), counters); err != nil {
+			return nil, err
+		}
+
+		stats.add(operationStats(PHASE_REDUCE, r, start, counters))
+
+		select {
+		case output <- reduceResult:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 
-	close(task.OutputChan)
-	return
+	cleanupScratch(task)
+
+	result = &Result{NumMapOperations: mapCounter, NumReduceOperations: task.NumReduceJobs}
+	stats.fill(result)
+	return result, nil
+}
+
+// RunParallel will run map and reduce operations on a pool of numWorkers goroutines
+// in a single process, using the same Task as RunSequential. It stores data locally
+// like RunSequential and sends the result of each reduce job to OutputChan in order.
+// The functions of the task are called concurrently, so they must be safe to do so.
+//   - numWorkers: the number of operations that run at once (0 = number of CPUs).
+//
+// Errors are fatal, use a Job to handle them instead.
+func RunParallel(task *Task, numWorkers int) {
+	runOrExit(&Job{Task: task, Mode: JOB_PARALLEL, NumWorkers: numWorkers})
+}
+
+func runParallel(ctx context.Context, task *Task, numWorkers int, inputs <-chan mapInput, output chan<- []KeyValue) (*Result, error) {
+	var (
+		wg         sync.WaitGroup
+		workers    chan struct{}
+		mapCounter int = 0
+		results    []chan []KeyValue
+		cancel     context.CancelFunc
+		errMutex   sync.Mutex
+		firstErr   error
+		stats      jobStats
+		result     *Result
+	)
+
+	if numWorkers <= 0 {
+		numWorkers = runtime.NumCPU()
+	}
+
+	log.Printf("Running RunParallel with %v workers...", numWorkers)
+
+	// Inputs are left unread if an operation fails
+	defer discardInputs(inputs)
+
+	// The first operation that fails cancels the others
+	ctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+
+	fail := func(err error) {
+		errMutex.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		errMutex.Unlock()
+		cancel()
+	}
+
+	failure := func() error {
+		errMutex.Lock()
+		defer errMutex.Unlock()
+		if firstErr != nil {
+			return firstErr
+		}
+		return ctx.Err()
+	}
+
+	if err := createWorkDirs(task); err != nil {
+		return nil, err
+	}
+	_ = RemoveContents(task.ScratchPath())
+
+	// A slot in workers is taken by each running operation
+	workers = make(chan struct{}, numWorkers)
+
+	for v := range inputs {
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+
+		go func(idMap int, input mapInput) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			start, counters := time.Now(), new(Counters)
+
+			if err := mapLocal(ctx, task, idMap, input, counters); err != nil {
+				fail(err)
+				return
+			}
+
+			stats.add(operationStats(PHASE_MAP, idMap, start, counters))
+		}(mapCounter, v)
+
+		mapCounter++
+	}
+
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, failure()
+	}
+
+	// Results are buffered so reduce jobs don't wait for the previous ones to be sent
+	results = make([]chan []KeyValue, task.NumReduceJobs)
+	for r := range results {
+		results[r] = make(chan []KeyValue, 1)
+	}
+
+	// Operations still running are waited for before returning, even if the job failed
+	defer wg.Wait()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for r := range results {
+			select {
+			case workers <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			wg.Add(1)
+			go func(idReduce int) {
+				defer wg.Done()
+				defer func() { <-workers }()
+
+				start, counters := time.Now(), new(Counters)
+				reduceResult, err := reduceLocal(task, idReduce, mapOutputPaths(task, mapCounter, idReduce), counters)
+
+				if err != nil {
+					fail(err)
+					return
+				}
+
+				stats.add(operationStats(PHASE_REDUCE, idReduce, start, counters))
+				results[idReduce] <- reduceResult
+			}(r)
+		}
+	}()
+
+	for r := range results {
+		select {
+		case reduceResult := <-results[r]:
+			select {
+			case output <- reduceResult:
+			case <-ctx.Done():
+				return nil, failure()
+			}
+		case <-ctx.Done():
+			return nil, failure()
+		}
+	}
+
+	cleanupScratch(task)
+
+	result = &Result{NumMapOperations: mapCounter, NumReduceOperations: task.NumReduceJobs}
+	stats.fill(result)
+	return result, nil
 }
 
 // RunMaster will start a master node on the map reduce operations.
 // In the distributed model, a Master should serve multiple workers and distribute
 // the operations to be executed in order to complete the task.
-//   - task: the Task object that contains the mapreduce operation.
+//   - task: the Task object that contains the mapreduce operation. task.Scheduler
+//     selects whether the Master calls workers or workers pull their operations.
 //   - hostname: the tcp/ip address on which it will listen for connections.
+//
+// Errors are fatal, use a Job to handle them instead.
 func RunMaster(task *Task, hostname string) {
+	runOrExit(&Job{Task: task, Mode: JOB_MASTER, Hostname: hostname})
+}
+
+func runMaster(ctx context.Context, tasks []*Task, hostname string, statusAddress string) (result *Result, err error) {
 	var (
-		err                error
-		master             *Master
-		newRpcServer       *rpc.Server
-		listener           net.Listener
-		reduceFilePathChan chan string
-		mapOperations      int
-		reduceOperations   int
+		master       *Master
+		newRpcServer *rpc.Server
+		listener     net.Listener
 	)
 
 	log.Println("Running Master on", hostname)
 
-	// Create a reduce directory to store intemediate reduce files.
-	_ = os.Mkdir(REDUCE_PATH, os.ModePerm)
-	_ = RemoveContents(REDUCE_PATH)
+	if err = checkMasterTasks(tasks); err != nil {
+		return nil, err
+	}
 
-	master = newMaster(hostname)
+	master = newMaster(ctx, hostname)
+	defer master.cancel()
 
-	master.task = task
+	// Settings of the whole job are taken from the first stage
+	master.task = tasks[0]
+	master.stages = tasks
 	newRpcServer = rpc.NewServer()
-	newRpcServer.Register(master)
 
-	if err != nil {
-		log.Panicln("Failed to register RPC server. Error:", err)
+	if err = newRpcServer.Register(master); err != nil {
+		return nil, fmt.Errorf("failed to register RPC server: %w", err)
 	}
 
 	master.rpcServer = newRpcServer
@@ -80,96 +288,206 @@ func RunMaster(task *Task, hostname string) {
 	listener, err = net.Listen("tcp", master.address)
 
 	if err != nil {
-		log.Panicln("Failed to start TCP server. Error:", err)
+		return nil, fmt.Errorf("failed to start TCP server: %w", err)
 	}
 
 	master.listener = listener
-
-	// Start MapReduce Operation
+	defer master.listener.Close()
 
 	go master.acceptMultipleConnections()
-	go master.handleFailingWorkers()
 
-	// Schedule map operations
-	mapOperations = master.schedule(task, "Worker.RunMap", task.InputFilePathChan)
+	return master.run(statusAddress)
+}
+
+// Returns an error if the tasks of a job can't run on remote workers.
+func checkMasterTasks(tasks []*Task) error {
+	if taskScheduler(tasks[0]) == SCHEDULER_PULL && tasks[0].LocalStorage {
+		return errors.New("LocalStorage can't be used with SCHEDULER_PULL, workers don't accept connections")
+	}
+	return nil
+}
+
+// run runs the stages of the job on the workers that register with master, and tells
+// them once it's over. Workers connect to master through a listener set up by the
+// caller.
+func (master *Master) run(statusAddress string) (result *Result, err error) {
+	var (
+		tasks       []*Task = master.stages
+		stopStatus  func()
+		splitChan   chan InputSplit
+		splits      []InputSplit
+		stageResult *Result
+	)
+
+	if statusAddress != "" {
+		if stopStatus, err = master.serveStatus(statusAddress); err != nil {
+			return nil, err
+		}
+		defer stopStatus()
+	}
 
-	// Merge the result of multiple map operation with the same reduceId into a single file
-	mergeMapLocal(task, mapOperations)
+	// Workers are stopped whether the job was completed or not
+	defer func() {
+		master.closeWorkers(err == nil)
+	}()
 
-	// Schedule reduce operations
-	reduceFilePathChan = fanReduceFilePath(task.NumReduceJobs)
-	reduceOperations = master.schedule(task, "Worker.RunReduce", reduceFilePathChan)
+	// Start MapReduce Operation
 
-	mergeReduceLocal(reduceOperations)
+	go master.handleFailingWorkers()
+	go master.monitorWorkers()
 
-	log.Println("Closing Remote Workers.")
-	for _, worker := range master.workers {
-		err = worker.callRemoteWorker("Worker.Done", new(struct{}), new(struct{}))
-		if err != nil {
-			log.Println("Failed to close Remote Worker. Error:", err)
+	// The map inputs of each stage are the result partitions of the previous one
+	result = new(Result)
+
+	if tasks[0].Input != nil {
+		if splits, err = tasks[0].Input.Splits(); err != nil {
+			return nil, stageError(tasks, 0, err)
 		}
+		splitChan = fanSplits(splits)
+	} else {
+		splitChan = wholeFileSplits(tasks[0].InputFilePathChan)
 	}
 
-	log.Println("Done.")
-	return
+	for stage, task := range tasks {
+		if stageResult, err = master.runStage(stage, splitChan); err != nil {
+			return nil, stageError(tasks, stage, err)
+		}
+
+		result.NumMapOperations += stageResult.NumMapOperations
+		result.NumReduceOperations += stageResult.NumReduceOperations
+		splitChan = wholeFileSplits(fanResultFilePath(task))
+	}
+
+	master.stats.fill(result)
+	return result, nil
 }
 
 // RunWorker will run a instance of a worker. It'll initialize and then try to register with
-// master.
+// master. With task.Scheduler set to SCHEDULER_PULL, it asks master for operations over
+// a single connection instead of accepting connections, and hostname only names it.
+// Sending SIGTERM to the process decommissions the worker: it finishes the operations
+// it's running, leaves the job without counting as a failure and returns.
 // Induced failures:
 // -> nOps = number of operations to run before failure (0 = no failure)
+//
+// Errors are fatal, use a Job to handle them instead.
 func RunWorker(task *Task, hostname string, masterHostname string, nOps int) {
-	var (
-		err           error
-		worker        *Worker
-		rpcs          *rpc.Server
-		listener      net.Listener
-		retryDuration time.Duration
-	)
+	runOrExit(&Job{Task: task, Mode: JOB_WORKER, Hostname: hostname, MasterHostname: masterHostname, FailAfter: nOps})
+}
+
+func runWorker(ctx context.Context, tasks []*Task, hostname string, masterHostname string, slots int, nOps int) (*Result, error) {
+	var worker *Worker
 
 	log.Println("Running Worker on", hostname)
 
-	_ = os.Mkdir(REDUCE_PATH, os.ModePerm)
+	worker = newWorker(ctx, hostname, masterHostname, slots)
+	worker.task = tasks[0]
+	worker.stages = tasks
 
+	// Should induce a failure
+	if nOps > 0 {
+		worker.taskCounter = 0
+		worker.nOps = int64(nOps)
+	}
+
+	return worker.run()
+}
+
+// RunPoolWorker will run a long-lived worker that serves the jobs of a Pool, several at
+// once if the Pool runs them concurrently. The tasks of each job are built from the ones
+// registered with RegisterTask in this process. With scheduler set to SCHEDULER_PULL, it asks the Pool for
+// operations instead of accepting connections. Sending SIGTERM to the process
+// decommissions the worker once it's serving a job.
+//
+// Errors are fatal, use a Job to handle them instead.
+func RunPoolWorker(hostname string, masterHostname string, scheduler Scheduler) {
+	runOrExit(&Job{Task: &Task{Scheduler: scheduler}, Mode: JOB_POOL_WORKER, Hostname: hostname, MasterHostname: masterHostname})
+}
+
+// Construct a new Worker that runs until ctx is cancelled
+func newWorker(ctx context.Context, hostname string, masterHostname string, slots int) (worker *Worker) {
 	worker = new(Worker)
 	worker.hostname = hostname
 	worker.masterHostname = masterHostname
-	worker.task = task
+	worker.slots = slots
+	worker.ctx = ctx
 	worker.done = make(chan bool)
+	worker.failed = make(chan error, 1)
+	return
+}
 
-	// Should induce a failure
-	if nOps > 0 {
-		worker.taskCounter = 0
-		worker.nOps = nOps
-	}
+// run registers the worker with Master and runs operations until the job is over.
+func (worker *Worker) run() (*Result, error) {
+	var (
+		err       error
+		rpcs      *rpc.Server
+		listener  net.Listener
+		scheduler Scheduler
+	)
 
-	rpcs = rpc.NewServer()
-	rpcs.Register(worker)
+	task, _ := worker.currentStages()
+	scheduler = taskScheduler(task)
 
-	worker.rpcServer = rpcs
+	// Workers that pull their operations don't accept connections
+	if scheduler == SCHEDULER_PUSH {
+		rpcs = rpc.NewServer()
 
-	listener, err = net.Listen("tcp", worker.hostname)
+		if err = rpcs.Register(worker); err != nil {
+			return nil, fmt.Errorf("failed to register RPC server: %w", err)
+		}
 
-	if err != nil {
-		log.Panic("Starting RPC listener failed. Error:", err)
+		worker.rpcServer = rpcs
+
+		listener, err = net.Listen("tcp", worker.hostname)
+
+		if err != nil {
+			return nil, fmt.Errorf("starting RPC listener failed: %w", err)
+		}
+
+		worker.listener = listener
+		defer worker.listener.Close()
 	}
 
-	worker.listener = listener
-	defer worker.listener.Close()
+	defer worker.disconnect()
 
-	retryDuration = time.Duration(2) * time.Second
-	for {
-		err = worker.register()
+	if err = worker.registerWithRetry(); err != nil {
+		return nil, err
+	}
 
-		if err == nil {
-			break
-		}
+	if scheduler == SCHEDULER_PUSH {
+		go worker.acceptMultipleConnections()
+	}
+
+	return worker.serve()
+}
 
-		log.Printf("Registration failed. Retrying in %v seconds...\n", retryDuration)
-		time.Sleep(retryDuration)
+// serve runs the operations of the job the worker registered with until it's over.
+// Workers that don't pull their operations must already be accepting connections.
+func (worker *Worker) serve() (*Result, error) {
+	var err error
+
+	task, _ := worker.currentStages()
+
+	if taskScheduler(task) == SCHEDULER_PULL {
+		go worker.pullOperations()
+		go worker.sendHeartbeats()
+	} else {
+		go worker.watchMaster()
 	}
 
-	go worker.acceptMultipleConnections()
+	go worker.drainOnSignal()
+
+	select {
+	case <-worker.done:
+	case <-worker.ctx.Done():
+		return nil, worker.ctx.Err()
+	case err = <-worker.failed:
+		return nil, err
+	}
 
-	<-worker.done
+	return &Result{
+		NumMapOperations:    int(atomic.LoadInt64(&worker.numMapOperations)),
+		NumReduceOperations: int(atomic.LoadInt64(&worker.numReduceOperations)),
+		Counters:            worker.counters.Values(),
+	}, nil
 }
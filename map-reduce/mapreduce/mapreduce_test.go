@@ -0,0 +1,163 @@
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A stage that fails before reading all of its inputs doesn't block the caller
+// sending them.
+func TestLocalRunnerFailureDrainsInput(t *testing.T) {
+	runners := map[string]localRunner{
+		"sequential": runSequential,
+		"parallel": func(ctx context.Context, task *Task, inputs <-chan mapInput, output chan<- []KeyValue) (*Result, error) {
+			return runParallel(ctx, task, 2, inputs, output)
+		},
+	}
+
+	for name, run := range runners {
+		t.Run(name, func(t *testing.T) {
+			var (
+				input chan []byte   = make(chan []byte)
+				sent  chan struct{} = make(chan struct{})
+			)
+
+			task := &Task{
+				JobId:         "job",
+				ScratchDir:    t.TempDir(),
+				OutputDir:     t.TempDir(),
+				NumReduceJobs: 1,
+				Map: func(data []byte) ([]KeyValue, error) {
+					return nil, errors.New("map failed")
+				},
+			}
+
+			go func() {
+				defer close(sent)
+				for i := 0; i < 100; i++ {
+					input <- []byte("data")
+				}
+				close(input)
+			}()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			_, err := run(ctx, task, dataInputs(ctx, input), make(chan []KeyValue, 1))
+			cancel()
+
+			if err == nil {
+				t.Fatal("stage succeeded with a failing map")
+			}
+
+			select {
+			case <-sent:
+			case <-time.After(5 * time.Second):
+				t.Fatal("input still blocked after the stage failed")
+			}
+		})
+	}
+}
+
+// Runs job on inputs, sent through the InputChan of its task, and returns its result
+// with the partitions it sent to the OutputChan of its last stage.
+func runTestJob(ctx context.Context, job *Job, inputs []string) (result *Result, partitions [][]KeyValue, err error) {
+	var (
+		last     *Task         = job.Task
+		received chan struct{} = make(chan struct{})
+		stopped  chan struct{} = make(chan struct{})
+	)
+
+	if len(job.Stages) > 0 {
+		last = job.Stages[len(job.Stages)-1]
+	}
+
+	job.Task.InputChan = make(chan []byte)
+	last.OutputChan = make(chan []KeyValue)
+
+	// Jobs that fail before reading their input leave it unread
+	go func() {
+		defer close(job.Task.InputChan)
+		for _, input := range inputs {
+			select {
+			case job.Task.InputChan <- []byte(input):
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	// Jobs that fail before they start don't close OutputChan
+	go func() {
+		defer close(received)
+		for {
+			select {
+			case records, ok := <-last.OutputChan:
+				if !ok {
+					return
+				}
+				partitions = append(partitions, records)
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	result, err = job.Run(ctx)
+	close(stopped)
+	<-received
+	return result, partitions, err
+}
+
+// Returns inputs of n lines of words.
+func testWordInputs(n int) (inputs []string) {
+	for i := 0; i < n; i++ {
+		inputs = append(inputs, fmt.Sprintf("w%v w%v w%v\nw%v", i%7, i%5, i%3, i))
+	}
+	return inputs
+}
+
+// RunParallel produces the same result as RunSequential, in the order of the reduce
+// jobs, whatever the number of workers.
+func TestRunParallel(t *testing.T) {
+	inputs := testWordInputs(40)
+
+	result, expected, err := runTestJob(context.Background(), &Job{Task: newTestWordCountTask(t, 3), Mode: JOB_SEQUENTIAL}, inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) != 3 || result.NumMapOperations != 40 || result.NumReduceOperations != 3 {
+		t.Fatalf("sequential job sent %v partitions and ran %v map and %v reduce operations", len(expected), result.NumMapOperations, result.NumReduceOperations)
+	}
+
+	for _, numWorkers := range []int{0, 1, 4, 100} {
+		result, partitions, err := runTestJob(context.Background(), &Job{Task: newTestWordCountTask(t, 3), Mode: JOB_PARALLEL, NumWorkers: numWorkers}, inputs)
+		if err != nil {
+			t.Fatalf("%v workers: %v", numWorkers, err)
+		}
+
+		if fmt.Sprint(partitions) != fmt.Sprint(expected) {
+			t.Errorf("%v workers: sent %v, want %v", numWorkers, partitions, expected)
+		}
+		if result.NumMapOperations != 40 || result.Counters[MAP_INPUT_RECORDS] != 40 || len(result.Operations) != 43 {
+			t.Errorf("%v workers: %v map operations, %v map input records and %v operation stats", numWorkers, result.NumMapOperations, result.Counters[MAP_INPUT_RECORDS], len(result.Operations))
+		}
+	}
+}
+
+// A reduce operation that fails stops the others and fails the job.
+func TestRunParallelReduceFailure(t *testing.T) {
+	task := newTestWordCountTask(t, 4)
+	task.Reduce = func(key string, values Iterator) ([]KeyValue, error) {
+		if key == "w3" {
+			return nil, errors.New("reduce failed")
+		}
+		return testSumFunc(key, values)
+	}
+
+	if _, _, err := runTestJob(context.Background(), &Job{Task: task, Mode: JOB_PARALLEL, NumWorkers: 2}, testWordInputs(10)); err == nil || !strings.Contains(err.Error(), "reduce failed") {
+		t.Errorf("job returned %v, want the reduce error", err)
+	}
+}
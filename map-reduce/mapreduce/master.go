@@ -1,21 +1,35 @@
 package mapreduce
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/rpc"
 	"sync"
+	"time"
 )
 
 const (
-	IDLE_WORKER_BUFFER     = 100
+	IDLE_WORKER_BUFFER     = 1000
 	RETRY_OPERATION_BUFFER = 100
+
+	// Maximum number of operations run at once by a single worker
+	MAX_WORKER_SLOTS = 64
 )
 
 type Master struct {
-	// Task
-	task *Task
+	// Task of the first stage, which holds the settings of the whole job, and the tasks
+	// of every stage
+	task   *Task
+	stages []*Task
+
+	// Job state. ctx is cancelled once the job is over, failed or was cancelled,
+	// and err holds the error that failed it.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	errMutex sync.Mutex
+	err      error
 
 	// Network
 	address   string
@@ -23,33 +37,105 @@ type Master struct {
 	listener  net.Listener
 
 	// Workers handling
+	// workersMutex also guards the state of RemoteWorkers and Operations
 	workersMutex sync.Mutex
 	workers      map[int]*RemoteWorker
 	totalWorkers int // Used to generate unique ids for new workers
+	numChanges   int // Incremented when workers or their map outputs change, see operationHolders
 
-	idleWorkerChan   chan *RemoteWorker
+	idleWorkerChan   chan *RemoteWorker // Holds a worker once for each of its free slots
 	failedWorkerChan chan *RemoteWorker
 
 	// Fault Tolerance
+	journal                *journal // Journal of the current stage
 	failedOperationChan    chan *Operation
+	operations             []*Operation // Operations of the current phase
 	totalOperations        int
 	numCompletedOperations int
+
+	// Map operations run again during the reduce phase because their output was lost.
+	// They aren't counted with the operations of the phase.
+	totalReruns        int
+	numCompletedReruns int
+
+	// Map operations of the job, used to locate their output with LocalStorage
+	mapOperations []*Operation
+
+	// Counters and completed operations of the job
+	stats jobStats
+
+	// Operations handed to workers that pull them, by id. Guarded by workersMutex.
+	assignments      map[int]*assignment
+	totalAssignments int
+
+	// Closed once the job is over, telling workers that pull operations to exit, and
+	// whether it was completed. Guarded by workersMutex.
+	over      chan struct{}
+	completed bool
+
+	// Reported by the status server. Guarded by workersMutex.
+	startTime   time.Time
+	stage       int
+	phase       string
+	failures    []OperationFailure // Most recent failed attempts of operations
+	numFailures int
 }
 
+type operationStatus string
+
+const (
+	OPERATION_PENDING   operationStatus = "pending"
+	OPERATION_COMPLETED operationStatus = "completed"
+)
+
 type Operation struct {
 	proc     string
+	stage    int
 	id       int
 	filePath string
+	split    InputSplit // Input of the operation, filePath describes it
+
+	status    operationStatus
+	workers   map[int]*RemoteWorker // Workers currently running the operation
+	queued    time.Time             // When the operation started waiting for a worker
+	holders   map[int]bool          // Workers holding its data, see operationHolders
+	changes   int                   // Value of numChanges when holders were found
+	startTime time.Time             // When the current attempt started
+	backups   int                   // Number of speculative backups launched
+	failures  int                   // Number of attempts that returned an error
+	output    *RemoteWorker         // Worker that completed the operation and holds its files
+	rerun     bool                  // Map operation run again during the reduce phase
+
+	// Size of each partition of the output of a map operation, reported by its worker
+	partitionSizes []int64
 }
 
-// Construct a new Master struct
-func newMaster(address string) (master *Master) {
+// Construct a new Operation
+func newOperation(proc string, stage int, id int, split InputSplit) (operation *Operation) {
+	operation = new(Operation)
+	operation.proc = proc
+	operation.stage = stage
+	operation.id = id
+	operation.filePath = split.String()
+	operation.split = split
+	operation.status = OPERATION_PENDING
+	operation.workers = make(map[int]*RemoteWorker)
+	return
+}
+
+// Construct a new Master struct for a job that runs until ctx is cancelled
+func newMaster(ctx context.Context, address string) (master *Master) {
 	master = new(Master)
+	master.ctx, master.cancel = context.WithCancel(ctx)
 	master.address = address
 	master.workers = make(map[int]*RemoteWorker, 0)
 	master.idleWorkerChan = make(chan *RemoteWorker, IDLE_WORKER_BUFFER)
 	master.failedWorkerChan = make(chan *RemoteWorker, IDLE_WORKER_BUFFER)
+	master.failedOperationChan = make(chan *Operation, RETRY_OPERATION_BUFFER)
+	master.assignments = make(map[int]*assignment)
+	master.over = make(chan struct{})
 	master.totalWorkers = 0
+	master.startTime = time.Now()
 	return
 }
 
@@ -66,7 +152,7 @@ func (master *Master) acceptMultipleConnections() {
 		newConn, err = master.listener.Accept()
 
 		if err == nil {
-			go master.handleConnection(&newConn)
+			go master.handleConnection(newConn)
 		} else {
 			log.Println("Failed to accept connection. Error: ", err)
 			break
@@ -76,19 +162,172 @@ func (master *Master) acceptMultipleConnections() {
 	log.Println("Stopped accepting connections.")
 }
 
-// handleFailingWorkers will handle workers that fails during an operation.
+// handleFailingWorkers will handle workers that fails during an operation or stop
+// answering heartbeats. They are removed from the master list and the operations they
+// were running are scheduled again.
 func (master *Master) handleFailingWorkers() {
-	for worker := range master.failedWorkerChan {
+	var retry []*Operation
+
+	for {
+		var worker *RemoteWorker
+
+		select {
+		case worker = <-master.failedWorkerChan:
+		case <-master.ctx.Done():
+			return
+		}
+
 		master.workersMutex.Lock()
+
+		if worker.status == WORKER_DEAD {
+			master.workersMutex.Unlock()
+			continue
+		}
+
 		fmt.Printf("Removing worker %d from master list.\n", worker.id)
 		delete(master.workers, worker.id)
+		master.numChanges++
+		worker.status = WORKER_DEAD
+		if worker.removed != nil {
+			close(worker.removed)
+		}
+		master.stats.counters.Add(FAILED_WORKERS, 1)
+
+		// Every operation running on the worker is lost
+		retry = nil
+		for _, operation := range worker.operations {
+			delete(operation.workers, worker.id)
+
+			if operation.status != OPERATION_COMPLETED {
+				master.recordFailure(worker, operation, fmt.Errorf("worker %v failed", worker.id))
+
+				if len(operation.workers) == 0 {
+					retry = append(retry, operation)
+				}
+			}
+		}
+		worker.operations = nil
+
 		master.workersMutex.Unlock()
+
+		for _, operation := range retry {
+			log.Printf("Rescheduling %v '%v' from failed worker %v\n", operation.proc, operation.id, worker.id)
+			master.stats.counters.Add(OPERATION_RETRIES, 1)
+			master.failedOperationChan <- operation
+		}
+	}
+}
+
+// tryIdleWorker returns a worker with a free slot if there's one available, or nil
+// otherwise. Workers that were removed or started draining while waiting in
+// idleWorkerChan are discarded.
+func (master *Master) tryIdleWorker() *RemoteWorker {
+	for {
+		select {
+		case worker := <-master.idleWorkerChan:
+			master.workersMutex.Lock()
+			available := worker.available()
+			master.workersMutex.Unlock()
+
+			if available {
+				return worker
+			}
+
+			log.Printf("Discarding removed or draining worker %v from idle workers.\n", worker.id)
+		default:
+			return nil
+		}
 	}
 }
 
 // Handle a single connection until it's done, then closes it.
-func (master *Master) handleConnection(conn *net.Conn) error {
-	master.rpcServer.ServeConn(*conn)
-	(*conn).Close()
+func (master *Master) handleConnection(conn net.Conn) error {
+	master.rpcServer.ServeConn(conn)
+	conn.Close()
 	return nil
 }
+
+// fail stops the job with err. Only the first error is kept.
+func (master *Master) fail(err error) {
+	master.errMutex.Lock()
+	if master.err == nil {
+		log.Println("Job failed. Error:", err)
+		master.err = err
+	}
+	master.errMutex.Unlock()
+
+	master.cancel()
+}
+
+// Returns the reason the job stopped before it was over: the error that failed it,
+// or the error of the context if it was cancelled.
+func (master *Master) failure() error {
+	master.errMutex.Lock()
+	defer master.errMutex.Unlock()
+
+	if master.err != nil {
+		return master.err
+	}
+	return master.ctx.Err()
+}
+
+// closeWorkers tells every registered worker that the job is over, and whether it
+// was completed.
+func (master *Master) closeWorkers(completed bool) {
+	var (
+		workers []*RemoteWorker
+		pulling []*RemoteWorker
+		args    *DoneArgs
+		timer   *time.Timer
+	)
+
+	log.Println("Closing Remote Workers.")
+	master.workersMutex.Lock()
+	workers = make([]*RemoteWorker, 0, len(master.workers))
+	for _, worker := range master.workers {
+		if worker.assignments != nil {
+			pulling = append(pulling, worker)
+		} else {
+			workers = append(workers, worker)
+		}
+	}
+
+	// Workers that pull their operations are told the next time they ask for one
+	master.completed = completed
+	close(master.over)
+	master.workersMutex.Unlock()
+
+	args = &DoneArgs{JobId: master.task.JobId, JobCompleted: completed}
+
+	// Workers that stopped answering shouldn't keep the master from finishing
+	for _, worker := range workers {
+		err := callWithTimeout(worker.hostname, "Worker.Done", args, new(struct{}), heartbeatTimeout(master.task))
+		if err != nil {
+			log.Println("Failed to close Remote Worker. Error:", err)
+		}
+	}
+
+	timer = time.NewTimer(heartbeatTimeout(master.task))
+	defer timer.Stop()
+
+	for _, worker := range pulling {
+		select {
+		case <-worker.exited:
+		case <-timer.C:
+			log.Println("Failed to close Remote Workers. Error: workers didn't ask for operations")
+			return
+		}
+	}
+
+	log.Println("Done.")
+}
+
+// Returns whether the job of master is over. Its workers were told or are being told.
+func (master *Master) isOver() bool {
+	select {
+	case <-master.over:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,97 @@
+package mapreduce
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// How often Decommission checks whether a draining worker can leave
+	DRAIN_POLL_INTERVAL = 100 * time.Millisecond
+)
+
+// RPC - Decommission
+// Called by a worker that leaves the job. No more operations are scheduled on it, and
+// it's removed once the operations it's running are done and, with LocalStorage, the
+// reduce operations of the stage don't need the map outputs it holds anymore. Returns
+// then, or once the job is over. Unlike a failure, nothing is run again.
+func (master *Master) Decommission(args *DecommissionArgs, _ *struct{}) error {
+	var (
+		worker *RemoteWorker
+		ok     bool
+		ticker *time.Ticker
+	)
+
+	master.workersMutex.Lock()
+	if worker, ok = master.workers[args.WorkerId]; ok {
+		worker.status = WORKER_DRAINING
+	}
+	master.workersMutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("unknown worker %v", args.WorkerId)
+	}
+
+	log.Printf("Draining worker %v.\n", worker.id)
+
+	ticker = time.NewTicker(DRAIN_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		master.workersMutex.Lock()
+
+		if worker.status == WORKER_DEAD {
+			master.workersMutex.Unlock()
+			return fmt.Errorf("worker %v failed while draining", worker.id)
+		}
+
+		if len(worker.operations) == 0 && !master.holdsNeededOutputs(worker) {
+			delete(master.workers, worker.id)
+			master.numChanges++
+			worker.status = WORKER_DEAD
+			if worker.removed != nil {
+				close(worker.removed)
+			}
+			master.workersMutex.Unlock()
+
+			log.Printf("Decommissioned worker %d.\n", worker.id)
+			return nil
+		}
+
+		master.workersMutex.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-master.over:
+			return nil
+		case <-master.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Returns whether reduce operations of the current stage may still read map outputs
+// kept on worker with LocalStorage. Should be called with workersMutex held.
+func (master *Master) holdsNeededOutputs(worker *RemoteWorker) bool {
+	var operations []*Operation = master.operations
+
+	if !master.task.LocalStorage {
+		return false
+	}
+
+	// The reduce phase only reads the map outputs until all of its operations are done
+	if master.phase == PHASE_REDUCE {
+		if master.totalOperations > 0 && master.numCompletedOperations == master.totalOperations {
+			return false
+		}
+		operations = master.mapOperations
+	}
+
+	for _, operation := range operations {
+		if operation.status == OPERATION_COMPLETED && operation.output == worker {
+			return true
+		}
+	}
+	return false
+}
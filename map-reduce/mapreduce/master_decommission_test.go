@@ -0,0 +1,110 @@
+package mapreduce
+
+import (
+	"testing"
+	"time"
+)
+
+// Returns the error of a call to Decommission for worker, once it returns.
+func decommissionTestWorker(master *Master, worker *RemoteWorker) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- master.Decommission(&DecommissionArgs{JobId: "job", WorkerId: worker.id}, nil)
+	}()
+	return done
+}
+
+// Returns true if Decommission returned before the timeout, with its error.
+func decommissioned(done chan error, timeout time.Duration) (ok bool, err error) {
+	select {
+	case err = <-done:
+		return true, err
+	case <-time.After(timeout):
+		return false, nil
+	}
+}
+
+// A draining worker gets no more operations and leaves once the ones it runs are done,
+// without counting as a failure.
+func TestDecommission(t *testing.T) {
+	master := newTestSchedulerMaster(t, &Task{JobId: "job"})
+	worker := newRemoteWorker(0, "worker", 2)
+	master.workers[worker.id] = worker
+
+	operation := newOperation("Worker.RunMap", 0, 0, InputSplit{Path: "a"})
+	master.assignOperation(worker, operation)
+	master.idleWorkerChan <- worker
+
+	done := decommissionTestWorker(master, worker)
+	if ok, _ := decommissioned(done, 3*DRAIN_POLL_INTERVAL); ok {
+		t.Fatal("worker left while running an operation")
+	}
+
+	if idle := master.tryIdleWorker(); idle != nil {
+		t.Error("draining worker got a free slot")
+	}
+
+	master.workersMutex.Lock()
+	worker.removeOperation(operation)
+	master.workersMutex.Unlock()
+
+	ok, err := decommissioned(done, 5*time.Second)
+	if !ok || err != nil {
+		t.Fatalf("Decommission returned %v, %v", ok, err)
+	}
+
+	master.workersMutex.Lock()
+	defer master.workersMutex.Unlock()
+
+	if _, ok := master.workers[worker.id]; ok || worker.status != WORKER_DEAD {
+		t.Error("decommissioned worker still registered")
+	}
+	if master.stats.counters.Get(FAILED_WORKERS) != 0 || len(master.failedOperationChan) != 0 {
+		t.Error("decommissioned worker handled as a failure")
+	}
+}
+
+// With LocalStorage, workers holding map outputs stay until the reduce phase is done.
+func TestDecommissionHoldsOutputs(t *testing.T) {
+	worker := newRemoteWorker(0, "worker", 1)
+	master := newTestReduceMaster(t, worker, 2)
+	master.task.JobId = "job"
+	master.totalOperations = 1
+
+	done := decommissionTestWorker(master, worker)
+	if ok, _ := decommissioned(done, 3*DRAIN_POLL_INTERVAL); ok {
+		t.Fatal("worker left while reduce operations need its map outputs")
+	}
+
+	master.workersMutex.Lock()
+	master.numCompletedOperations = 1
+	master.workersMutex.Unlock()
+
+	if ok, err := decommissioned(done, 5*time.Second); !ok || err != nil {
+		t.Fatalf("Decommission returned %v, %v once the reduce phase was done", ok, err)
+	}
+}
+
+func TestDecommissionErrors(t *testing.T) {
+	master := newTestSchedulerMaster(t, &Task{JobId: "job"})
+
+	if err := master.Decommission(&DecommissionArgs{JobId: "job", WorkerId: 3}, nil); err == nil {
+		t.Error("unknown worker decommissioned")
+	}
+
+	// Workers that fail while draining are reported
+	worker := newRemoteWorker(0, "worker", 1)
+	master.workers[worker.id] = worker
+	master.assignOperation(worker, newOperation("Worker.RunMap", 0, 0, InputSplit{Path: "a"}))
+
+	done := decommissionTestWorker(master, worker)
+	time.Sleep(DRAIN_POLL_INTERVAL)
+
+	master.workersMutex.Lock()
+	worker.status = WORKER_DEAD
+	master.workersMutex.Unlock()
+
+	if ok, err := decommissioned(done, 5*time.Second); !ok || err == nil {
+		t.Errorf("Decommission returned %v, %v for a worker that failed", ok, err)
+	}
+}
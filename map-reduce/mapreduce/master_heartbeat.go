@@ -0,0 +1,95 @@
+package mapreduce
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	DEFAULT_HEARTBEAT_INTERVAL = time.Second
+	DEFAULT_HEARTBEAT_TIMEOUT  = 5 * time.Second
+)
+
+// monitorWorkers will ping every registered worker each heartbeat interval. Workers
+// that don't answer for longer than the heartbeat timeout are considered failed, even
+// if they are idle, so they are never scheduled again.
+func (master *Master) monitorWorkers() {
+	var (
+		interval time.Duration
+		ticker   *time.Ticker
+		workers  []*RemoteWorker
+	)
+
+	interval = heartbeatInterval(master.task)
+
+	ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-master.ctx.Done():
+			return
+		}
+
+		master.workersMutex.Lock()
+		workers = make([]*RemoteWorker, 0, len(master.workers))
+		for _, worker := range master.workers {
+			workers = append(workers, worker)
+		}
+		master.workersMutex.Unlock()
+
+		for _, worker := range workers {
+			go master.checkWorker(worker, interval)
+		}
+	}
+}
+
+// checkWorker pings a single worker and reports it as failed if its last heartbeat
+// is older than the heartbeat timeout. Workers that pull their operations can't be
+// pinged, they call Master.Heartbeat instead.
+func (master *Master) checkWorker(worker *RemoteWorker, interval time.Duration) {
+	var (
+		err     error
+		timeout time.Duration
+		failed  bool
+	)
+
+	timeout = heartbeatTimeout(master.task)
+
+	if worker.assignments == nil {
+		err = callWithTimeout(worker.hostname, "Worker.Ping", &PingArgs{JobId: master.task.JobId}, new(struct{}), interval)
+	}
+
+	master.workersMutex.Lock()
+	if err == nil && worker.assignments == nil {
+		worker.lastHeartbeat = time.Now()
+	}
+	failed = worker.status != WORKER_DEAD && time.Since(worker.lastHeartbeat) > timeout
+	master.workersMutex.Unlock()
+
+	if failed {
+		if err != nil {
+			log.Printf("Worker %v missed heartbeats for %v. Error: %v\n", worker.id, timeout, err)
+		} else {
+			log.Printf("Worker %v missed heartbeats for %v.\n", worker.id, timeout)
+		}
+		master.failedWorkerChan <- worker
+	}
+}
+
+// Returns the time between heartbeats.
+func heartbeatInterval(task *Task) time.Duration {
+	if task.HeartbeatInterval <= 0 {
+		return DEFAULT_HEARTBEAT_INTERVAL
+	}
+	return task.HeartbeatInterval
+}
+
+// Returns the time without heartbeats after which a worker is considered failed.
+func heartbeatTimeout(task *Task) time.Duration {
+	if task.HeartbeatTimeout <= 0 {
+		return DEFAULT_HEARTBEAT_TIMEOUT
+	}
+	return task.HeartbeatTimeout
+}
@@ -0,0 +1,166 @@
+package mapreduce
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+type testPingService struct{}
+
+func (testPingService) Ping(args *PingArgs, _ *struct{}) error { return nil }
+
+// Returns the address of an RPC server answering Worker.Ping, closed with the test.
+func startTestWorkerServer(t *testing.T) string {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Worker", testPingService{}); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go server.Accept(listener)
+	return listener.Addr().String()
+}
+
+// Returns an address nothing listens on.
+func closedTestAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	return listener.Addr().String()
+}
+
+func newTestHeartbeatMaster(t *testing.T) *Master {
+	master := newMaster(context.Background(), "")
+	t.Cleanup(master.cancel)
+	master.task = &Task{JobId: "job", HeartbeatInterval: 10 * time.Millisecond, HeartbeatTimeout: 100 * time.Millisecond}
+	return master
+}
+
+// Returns true if the worker was reported as failed.
+func reportedFailed(master *Master, worker *RemoteWorker) bool {
+	select {
+	case failed := <-master.failedWorkerChan:
+		return failed == worker
+	default:
+		return false
+	}
+}
+
+// Workers that answer pings stay alive, the ones that don't are only reported once
+// their last heartbeat is older than the timeout.
+func TestCheckWorker(t *testing.T) {
+	master := newTestHeartbeatMaster(t)
+	stale := time.Now().Add(-time.Second)
+
+	alive := newRemoteWorker(0, startTestWorkerServer(t), 1)
+	alive.lastHeartbeat = stale
+	master.checkWorker(alive, time.Second)
+
+	if reportedFailed(master, alive) || !alive.lastHeartbeat.After(stale) {
+		t.Error("worker answering pings reported failed or without a new heartbeat")
+	}
+
+	unreachable := newRemoteWorker(1, closedTestAddress(t), 1)
+	master.checkWorker(unreachable, time.Second)
+
+	if reportedFailed(master, unreachable) {
+		t.Error("worker reported failed before the heartbeat timeout")
+	}
+
+	unreachable.lastHeartbeat = stale
+	master.checkWorker(unreachable, time.Second)
+
+	if !reportedFailed(master, unreachable) {
+		t.Error("unreachable worker not reported failed after the heartbeat timeout")
+	}
+
+	// Dead workers aren't reported again
+	unreachable.status = WORKER_DEAD
+	master.checkWorker(unreachable, time.Second)
+
+	if reportedFailed(master, unreachable) {
+		t.Error("removed worker reported failed again")
+	}
+}
+
+// Workers that pull their operations aren't pinged, their heartbeats come from their
+// calls to Master.
+func TestCheckPullingWorker(t *testing.T) {
+	master := newTestHeartbeatMaster(t)
+
+	worker := newPullingWorker(0, closedTestAddress(t), 1)
+	worker.lastHeartbeat = time.Now().Add(-time.Second)
+	master.workers[worker.id] = worker
+
+	if err := master.Heartbeat(&HeartbeatArgs{JobId: "job", WorkerId: worker.id}, nil); err != nil {
+		t.Fatal(err)
+	}
+	master.checkWorker(worker, time.Second)
+
+	if reportedFailed(master, worker) {
+		t.Error("worker reported failed right after its heartbeat")
+	}
+
+	worker.lastHeartbeat = time.Now().Add(-time.Second)
+	master.checkWorker(worker, time.Second)
+
+	if !reportedFailed(master, worker) {
+		t.Error("worker without heartbeats not reported failed")
+	}
+
+	if err := master.Heartbeat(&HeartbeatArgs{JobId: "job", WorkerId: 7}, nil); err == nil {
+		t.Error("heartbeat of an unknown worker accepted")
+	}
+}
+
+// Failed workers are removed, and the operations they were running are scheduled
+// again unless another worker is still running them.
+func TestHandleFailingWorkers(t *testing.T) {
+	master := newTestHeartbeatMaster(t)
+
+	failed := newRemoteWorker(0, "failed", 2)
+	other := newRemoteWorker(1, "other", 1)
+	master.workers[failed.id] = failed
+	master.workers[other.id] = other
+
+	lost := newOperation("Worker.RunMap", 0, 0, InputSplit{Path: "a"})
+	backedUp := newOperation("Worker.RunMap", 0, 1, InputSplit{Path: "b"})
+	master.assignOperation(failed, lost)
+	master.assignOperation(failed, backedUp)
+	master.assignOperation(other, backedUp)
+
+	go master.handleFailingWorkers()
+	master.failedWorkerChan <- failed
+
+	select {
+	case operation := <-master.failedOperationChan:
+		if operation != lost {
+			t.Errorf("operation %v scheduled again, want %v", operation.id, lost.id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("operation of the failed worker not scheduled again")
+	}
+
+	master.workersMutex.Lock()
+	defer master.workersMutex.Unlock()
+
+	if _, ok := master.workers[failed.id]; ok || failed.status != WORKER_DEAD {
+		t.Error("failed worker not removed")
+	}
+	if len(backedUp.workers) != 1 || backedUp.workers[other.id] != other {
+		t.Errorf("operation running on another worker has workers %v", backedUp.workers)
+	}
+	if len(master.failedOperationChan) != 0 {
+		t.Error("operation still running on another worker scheduled again")
+	}
+}
@@ -0,0 +1,279 @@
+package mapreduce
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Number of recent operation failures kept for the status server
+	STATUS_MAX_FAILURES = 100
+)
+
+// JobStatus is the state of a distributed job, served by the status server of Master.
+type JobStatus struct {
+	StartTime time.Time
+
+	// Phase that is running and the progress of its operations
+	Stage               int
+	NumStages           int
+	Phase               string
+	CompletedOperations int
+	TotalOperations     int
+
+	// Map operations run again during the reduce phase because their output was lost
+	CompletedReruns int
+	TotalReruns     int
+
+	Workers []WorkerInfo
+
+	// Most recent failures, up to STATUS_MAX_FAILURES, and the total number of them
+	Failures    []OperationFailure
+	NumFailures int
+
+	Counters map[string]int64
+}
+
+// WorkerInfo describes a worker registered with Master.
+type WorkerInfo struct {
+	Id            int
+	Hostname      string
+	Status        string
+	Slots         int
+	Operations    []string // Operations that are running, as "<phase> <id>"
+	LastHeartbeat time.Time
+}
+
+// OperationFailure is an attempt of an operation that returned an error or was running
+// on a worker that failed.
+type OperationFailure struct {
+	Stage  int
+	Phase  string
+	Id     int
+	Worker string
+	Error  string
+	Time   time.Time
+}
+
+// Keep a failed attempt of operation for the status server. Should be called with
+// workersMutex held.
+func (master *Master) recordFailure(worker *RemoteWorker, operation *Operation, err error) {
+	master.numFailures++
+	master.failures = append(master.failures, OperationFailure{
+		Stage:  operation.stage,
+		Phase:  operationPhase(operation.proc),
+		Id:     operation.id,
+		Worker: worker.hostname,
+		Error:  err.Error(),
+		Time:   time.Now(),
+	})
+
+	if len(master.failures) > STATUS_MAX_FAILURES {
+		master.failures = master.failures[len(master.failures)-STATUS_MAX_FAILURES:]
+	}
+}
+
+// Returns the current state of the job.
+func (master *Master) status() (status JobStatus) {
+	master.workersMutex.Lock()
+
+	status.StartTime = master.startTime
+	status.Stage = master.stage
+	status.NumStages = len(master.stages)
+	status.Phase = master.phase
+	status.CompletedOperations = master.numCompletedOperations
+	status.TotalOperations = master.totalOperations
+	status.CompletedReruns = master.numCompletedReruns
+	status.TotalReruns = master.totalReruns
+
+	status.Workers = make([]WorkerInfo, 0, len(master.workers))
+	for _, worker := range master.workers {
+		info := WorkerInfo{
+			Id:            worker.id,
+			Hostname:      worker.hostname,
+			Status:        string(worker.status),
+			Slots:         worker.slots,
+			Operations:    make([]string, 0, len(worker.operations)),
+			LastHeartbeat: worker.lastHeartbeat,
+		}
+		for _, operation := range worker.operations {
+			info.Operations = append(info.Operations, fmt.Sprintf("%v %v", operationPhase(operation.proc), operation.id))
+		}
+		status.Workers = append(status.Workers, info)
+	}
+
+	status.Failures = append(make([]OperationFailure, 0, len(master.failures)), master.failures...)
+	status.NumFailures = master.numFailures
+
+	master.workersMutex.Unlock()
+
+	sort.Slice(status.Workers, func(i, j int) bool {
+		return status.Workers[i].Id < status.Workers[j].Id
+	})
+
+	status.Counters = master.stats.counters.Values()
+	return status
+}
+
+// serveStatus runs an HTTP server on address with the status of the job until it's
+// over. It serves a dashboard on /, the JobStatus as JSON on /api/status, and metrics
+// in the Prometheus text format on /metrics.
+func (master *Master) serveStatus(address string) (stop func(), err error) {
+	var (
+		listener net.Listener
+		mux      *http.ServeMux = http.NewServeMux()
+		server   *http.Server
+	)
+
+	if listener, err = net.Listen("tcp", address); err != nil {
+		return nil, fmt.Errorf("failed to start status server: %w", err)
+	}
+
+	mux.HandleFunc("/", master.handleDashboard)
+	mux.HandleFunc("/api/status", master.handleStatus)
+	mux.HandleFunc("/metrics", master.handleMetrics)
+
+	server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	log.Printf("Serving job status on http://%v/\n", listener.Addr())
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Println("Status server failed. Error:", err)
+		}
+	}()
+
+	return func() { server.Close() }, nil
+}
+
+func (master *Master) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(master.status()); err != nil {
+		log.Println("Failed to write job status. Error:", err)
+	}
+}
+
+func (master *Master) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var (
+		status   JobStatus = master.status()
+		builder  strings.Builder
+		statuses map[string]int = map[string]int{string(WORKER_IDLE): 0, string(WORKER_RUNNING): 0, string(WORKER_DRAINING): 0}
+		names    []string
+		slots    int
+		busy     int
+	)
+
+	metric := func(name string, kind string, help string) {
+		fmt.Fprintf(&builder, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+	}
+
+	metric("mapreduce_stage", "gauge", "Stage of the job that is running.")
+	fmt.Fprintf(&builder, "mapreduce_stage %v\n", status.Stage)
+
+	metric("mapreduce_phase_operations", "gauge", "Operations of the phase that is running.")
+	fmt.Fprintf(&builder, "mapreduce_phase_operations{phase=%q,state=\"completed\"} %v\n", status.Phase, status.CompletedOperations)
+	fmt.Fprintf(&builder, "mapreduce_phase_operations{phase=%q,state=\"total\"} %v\n", status.Phase, status.TotalOperations)
+
+	metric("mapreduce_rerun_operations", "gauge", "Map operations run again during the reduce phase because their output was lost.")
+	fmt.Fprintf(&builder, "mapreduce_rerun_operations{state=\"completed\"} %v\n", status.CompletedReruns)
+	fmt.Fprintf(&builder, "mapreduce_rerun_operations{state=\"total\"} %v\n", status.TotalReruns)
+
+	for _, worker := range status.Workers {
+		statuses[worker.Status]++
+		slots += worker.Slots
+		busy += len(worker.Operations)
+	}
+
+	metric("mapreduce_workers", "gauge", "Registered workers by status.")
+	for _, name := range []string{string(WORKER_IDLE), string(WORKER_RUNNING), string(WORKER_DRAINING)} {
+		fmt.Fprintf(&builder, "mapreduce_workers{status=%q} %v\n", name, statuses[name])
+	}
+
+	metric("mapreduce_worker_slots", "gauge", "Slots of registered workers, running an operation or not.")
+	fmt.Fprintf(&builder, "mapreduce_worker_slots{state=\"busy\"} %v\n", busy)
+	fmt.Fprintf(&builder, "mapreduce_worker_slots{state=\"free\"} %v\n", slots-busy)
+
+	metric("mapreduce_operation_failures_total", "counter", "Attempts of operations that failed.")
+	fmt.Fprintf(&builder, "mapreduce_operation_failures_total %v\n", status.NumFailures)
+
+	for name := range status.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metric("mapreduce_counter_total", "counter", "Built-in and user-defined counters of the job.")
+	for _, name := range names {
+		fmt.Fprintf(&builder, "mapreduce_counter_total{name=\"%v\"} %v\n", labelEscaper.Replace(name), status.Counters[name])
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := w.Write([]byte(builder.String())); err != nil {
+		log.Println("Failed to write metrics. Error:", err)
+	}
+}
+
+// Escapes label values in the Prometheus text format
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func (master *Master) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, master.status()); err != nil {
+		log.Println("Failed to write dashboard. Error:", err)
+	}
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="2">
+<title>MapReduce</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>MapReduce job</h1>
+<p>Started {{.StartTime.Format "2006-01-02 15:04:05"}}.
+Stage {{.Stage}} of {{.NumStages}}, {{.Phase}} phase: {{.CompletedOperations}}/{{.TotalOperations}} operations completed.
+{{if .TotalReruns}}{{.CompletedReruns}}/{{.TotalReruns}} lost map outputs created again.{{end}}</p>
+
+<h2>Workers</h2>
+<table>
+<tr><th>Id</th><th>Hostname</th><th>Status</th><th>Slots</th><th>Operations</th><th>Last heartbeat</th></tr>
+{{range .Workers}}<tr><td>{{.Id}}</td><td>{{.Hostname}}</td><td>{{.Status}}</td><td>{{len .Operations}}/{{.Slots}}</td><td>{{range $i, $op := .Operations}}{{if $i}}, {{end}}{{$op}}{{end}}</td><td>{{.LastHeartbeat.Format "15:04:05"}}</td></tr>
+{{end}}</table>
+
+<h2>Failures ({{.NumFailures}})</h2>
+<table>
+<tr><th>Time</th><th>Stage</th><th>Operation</th><th>Worker</th><th>Error</th></tr>
+{{range .Failures}}<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.Stage}}</td><td>{{.Phase}} {{.Id}}</td><td>{{.Worker}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+
+<h2>Counters</h2>
+<table>
+{{range $name, $value := .Counters}}<tr><td>{{$name}}</td><td>{{$value}}</td></tr>
+{{end}}</table>
+
+<p>JSON: <a href="/api/status">/api/status</a>, Prometheus: <a href="/metrics">/metrics</a></p>
+</body>
+</html>
+`))
@@ -0,0 +1,120 @@
+package mapreduce
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Returns a Master in the map phase of a job, with a worker running an operation and
+// another one that failed it.
+func newTestStatusMaster(t *testing.T) *Master {
+	master := newTestSchedulerMaster(t, &Task{JobId: "job"})
+	master.phase = PHASE_MAP
+	master.totalOperations = 3
+	master.numCompletedOperations = 1
+
+	running := newRemoteWorker(0, "running", 2)
+	failed := newRemoteWorker(1, "failed", 1)
+	master.workers[running.id] = running
+
+	operation := newOperation("Worker.RunMap", 0, 2, InputSplit{Path: "input"})
+	master.assignOperation(running, operation)
+	running.status = WORKER_RUNNING
+	master.recordFailure(failed, operation, errors.New("worker 1 failed"))
+	master.stats.counters.Add(MAP_INPUT_RECORDS, 7)
+	master.stats.counters.Add(`quoted "name"`, 1)
+
+	return master
+}
+
+// Returns the response of a handler of the status server to a GET of path.
+func getStatus(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder
+}
+
+func TestStatusJSON(t *testing.T) {
+	master := newTestStatusMaster(t)
+
+	response := getStatus(master.handleStatus, "/api/status")
+	var status JobStatus
+	if err := json.Unmarshal(response.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Phase != PHASE_MAP || status.CompletedOperations != 1 || status.TotalOperations != 3 || status.NumStages != 1 {
+		t.Errorf("status of the phase: %+v", status)
+	}
+	if len(status.Workers) != 1 || status.Workers[0].Hostname != "running" || strings.Join(status.Workers[0].Operations, ",") != "map 2" {
+		t.Errorf("workers: %+v", status.Workers)
+	}
+	if status.NumFailures != 1 || status.Failures[0].Worker != "failed" || status.Failures[0].Error != "worker 1 failed" {
+		t.Errorf("failures: %v, %+v", status.NumFailures, status.Failures)
+	}
+	if status.Counters[MAP_INPUT_RECORDS] != 7 {
+		t.Errorf("counters: %v", status.Counters)
+	}
+}
+
+func TestStatusMetrics(t *testing.T) {
+	master := newTestStatusMaster(t)
+	metrics := getStatus(master.handleMetrics, "/metrics").Body.String()
+
+	for _, line := range []string{
+		`mapreduce_phase_operations{phase="map",state="completed"} 1`,
+		`mapreduce_phase_operations{phase="map",state="total"} 3`,
+		`mapreduce_workers{status="running"} 1`,
+		`mapreduce_worker_slots{state="busy"} 1`,
+		`mapreduce_worker_slots{state="free"} 1`,
+		`mapreduce_operation_failures_total 1`,
+		`mapreduce_counter_total{name="MAP_INPUT_RECORDS"} 7`,
+		`mapreduce_counter_total{name="quoted \"name\""} 1`,
+		`# TYPE mapreduce_counter_total counter`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("metrics without %q:\n%v", line, metrics)
+		}
+	}
+}
+
+func TestStatusDashboard(t *testing.T) {
+	master := newTestStatusMaster(t)
+
+	dashboard := getStatus(master.handleDashboard, "/").Body.String()
+	for _, text := range []string{"map phase: 1/3 operations completed", "<td>running</td>", "<td>1/2</td>", "worker 1 failed", "MAP_INPUT_RECORDS"} {
+		if !strings.Contains(dashboard, text) {
+			t.Errorf("dashboard without %q", text)
+		}
+	}
+	if strings.Contains(dashboard, "lost map outputs") {
+		t.Error("dashboard shows reruns without any")
+	}
+
+	if response := getStatus(master.handleDashboard, "/other"); response.Code != http.StatusNotFound {
+		t.Errorf("GET /other = %v, want 404", response.Code)
+	}
+}
+
+// Only the most recent failures are kept, but all of them are counted.
+func TestStatusFailures(t *testing.T) {
+	master := newTestStatusMaster(t)
+	worker := newRemoteWorker(2, "worker", 1)
+	operation := newOperation("Worker.RunReduce", 0, 0, InputSplit{Path: "reduce-0"})
+
+	for i := 0; i < STATUS_MAX_FAILURES+10; i++ {
+		master.recordFailure(worker, operation, errors.New("reduce failed"))
+	}
+
+	status := master.status()
+	if status.NumFailures != STATUS_MAX_FAILURES+11 || len(status.Failures) != STATUS_MAX_FAILURES {
+		t.Errorf("%v failures counted and %v kept", status.NumFailures, len(status.Failures))
+	}
+	if status.Failures[0].Phase != PHASE_REDUCE {
+		t.Errorf("oldest failure kept is %+v, want a reduce failure", status.Failures[0])
+	}
+}
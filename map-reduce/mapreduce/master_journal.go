@@ -0,0 +1,255 @@
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	JOURNAL_FILE = "journal"
+)
+
+type journalEvent string
+
+const (
+	JOURNAL_JOB_START      journalEvent = "job-start"
+	JOURNAL_OPERATION_DONE journalEvent = "operation-done"
+	JOURNAL_STAGE_DONE     journalEvent = "stage-done"
+	JOURNAL_JOB_DONE       journalEvent = "job-done"
+)
+
+// journalEntry is a single line of the journal.
+type journalEntry struct {
+	Event      journalEvent
+	Phase      string `json:",omitempty"`
+	Id         int    `json:",omitempty"`
+	FilePath   string `json:",omitempty"`
+	ReduceJobs int    `json:",omitempty"`
+
+	// Operations run by a stage that isn't the last one of the job
+	MapOperations    int `json:",omitempty"`
+	ReduceOperations int `json:",omitempty"`
+}
+
+// journal is a write-ahead log of the progress of the job on the Master. Every
+// completed operation is synced to disk before the Master moves on, so a
+// restarted Master can resume the job reusing the files that were already created.
+type journal struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+
+	completedOperations map[string]map[int]string // Phase -> operation id -> file path
+	completedStage      *Result                   // Set once the stage was completed
+}
+
+// Returns the path of the journal of the job.
+func journalPath(task *Task) string {
+	return filepath.Join(task.ScratchPath(), JOURNAL_FILE)
+}
+
+// openJournal will load the journal left by a previous Master, if there's one for an
+// unfinished job with the same settings, and open it to record new entries. Otherwise
+// the intermediate and result files are removed and a new journal is started.
+func openJournal(task *Task) (j *journal, resumed bool, err error) {
+	var (
+		entries []journalEntry
+		size    int64
+	)
+
+	j = new(journal)
+	j.completedOperations = make(map[string]map[int]string)
+
+	entries, size = loadJournal(journalPath(task))
+	resumed = canResume(task, entries)
+
+	if resumed {
+		for _, entry := range entries {
+			j.apply(entry)
+		}
+		log.Printf("Resuming job from journal (%v entries)\n", len(entries))
+
+		// A partially written entry would hide the ones appended after it
+		if err = os.Truncate(journalPath(task), size); err != nil {
+			return nil, false, err
+		}
+	} else {
+		_ = RemoveContents(task.ScratchPath())
+		_ = RemoveContents(task.OutputPath())
+	}
+
+	if j.file, err = os.OpenFile(journalPath(task), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, false, err
+	}
+	j.encoder = json.NewEncoder(j.file)
+
+	if !resumed {
+		if err = j.record(journalEntry{Event: JOURNAL_JOB_START, ReduceJobs: task.NumReduceJobs}); err != nil {
+			j.file.Close()
+			return nil, false, err
+		}
+	}
+
+	return j, resumed, nil
+}
+
+// Read all the entries of a journal, one per line, and return them with the size of
+// the lines they were read from. A partially written entry at the end, left by a
+// crash, is ignored.
+func loadJournal(path string) (entries []journalEntry, size int64) {
+	var (
+		err    error
+		file   *os.File
+		reader *bufio.Reader
+		line   []byte
+	)
+
+	entries = make([]journalEntry, 0)
+
+	if file, err = os.Open(path); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("Failed to open journal. Error:", err)
+		}
+		return entries, 0
+	}
+	defer file.Close()
+
+	reader = bufio.NewReader(file)
+
+	for {
+		var entry journalEntry
+
+		// Entries are only complete once their newline was written
+		if line, err = reader.ReadBytes('\n'); err != nil {
+			break
+		}
+		if err = json.Unmarshal(line, &entry); err != nil {
+			break
+		}
+
+		entries = append(entries, entry)
+		size += int64(len(line))
+	}
+
+	return entries, size
+}
+
+// A job can be resumed if it was started with the same number of reduce jobs and
+// wasn't finished.
+func canResume(task *Task, entries []journalEntry) bool {
+	if len(entries) == 0 || entries[0].Event != JOURNAL_JOB_START {
+		return false
+	}
+
+	if entries[len(entries)-1].Event == JOURNAL_JOB_DONE {
+		return false
+	}
+
+	if entries[0].ReduceJobs != task.NumReduceJobs {
+		log.Printf("Ignoring journal of a job with %v reduce jobs.\n", entries[0].ReduceJobs)
+		return false
+	}
+
+	return true
+}
+
+// Update the state of the journal with an entry.
+func (j *journal) apply(entry journalEntry) {
+	switch entry.Event {
+	case JOURNAL_OPERATION_DONE:
+		if j.completedOperations[entry.Phase] == nil {
+			j.completedOperations[entry.Phase] = make(map[int]string)
+		}
+		j.completedOperations[entry.Phase][entry.Id] = entry.FilePath
+	case JOURNAL_STAGE_DONE:
+		j.completedStage = &Result{NumMapOperations: entry.MapOperations, NumReduceOperations: entry.ReduceOperations}
+	}
+}
+
+// Append an entry to the journal and sync it to disk.
+func (j *journal) record(entry journalEntry) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if err := j.encoder.Encode(&entry); err != nil {
+		return err
+	}
+
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+
+	j.apply(entry)
+	return nil
+}
+
+func (j *journal) operationDone(operation *Operation) error {
+	return j.record(journalEntry{Event: JOURNAL_OPERATION_DONE, Phase: operation.proc, Id: operation.id, FilePath: operation.filePath})
+}
+
+// Stages of a pipeline before the last one are done once their result is written, but
+// their journal is kept, so a restarted Master doesn't run them again.
+func (j *journal) stageDone(result *Result) error {
+	return j.record(journalEntry{Event: JOURNAL_STAGE_DONE, MapOperations: result.NumMapOperations, ReduceOperations: result.NumReduceOperations})
+}
+
+func (j *journal) jobDone() error {
+	return j.record(journalEntry{Event: JOURNAL_JOB_DONE})
+}
+
+// Close the journal. The job can still be resumed unless jobDone was recorded.
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+// Returns true if the operation was completed for the same file before the Master
+// restarted, and the files it created are still there.
+func (j *journal) isOperationDone(task *Task, operation *Operation) bool {
+	j.mutex.Lock()
+	filePath, ok := j.completedOperations[operation.proc][operation.id]
+	j.mutex.Unlock()
+
+	return ok && filePath == operation.filePath && operationOutputExists(task, operation.proc, operation.id)
+}
+
+// Returns the result of the stage if it was completed before the Master restarted, and
+// the result files it wrote are still there.
+func (j *journal) stageResult(task *Task) (*Result, bool) {
+	j.mutex.Lock()
+	result := j.completedStage
+	j.mutex.Unlock()
+
+	if result == nil {
+		return nil, false
+	}
+
+	for r := 0; r < task.NumReduceJobs; r++ {
+		if !operationOutputExists(task, "Worker.RunReduce", r) {
+			return nil, false
+		}
+	}
+	return result, true
+}
+
+// finishJournal records that the job of an earlier stage of the pipeline is over, so
+// its journal isn't resumed by the next run of the job.
+func finishJournal(task *Task) error {
+	file, err := os.OpenFile(journalPath(task), os.O_WRONLY|os.O_APPEND, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err = json.NewEncoder(file).Encode(&journalEntry{Event: JOURNAL_JOB_DONE}); err != nil {
+		return err
+	}
+	return file.Sync()
+}
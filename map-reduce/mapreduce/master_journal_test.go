@@ -0,0 +1,147 @@
+package mapreduce
+
+import (
+	"os"
+	"testing"
+)
+
+// Returns a task whose scratch directory is a new temporary directory.
+func journalTestTask(t *testing.T) *Task {
+	task := &Task{JobId: "job", ScratchDir: t.TempDir(), NumReduceJobs: 3}
+	if err := os.MkdirAll(task.ScratchPath(), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+// Records an operation of the journal as completed.
+func recordTestOperation(t *testing.T, j *journal, proc string, id int, filePath string) {
+	if err := j.record(journalEntry{Event: JOURNAL_OPERATION_DONE, Phase: proc, Id: id, FilePath: filePath}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalResume(t *testing.T) {
+	task := journalTestTask(t)
+
+	j, resumed, err := openJournal(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed {
+		t.Fatal("resumed a job without a journal")
+	}
+
+	recordTestOperation(t, j, "Worker.RunMap", 0, "input-0")
+	recordTestOperation(t, j, "Worker.RunReduce", 1, "reduce-1")
+	j.close()
+
+	// A crash in the middle of an entry leaves part of it in the journal
+	file, err := os.OpenFile(journalPath(task), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"Event":"operation-do`)
+	file.Close()
+
+	if j, resumed, err = openJournal(task); err != nil {
+		t.Fatal(err)
+	}
+	if !resumed {
+		t.Fatal("didn't resume the job")
+	}
+	if path := j.completedOperations["Worker.RunMap"][0]; path != "input-0" {
+		t.Errorf("map 0 was completed for %q, want input-0", path)
+	}
+	if path := j.completedOperations["Worker.RunReduce"][1]; path != "reduce-1" {
+		t.Errorf("reduce 1 was completed for %q, want reduce-1", path)
+	}
+
+	// The partial entry is dropped, so the new ones can be read back
+	recordTestOperation(t, j, "Worker.RunReduce", 2, "reduce-2")
+	j.close()
+
+	entries, _ := loadJournal(journalPath(task))
+	if len(entries) != 4 || entries[3].Event != JOURNAL_OPERATION_DONE || entries[3].Id != 2 {
+		t.Errorf("journal entries = %v", entries)
+	}
+}
+
+func TestJournalNotResumed(t *testing.T) {
+	task := journalTestTask(t)
+
+	j, _, err := openJournal(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordTestOperation(t, j, "Worker.RunMap", 0, "input-0")
+	j.close()
+
+	// A different number of reduce jobs starts the job again
+	task.NumReduceJobs = 4
+	if j, resumed, err := openJournal(task); err != nil || resumed {
+		t.Fatalf("openJournal = %v, %v; want a new journal", resumed, err)
+	} else {
+		j.jobDone()
+		j.close()
+	}
+
+	// So does a job that was finished
+	if j, resumed, err := openJournal(task); err != nil || resumed || len(j.completedOperations) != 0 {
+		t.Fatalf("openJournal = %v, %v; want a new journal", resumed, err)
+	} else {
+		j.close()
+	}
+}
+
+// A completed stage of a pipeline is resumed with its result as long as its result
+// files are there, until the job is over.
+func TestJournalStageDone(t *testing.T) {
+	task := journalTestTask(t)
+	task.OutputDir = t.TempDir()
+	if err := createWorkDirs(task); err != nil {
+		t.Fatal(err)
+	}
+
+	j, _, err := openJournal(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = j.stageDone(&Result{NumMapOperations: 4, NumReduceOperations: 3}); err != nil {
+		t.Fatal(err)
+	}
+	j.close()
+
+	for r := 0; r < task.NumReduceJobs; r++ {
+		if err = os.WriteFile(resultFileName(task, r), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	j, resumed, err := openJournal(task)
+	if err != nil || !resumed {
+		t.Fatalf("openJournal = %v, %v; want the journal of the stage", resumed, err)
+	}
+	result, ok := j.stageResult(task)
+	if !ok || result.NumMapOperations != 4 || result.NumReduceOperations != 3 {
+		t.Errorf("stageResult = %+v, %v; want 4 map and 3 reduce operations", result, ok)
+	}
+
+	// The stage runs again if its result is gone
+	os.Remove(resultFileName(task, 1))
+	if _, ok = j.stageResult(task); ok {
+		t.Error("stage without its result files was completed")
+	}
+	j.close()
+
+	if err = finishJournal(task); err != nil {
+		t.Fatal(err)
+	}
+	if j, resumed, err = openJournal(task); err != nil || resumed {
+		t.Fatalf("openJournal = %v, %v; want a new journal once the job is over", resumed, err)
+	}
+	if _, ok = j.stageResult(task); ok {
+		t.Error("stage of a finished job was completed")
+	}
+	j.close()
+}
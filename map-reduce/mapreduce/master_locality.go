@@ -0,0 +1,227 @@
+package mapreduce
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_LOCALITY_WAIT = time.Second
+)
+
+// operationQueue holds the operations of a phase that are waiting for a worker, and
+// the free slots of workers that none of them should run on yet. An operation runs on
+// a worker that holds its data if there's one, and on any worker once it waited for
+// the locality wait. Operations whose data no worker holds run on any worker.
+type operationQueue struct {
+	master  *Master
+	wait    time.Duration
+	wg      *sync.WaitGroup
+	pending []*Operation
+	idle    []*RemoteWorker
+}
+
+// Returns how long an operation waits for a free slot on a worker that holds its data.
+func localityWait(task *Task) time.Duration {
+	if task.LocalityWait <= 0 {
+		return DEFAULT_LOCALITY_WAIT
+	}
+	return task.LocalityWait
+}
+
+// Add an operation that is waiting for a worker.
+func (queue *operationQueue) add(operation *Operation) {
+	queue.master.workersMutex.Lock()
+	operation.queued = time.Now()
+	queue.master.workersMutex.Unlock()
+
+	queue.pending = append(queue.pending, operation)
+}
+
+// Add a free slot of worker, taken from idleWorkerChan.
+func (queue *operationQueue) addWorker(worker *RemoteWorker) {
+	queue.idle = append(queue.idle, worker)
+}
+
+// Returns whether there are operations waiting for a worker.
+func (queue *operationQueue) waiting() bool {
+	return len(queue.pending) > 0
+}
+
+// match starts pending operations on the free slots. It returns a channel that
+// receives once a pending operation stops waiting for the workers that hold its data,
+// or nil if no free slot is waiting for that. Free slots are given back to
+// idleWorkerChan once there are no pending operations.
+func (queue *operationQueue) match() <-chan time.Time {
+	var (
+		master *Master = queue.master
+		now    time.Time
+		next   time.Time
+		idle   []*RemoteWorker
+	)
+
+	master.workersMutex.Lock()
+
+	// Operations are completed by a backup while they wait to be retried
+	pending := queue.pending[:0]
+	for _, operation := range queue.pending {
+		if operation.status != OPERATION_COMPLETED {
+			pending = append(pending, operation)
+			master.operationHolders(operation)
+		}
+	}
+	queue.pending = pending
+
+	now = time.Now()
+	for _, worker := range queue.idle {
+		if !worker.available() {
+			log.Printf("Discarding removed or draining worker %v from idle workers.\n", worker.id)
+			continue
+		}
+
+		i := queue.pick(worker, now)
+		if i < 0 {
+			idle = append(idle, worker)
+			continue
+		}
+
+		operation := queue.pending[i]
+		queue.pending = append(queue.pending[:i], queue.pending[i+1:]...)
+
+		master.assignOperation(worker, operation)
+		go master.runOperation(worker, operation, queue.wg)
+	}
+	queue.idle = idle
+
+	if len(queue.idle) > 0 {
+		for _, operation := range queue.pending {
+			expiry := operation.queued.Add(queue.wait)
+			if next.IsZero() || expiry.Before(next) {
+				next = expiry
+			}
+		}
+	}
+
+	master.workersMutex.Unlock()
+
+	if len(queue.pending) == 0 {
+		queue.close()
+	}
+
+	if next.IsZero() {
+		return nil
+	}
+	return time.After(time.Until(next))
+}
+
+// Returns the index of the pending operation that should run on worker, or -1 if none
+// should yet: the first one whose data it holds, or else the first one that isn't
+// waiting for the workers that hold its data. Should be called with workersMutex held,
+// once the holders of the pending operations were found.
+func (queue *operationQueue) pick(worker *RemoteWorker, now time.Time) int {
+	for i, operation := range queue.pending {
+		if operation.holders[worker.id] {
+			return i
+		}
+	}
+
+	for i, operation := range queue.pending {
+		if len(operation.holders) == 0 || now.Sub(operation.queued) >= queue.wait {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Give the free slots back to idleWorkerChan.
+func (queue *operationQueue) close() {
+	for _, worker := range queue.idle {
+		queue.master.releaseWorker(worker)
+	}
+	queue.idle = nil
+}
+
+// operationHolders returns the workers that hold the data of operation. They're only
+// found again once workers register or are removed, or with LocalStorage once a map
+// operation is completed. Should be called with workersMutex held.
+func (master *Master) operationHolders(operation *Operation) map[int]bool {
+	if operation.holders == nil || operation.changes != master.numChanges {
+		operation.holders = master.dataHolders(operation)
+		operation.changes = master.numChanges
+	}
+	return operation.holders
+}
+
+// dataHolders returns the ids of the registered workers that hold the data of
+// operation: the input file of a map operation, or with LocalStorage the largest share
+// of the partition of a reduce operation. Should be called with workersMutex held.
+func (master *Master) dataHolders(operation *Operation) map[int]bool {
+	var (
+		holders map[int]bool = make(map[int]bool)
+		sizes   map[int]int64
+		largest int64
+	)
+
+	if operation.proc == "Worker.RunMap" {
+		for _, worker := range master.workers {
+			if worker.inputs[operation.split.Path] {
+				holders[worker.id] = true
+			}
+		}
+		return holders
+	}
+
+	if !master.task.LocalStorage {
+		return holders
+	}
+
+	sizes = make(map[int]int64)
+	for _, mapOperation := range master.mapOperations {
+		output := mapOperation.output
+
+		if mapOperation.status != OPERATION_COMPLETED || output == nil || output.status == WORKER_DEAD ||
+			operation.id >= len(mapOperation.partitionSizes) {
+			continue
+		}
+
+		sizes[output.id] += mapOperation.partitionSizes[operation.id]
+		if sizes[output.id] > largest {
+			largest = sizes[output.id]
+		}
+	}
+
+	for id, size := range sizes {
+		if largest > 0 && size == largest {
+			holders[id] = true
+		}
+	}
+	return holders
+}
+
+// Count an attempt of operation on worker in the locality counters, if some worker
+// holds its data. Should be called with workersMutex held.
+func (master *Master) countLocality(operation *Operation, worker *RemoteWorker) {
+	var (
+		holders map[int]bool = master.operationHolders(operation)
+		name    string
+	)
+
+	if len(holders) == 0 {
+		return
+	}
+
+	switch {
+	case operation.proc == "Worker.RunMap" && holders[worker.id]:
+		name = DATA_LOCAL_MAPS
+	case operation.proc == "Worker.RunMap":
+		name = NON_LOCAL_MAPS
+	case holders[worker.id]:
+		name = DATA_LOCAL_REDUCES
+	default:
+		name = NON_LOCAL_REDUCES
+	}
+
+	master.stats.counters.Add(name, 1)
+}
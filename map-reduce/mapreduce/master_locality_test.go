@@ -0,0 +1,105 @@
+package mapreduce
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Returns a registered worker holding the input files paths.
+func addTestHolder(master *Master, id int, paths ...string) *RemoteWorker {
+	worker := newRemoteWorker(id, fmt.Sprintf("worker-%v", id), 1)
+	worker.inputs = make(map[string]bool)
+	for _, path := range paths {
+		worker.inputs[path] = true
+	}
+	master.workers[id] = worker
+	master.numChanges++
+	return worker
+}
+
+func TestDataHolders(t *testing.T) {
+	master := newTestSchedulerMaster(t, &Task{JobId: "job", LocalStorage: true})
+	first := addTestHolder(master, 0, "a", "b")
+	second := addTestHolder(master, 1, "b")
+
+	for path, want := range map[string]string{"a": "map[0:true]", "b": "map[0:true 1:true]", "c": "map[]"} {
+		holders := master.dataHolders(newOperation("Worker.RunMap", 0, 0, InputSplit{Path: path}))
+		if fmt.Sprint(holders) != want {
+			t.Errorf("holders of %v = %v, want %v", path, holders, want)
+		}
+	}
+
+	// Reduce operations are held by the worker with most of their partition
+	for i, sizes := range [][]int64{{10, 1}, {5, 1}, {6, 3}} {
+		operation := newOperation("Worker.RunMap", 0, i, InputSplit{Path: "a"})
+		operation.status = OPERATION_COMPLETED
+		operation.output = first
+		if i == 2 {
+			operation.output = second
+		}
+		operation.partitionSizes = sizes
+		master.mapOperations = append(master.mapOperations, operation)
+	}
+
+	for id, want := range []string{"map[0:true]", "map[1:true]"} {
+		holders := master.dataHolders(newOperation("Worker.RunReduce", 0, id, InputSplit{Path: "reduce"}))
+		if fmt.Sprint(holders) != want {
+			t.Errorf("holders of reduce %v = %v, want %v", id, holders, want)
+		}
+	}
+
+	// Outputs of failed workers aren't held anymore
+	second.status = WORKER_DEAD
+	if holders := master.dataHolders(newOperation("Worker.RunReduce", 0, 1, InputSplit{Path: "reduce"})); fmt.Sprint(holders) != "map[0:true]" {
+		t.Errorf("holders of reduce 1 = %v once worker 1 failed, want map[0:true]", holders)
+	}
+}
+
+// Free slots run the operations whose data they hold first, and the others once they
+// waited for the locality wait or if no worker holds their data.
+func TestOperationQueuePick(t *testing.T) {
+	master := newTestSchedulerMaster(t, &Task{JobId: "job"})
+	holder := addTestHolder(master, 0, "a")
+	other := addTestHolder(master, 1)
+
+	queue := &operationQueue{master: master, wait: time.Minute}
+	held := newOperation("Worker.RunMap", 0, 0, InputSplit{Path: "a"})
+	queue.add(held)
+
+	now := time.Now()
+	master.operationHolders(held)
+
+	if i := queue.pick(other, now); i != -1 {
+		t.Errorf("other worker picked %v before the locality wait", i)
+	}
+	if i := queue.pick(other, now.Add(time.Minute)); i != 0 {
+		t.Errorf("other worker picked %v after the locality wait, want 0", i)
+	}
+
+	anywhere := newOperation("Worker.RunMap", 0, 1, InputSplit{Path: "b"})
+	queue.add(anywhere)
+	master.operationHolders(anywhere)
+
+	if i := queue.pick(other, now); i != 1 {
+		t.Errorf("other worker picked %v, want the operation nobody holds", i)
+	}
+	if i := queue.pick(holder, now); i != 0 {
+		t.Errorf("holder picked %v, want the operation it holds", i)
+	}
+}
+
+func TestCountLocality(t *testing.T) {
+	master := newTestSchedulerMaster(t, &Task{JobId: "job"})
+	holder := addTestHolder(master, 0, "a")
+	other := addTestHolder(master, 1)
+
+	master.countLocality(newOperation("Worker.RunMap", 0, 0, InputSplit{Path: "a"}), holder)
+	master.countLocality(newOperation("Worker.RunMap", 0, 1, InputSplit{Path: "a"}), other)
+	master.countLocality(newOperation("Worker.RunMap", 0, 2, InputSplit{Path: "b"}), other)
+
+	counters := master.stats.counters.Values()
+	if counters[DATA_LOCAL_MAPS] != 1 || counters[NON_LOCAL_MAPS] != 1 || len(counters) != 2 {
+		t.Errorf("counters %v, want one data-local and one non-local map", counters)
+	}
+}
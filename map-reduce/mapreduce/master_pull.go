@@ -0,0 +1,172 @@
+package mapreduce
+
+import (
+	"fmt"
+	"log"
+	"net/rpc"
+	"time"
+)
+
+const (
+	// How long RequestTask waits for an operation before telling the worker to ask again
+	PULL_WAIT = time.Second
+)
+
+// assignment is an operation handed to a worker that pulls its operations. It's
+// completed when the worker it was handed to reports it with its id.
+type assignment struct {
+	id     int
+	worker int
+	kind   TaskKind
+	args   *RunArgs
+	reply  *RunReply
+	done   chan error
+}
+
+// handOut gives an operation to a worker that pulls its operations and waits until the
+// worker reports it. Like with a call to a worker that accepts connections, errors
+// returned by the operation are rpc.ServerErrors, and other errors mean that the worker
+// failed.
+func (master *Master) handOut(worker *RemoteWorker, proc string, args *RunArgs, reply *RunReply) error {
+	var (
+		timeout <-chan time.Time
+		task    *assignment = &assignment{worker: worker.id, kind: TASK_REDUCE, args: args, reply: reply, done: make(chan error, 1)}
+	)
+
+	if proc == "Worker.RunMap" {
+		task.kind = TASK_MAP
+	}
+
+	master.workersMutex.Lock()
+	task.id = master.totalAssignments
+	master.totalAssignments++
+	master.assignments[task.id] = task
+	master.workersMutex.Unlock()
+
+	defer func() {
+		master.workersMutex.Lock()
+		delete(master.assignments, task.id)
+		master.workersMutex.Unlock()
+	}()
+
+	// There's room for an assignment in each slot of the worker
+	worker.assignments <- task
+
+	// Workers that don't finish an operation before the deadline are considered failed
+	if master.task.OperationTimeout > 0 {
+		timer := time.NewTimer(master.task.OperationTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case err := <-task.done:
+		return err
+	case <-worker.removed:
+		return fmt.Errorf("worker %v was removed", worker.id)
+	case <-timeout:
+		return fmt.Errorf("%v timed out after %v", proc, master.task.OperationTimeout)
+	}
+}
+
+// Returns the registered worker that pulls its operations with id. Updates its last
+// heartbeat, since it just called Master.
+func (master *Master) pullingWorker(id int) (*RemoteWorker, error) {
+	master.workersMutex.Lock()
+	defer master.workersMutex.Unlock()
+
+	worker, ok := master.workers[id]
+	if !ok || worker.assignments == nil {
+		return nil, fmt.Errorf("unknown worker %v", id)
+	}
+
+	worker.lastHeartbeat = time.Now()
+	return worker, nil
+}
+
+// RPC - RequestTask
+// Called by workers that pull their operations when they have a free slot. Returns an
+// operation to run, or tells the worker to wait or to exit once the job is over.
+func (master *Master) RequestTask(args *RequestTaskArgs, reply *RequestTaskReply) error {
+	worker, err := master.pullingWorker(args.WorkerId)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-master.over:
+		master.exitWorker(worker, reply)
+		return nil
+	default:
+	}
+
+	select {
+	case task := <-worker.assignments:
+		reply.Kind = task.kind
+		reply.TaskId = task.id
+		reply.Args = *task.args
+	case <-master.over:
+		master.exitWorker(worker, reply)
+	case <-worker.removed:
+		return fmt.Errorf("unknown worker %v", args.WorkerId)
+	case <-time.After(PULL_WAIT):
+		reply.Kind = TASK_WAIT
+	}
+
+	return nil
+}
+
+// Tell a worker that pulls its operations that the job is over.
+func (master *Master) exitWorker(worker *RemoteWorker, reply *RequestTaskReply) {
+	master.workersMutex.Lock()
+	reply.Kind = TASK_EXIT
+	reply.JobCompleted = master.completed
+
+	select {
+	case <-worker.exited:
+	default:
+		close(worker.exited)
+	}
+	master.workersMutex.Unlock()
+}
+
+// RPC - ReportTask
+// Called by workers that pull their operations once an operation is done. Reports of
+// assignments that were given up on are ignored, and reports of assignments handed to
+// another worker are rejected.
+func (master *Master) ReportTask(args *ReportTaskArgs, _ *struct{}) error {
+	if _, err := master.pullingWorker(args.WorkerId); err != nil {
+		return err
+	}
+
+	master.workersMutex.Lock()
+	task, ok := master.assignments[args.TaskId]
+	if ok && task.worker != args.WorkerId {
+		master.workersMutex.Unlock()
+		return fmt.Errorf("task %v wasn't handed to worker %v", args.TaskId, args.WorkerId)
+	}
+	delete(master.assignments, args.TaskId)
+	master.workersMutex.Unlock()
+
+	if !ok {
+		log.Printf("Ignoring report of task %v from worker %v\n", args.TaskId, args.WorkerId)
+		return nil
+	}
+
+	*task.reply = args.Reply
+
+	if args.Error != "" {
+		task.done <- rpc.ServerError(args.Error)
+	} else {
+		task.done <- nil
+	}
+	return nil
+}
+
+// RPC - Heartbeat
+// Called periodically by workers that pull their operations, since Master can't ping
+// them.
+func (master *Master) Heartbeat(args *HeartbeatArgs, _ *struct{}) error {
+	_, err := master.pullingWorker(args.WorkerId)
+	return err
+}
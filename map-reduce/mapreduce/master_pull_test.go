@@ -0,0 +1,84 @@
+package mapreduce
+
+import (
+	"errors"
+	"net/rpc"
+	"testing"
+)
+
+// A report from a worker that the assignment wasn't handed to doesn't complete it.
+func TestReportTaskOtherWorker(t *testing.T) {
+	master := &Master{workers: make(map[int]*RemoteWorker), assignments: make(map[int]*assignment)}
+	master.workers[0] = newPullingWorker(0, "first", 1)
+	master.workers[1] = newPullingWorker(1, "second", 1)
+
+	reply := new(RunReply)
+	task := &assignment{id: 7, worker: 0, kind: TASK_MAP, args: new(RunArgs), reply: reply, done: make(chan error, 1)}
+	master.assignments[task.id] = task
+
+	if err := master.ReportTask(&ReportTaskArgs{WorkerId: 1, TaskId: 7, Error: "failed"}, nil); err == nil {
+		t.Error("accepted a report from another worker")
+	}
+	select {
+	case err := <-task.done:
+		t.Fatalf("assignment completed by another worker with %v", err)
+	default:
+	}
+
+	if err := master.ReportTask(&ReportTaskArgs{WorkerId: 0, TaskId: 7}, nil); err != nil {
+		t.Fatalf("rejected the report of the worker holding the assignment: %v", err)
+	}
+	if err := <-task.done; err != nil {
+		t.Errorf("assignment completed with %v", err)
+	}
+	if _, ok := master.assignments[7]; ok {
+		t.Error("assignment still pending after its report")
+	}
+}
+
+// Workers that pull their operations get the ones handed to them, wait when there's
+// none, and exit once the job is over. Errors they report are returned by handOut like
+// the ones of a call to a worker.
+func TestRequestTask(t *testing.T) {
+	master := newTestSchedulerMaster(t, &Task{JobId: "job", Scheduler: SCHEDULER_PULL})
+	worker := newPullingWorker(0, "worker", 1)
+	master.workers[worker.id] = worker
+
+	handedOut := make(chan error, 1)
+	go func() {
+		handedOut <- master.handOut(worker, "Worker.RunReduce", &RunArgs{JobId: "job", Id: 4}, new(RunReply))
+	}()
+
+	reply := new(RequestTaskReply)
+	if err := master.RequestTask(&RequestTaskArgs{JobId: "job", WorkerId: worker.id}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Kind != TASK_REDUCE || reply.Args.Id != 4 {
+		t.Fatalf("got %v %v, want reduce 4", reply.Kind, reply.Args.Id)
+	}
+
+	if err := master.ReportTask(&ReportTaskArgs{JobId: "job", WorkerId: worker.id, TaskId: reply.TaskId, Error: "reduce failed"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var serverErr rpc.ServerError
+	if err := <-handedOut; !errors.As(err, &serverErr) || string(serverErr) != "reduce failed" {
+		t.Errorf("handOut returned %v, want the reported error", err)
+	}
+
+	reply = new(RequestTaskReply)
+	if err := master.RequestTask(&RequestTaskArgs{JobId: "job", WorkerId: worker.id}, reply); err != nil || reply.Kind != TASK_WAIT {
+		t.Errorf("got %v, %v without operations, want %v", reply.Kind, err, TASK_WAIT)
+	}
+
+	master.completed = true
+	close(master.over)
+
+	reply = new(RequestTaskReply)
+	if err := master.RequestTask(&RequestTaskArgs{JobId: "job", WorkerId: worker.id}, reply); err != nil || reply.Kind != TASK_EXIT || !reply.JobCompleted {
+		t.Errorf("got %v (completed %v), %v once the job is over, want %v", reply.Kind, reply.JobCompleted, err, TASK_EXIT)
+	}
+
+	if err := master.RequestTask(&RequestTaskArgs{JobId: "job", WorkerId: 7}, new(RequestTaskReply)); err == nil {
+		t.Error("unknown worker got an operation")
+	}
+}
@@ -9,14 +9,79 @@ import (
 type workerStatus string
 
 const (
-	WORKER_IDLE    workerStatus = "idle"
-	WORKER_RUNNING workerStatus = "running"
+	WORKER_IDLE     workerStatus = "idle"
+	WORKER_RUNNING  workerStatus = "running"
+	WORKER_DRAINING workerStatus = "draining" // Leaving, no more operations are scheduled on it
+	WORKER_DEAD     workerStatus = "dead"     // Removed, because it failed or was decommissioned
 )
 
+// RemoteWorker is a worker registered with Master. It's idle when none of its slots
+// are running an operation.
 type RemoteWorker struct {
 	id       int
 	hostname string
 	status   workerStatus
+	slots    int // Number of operations the worker runs at once
+
+	operations    []*Operation // Operations currently running on the worker
+	lastHeartbeat time.Time
+
+	inputs map[string]bool // Input files the worker holds locally
+
+	// Set for workers that pull their operations: the assignments waiting to be
+	// pulled, closed once the worker is removed, and closed once it was told to exit
+	assignments chan *assignment
+	removed     chan struct{}
+	exited      chan struct{}
+}
+
+// Construct a new RemoteWorker
+func newRemoteWorker(id int, hostname string, slots int) (worker *RemoteWorker) {
+	worker = new(RemoteWorker)
+	worker.id = id
+	worker.hostname = hostname
+	worker.status = WORKER_IDLE
+	worker.slots = slots
+	worker.lastHeartbeat = time.Now()
+	return
+}
+
+// Construct a new RemoteWorker that pulls its operations
+func newPullingWorker(id int, hostname string, slots int) (worker *RemoteWorker) {
+	worker = newRemoteWorker(id, hostname, slots)
+	worker.assignments = make(chan *assignment, slots)
+	worker.removed = make(chan struct{})
+	worker.exited = make(chan struct{})
+	return
+}
+
+// Run operation in one of the slots of the worker. Should be called with workersMutex
+// held.
+func (worker *RemoteWorker) addOperation(operation *Operation) {
+	worker.operations = append(worker.operations, operation)
+	if worker.status == WORKER_IDLE {
+		worker.status = WORKER_RUNNING
+	}
+}
+
+// Free the slot running operation. Should be called with workersMutex held.
+func (worker *RemoteWorker) removeOperation(operation *Operation) {
+	for i, running := range worker.operations {
+		if running == operation {
+			worker.operations = append(worker.operations[:i:i], worker.operations[i+1:]...)
+			break
+		}
+	}
+
+	if len(worker.operations) == 0 && worker.status == WORKER_RUNNING {
+		worker.status = WORKER_IDLE
+	}
+}
+
+// Returns whether operations can be scheduled on the worker. Should be called with
+// workersMutex held.
+func (worker *RemoteWorker) available() bool {
+	return worker.status == WORKER_IDLE || worker.status == WORKER_RUNNING
 }
 
 // Call a RemoteWork with the procedure specified in parameters. It will also handle connecting
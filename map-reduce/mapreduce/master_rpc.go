@@ -1,27 +1,126 @@
 package mapreduce
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
 )
 
 // RPC - Register
-// Procedure that will be called by workers to register within this master.
+// Procedure that will be called by workers to register within this master. Workers
+// with another scheduler aren't registered, they only get the scheduler of Master. Pool
+// workers that didn't register the task of every stage get an error.
 func (master *Master) Register(args *RegisterArgs, reply *RegisterReply) error {
 	var (
 		newWorker *RemoteWorker
+		slots     int       = workerSlots(args.Slots)
+		scheduler Scheduler = taskScheduler(master.task)
 	)
-	log.Printf("Registering worker '%v' with hostname '%v'", master.totalWorkers, args.WorkerHostname)
+
+	if args.Scheduler != scheduler {
+		log.Printf("Rejecting worker with hostname '%v' (Scheduler: %v)", args.WorkerHostname, args.Scheduler)
+		*reply = RegisterReply{Scheduler: scheduler}
+		return nil
+	}
+
+	if args.Pool {
+		if err := checkPoolTasks(master.stages, args.Tasks); err != nil {
+			log.Printf("Rejecting pool worker with hostname '%v'. Error: %v", args.WorkerHostname, err)
+			return err
+		}
+	}
 
 	master.workersMutex.Lock()
 
-	newWorker = &RemoteWorker{master.totalWorkers, args.WorkerHostname, WORKER_IDLE}
+	if scheduler == SCHEDULER_PULL {
+		newWorker = newPullingWorker(master.totalWorkers, args.WorkerHostname, slots)
+	} else {
+		newWorker = newRemoteWorker(master.totalWorkers, args.WorkerHostname, slots)
+	}
 	master.workers[newWorker.id] = newWorker
+	master.numChanges++
 	master.totalWorkers++
 
+	newWorker.inputs = make(map[string]bool, len(args.LocalInputs))
+	for _, path := range args.LocalInputs {
+		newWorker.inputs[path] = true
+	}
+
 	master.workersMutex.Unlock()
 
-	master.idleWorkerChan <- newWorker
+	log.Printf("Registering worker '%v' with hostname '%v' (Slots: %v, Local inputs: %v)", newWorker.id, args.WorkerHostname, slots, len(args.LocalInputs))
+
+	for i := 0; i < slots; i++ {
+		master.idleWorkerChan <- newWorker
+	}
 
-	*reply = RegisterReply{newWorker.id, master.task.NumReduceJobs}
+	*reply = RegisterReply{
+		WorkerId:          newWorker.id,
+		HeartbeatTimeout:  heartbeatTimeout(master.task),
+		LocalStorage:      master.task.LocalStorage,
+		Stages:            make([]StageSettings, 0, len(master.stages)),
+		Scheduler:         scheduler,
+		HeartbeatInterval: heartbeatInterval(master.task),
+	}
+	for _, task := range master.stages {
+		reply.Stages = append(reply.Stages, StageSettings{
+			Name:           task.Name,
+			Params:         task.Params,
+			ReduceJobs:     task.NumReduceJobs,
+			Codec:          recordCodec(task).Name(),
+			Compression:    taskCompression(task),
+			SplitInput:     task.Input != nil,
+			JobId:          task.JobId,
+			ScratchDir:     task.ScratchDir,
+			OutputDir:      task.OutputDir,
+			CleanupScratch: task.CleanupScratch,
+		})
+	}
 	return nil
 }
+
+// RPC - FetchInput
+// Called by workers that don't share a filesystem with Master to read the input file
+// of a map operation, or a byte range of it.
+func (master *Master) FetchInput(args *FetchInputArgs, reply *FetchReply) error {
+	var err error
+
+	if !master.isInputFile(args.FilePath) {
+		return fmt.Errorf("'%v' is not an input file", args.FilePath)
+	}
+
+	if args.Length == 0 {
+		reply.Data, err = ioutil.ReadFile(args.FilePath)
+		return err
+	}
+
+	reply.Data, err = readChunk(args.FilePath, args.Offset, args.Length)
+	return err
+}
+
+// Returns an error if a stage of the job doesn't have one of the registered tasks of a
+// pool worker.
+func checkPoolTasks(stages []*Task, registered []string) error {
+	names := make(map[string]bool, len(registered))
+	for _, name := range registered {
+		names[name] = true
+	}
+
+	for i, task := range stages {
+		if !names[task.Name] {
+			return fmt.Errorf("stage %v has task '%v', which the worker didn't register", i, task.Name)
+		}
+	}
+	return nil
+}
+
+// Returns the number of operations a worker that asked for slots can run at once.
+func workerSlots(slots int) int {
+	if slots <= 0 {
+		return 1
+	}
+	if slots > MAX_WORKER_SLOTS {
+		return MAX_WORKER_SLOTS
+	}
+	return slots
+}
@@ -0,0 +1,63 @@
+package mapreduce
+
+import (
+	"testing"
+)
+
+func TestWorkerSlots(t *testing.T) {
+	tests := map[int]int{-1: 1, 0: 1, 1: 1, 3: 3, MAX_WORKER_SLOTS: MAX_WORKER_SLOTS, MAX_WORKER_SLOTS + 1: MAX_WORKER_SLOTS}
+
+	for slots, want := range tests {
+		if got := workerSlots(slots); got != want {
+			t.Errorf("workerSlots(%v) = %v, want %v", slots, got, want)
+		}
+	}
+}
+
+// A registered worker is idle once for each of its slots, and stays running until none
+// of them runs an operation.
+func TestRegisterSlots(t *testing.T) {
+	master := newTestSchedulerMaster(t, &Task{JobId: "job", NumReduceJobs: 2})
+
+	reply := new(RegisterReply)
+	if err := master.Register(&RegisterArgs{WorkerHostname: "worker", Slots: 3, Scheduler: SCHEDULER_PUSH}, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	worker := master.workers[reply.WorkerId]
+	if worker == nil || worker.slots != 3 || len(master.idleWorkerChan) != 3 {
+		t.Fatalf("registered %+v with %v idle slots, want 3", worker, len(master.idleWorkerChan))
+	}
+	if len(reply.Stages) != 1 || reply.Stages[0].JobId != "job" || reply.Stages[0].ReduceJobs != 2 {
+		t.Errorf("stage settings %+v", reply.Stages)
+	}
+
+	first := newOperation("Worker.RunMap", 0, 0, InputSplit{Path: "a"})
+	second := newOperation("Worker.RunMap", 0, 1, InputSplit{Path: "b"})
+	worker.addOperation(first)
+	worker.addOperation(second)
+
+	worker.removeOperation(first)
+	if worker.status != WORKER_RUNNING || len(worker.operations) != 1 {
+		t.Errorf("worker %v with %v operations, want running with 1", worker.status, len(worker.operations))
+	}
+
+	worker.removeOperation(second)
+	if worker.status != WORKER_IDLE || len(worker.operations) != 0 {
+		t.Errorf("worker %v with %v operations, want idle with none", worker.status, len(worker.operations))
+	}
+}
+
+// Workers with another scheduler only get the scheduler of Master.
+func TestRegisterOtherScheduler(t *testing.T) {
+	master := newTestSchedulerMaster(t, &Task{JobId: "job", Scheduler: SCHEDULER_PULL})
+
+	reply := new(RegisterReply)
+	if err := master.Register(&RegisterArgs{WorkerHostname: "worker", Scheduler: SCHEDULER_PUSH}, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply.Scheduler != SCHEDULER_PULL || len(master.workers) != 0 || len(master.idleWorkerChan) != 0 {
+		t.Errorf("reply with scheduler %v, %v workers registered", reply.Scheduler, len(master.workers))
+	}
+}
@@ -1,76 +1,447 @@
 package mapreduce
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net/rpc"
 	"sync"
+	"time"
 )
 
-// Schedules map operations on remote workers. This will run until InputFilePathChan
-// is closed. If there is no worker available, it'll block.
-func (master *Master) schedule(task *Task, proc string, filePathChan chan string) int {
+const (
+	DEFAULT_SPECULATIVE_DELAY = 5 * time.Second
+	DEFAULT_MAX_ATTEMPTS      = 4
+)
+
+// runStage runs the map and then the reduce phase of a stage of the job, and merges
+// the result of the last stage into a single file. A stage that a previous Master
+// completed keeps its result and isn't run again.
+func (master *Master) runStage(stage int, splitChan chan InputSplit) (result *Result, err error) {
 	var (
+		task               *Task = master.stages[stage]
+		last               bool  = stage == len(master.stages)-1
+		stageJournal       *journal
+		reduceFilePathChan chan InputSplit
+		mapOperations      int
+		reduceOperations   int
+		ok                 bool
+	)
+
+	// Create the directories to store intemediate and result files. If a previous Master
+	// didn't finish the stage, it's resumed from the journal and the files are kept.
+	if err = createWorkDirs(task); err != nil {
+		return nil, err
+	}
+
+	if stageJournal, _, err = openJournal(task); err != nil {
+		return nil, err
+	}
+	defer stageJournal.close()
+
+	if result, ok = stageJournal.stageResult(task); ok {
+		log.Printf("Skipping stage %v, completed before restart\n", stage)
+		for range splitChan {
+		}
+		return result, nil
+	}
+
+	master.workersMutex.Lock()
+	master.journal = stageJournal
+	master.workersMutex.Unlock()
+
+	// Schedule map operations
+	if mapOperations, err = master.schedule(stage, "Worker.RunMap", splitChan); err != nil {
+		return nil, err
+	}
+
+	// Reduce operations merge their partition of every map output, Master only keeps
+	// track of where they are
+	master.workersMutex.Lock()
+	master.mapOperations = master.operations
+	master.workersMutex.Unlock()
+
+	// Schedule reduce operations
+	reduceFilePathChan = wholeFileSplits(fanReduceFilePath(task, task.NumReduceJobs))
+	if reduceOperations, err = master.schedule(stage, "Worker.RunReduce", reduceFilePathChan); err != nil {
+		return nil, err
+	}
+
+	result = &Result{NumMapOperations: mapOperations, NumReduceOperations: reduceOperations}
+
+	if !last {
+		if err = stageJournal.stageDone(result); err != nil {
+			return nil, err
+		}
+		cleanupStageScratch(task)
+		return result, nil
+	}
+
+	if err = writeResultOutput(task, reduceOperations); err != nil {
+		return nil, err
+	}
+
+	if err = stageJournal.jobDone(); err != nil {
+		return nil, err
+	}
+
+	// The journals of the earlier stages were kept until the job was over
+	for _, earlier := range master.stages {
+		if earlier != task {
+			if err = finishJournal(earlier); err != nil {
+				return nil, err
+			}
+		}
+		cleanupScratch(earlier)
+	}
+
+	return result, nil
+}
+
+// Schedules the operations of a stage on remote workers, one for each input split.
+// This will run until splitChan is closed and all the operations are completed. Operations wait in a queue for
+// a free slot on a worker, preferably one that holds their data. Operations that fail are scheduled again.
+// Once all the operations were started, backups of the slow ones are launched on
+// idle workers if task.SpeculativeThreshold is set.
+// Returns early with an error if the job fails or is cancelled.
+func (master *Master) schedule(stage int, proc string, splitChan chan InputSplit) (int, error) {
+	var (
+		task      *Task = master.stages[stage]
 		wg        sync.WaitGroup
-		filePath  string
-		worker    *RemoteWorker
+		split     InputSplit
+		ok        bool
 		operation *Operation
+		worker    *RemoteWorker
 		counter   int
+		done      chan struct{}
+		ticker    *time.Ticker
+		queue     *operationQueue
+		idle      chan *RemoteWorker
+		wake      <-chan time.Time
 	)
 
 	log.Printf("Scheduling %v operations\n", proc)
 
-	master.failedOperationChan = make(chan *Operation, RETRY_OPERATION_BUFFER)
+	master.workersMutex.Lock()
+	master.stage = stage
+	master.phase = operationPhase(proc)
 	master.totalOperations = 0
 	master.numCompletedOperations = 0
+	master.totalReruns = 0
+	master.numCompletedReruns = 0
+	master.operations = make([]*Operation, 0)
+	master.workersMutex.Unlock()
 
+	queue = &operationQueue{master: master, wait: localityWait(task), wg: &wg}
+	defer queue.close()
+
+	ticker = time.NewTicker(speculativeDelay(task) / 2)
+	defer ticker.Stop()
+
+	// wg keeps track of operations that weren't completed yet, done is closed once
+	// they were all queued and completed
 	counter = 0
-	for filePath = range filePathChan {
-		operation = &Operation{proc, counter, filePath}
-		counter++
-		master.totalOperations++
+	for {
+		// Free slots are only taken while operations are waiting for one
+		idle = nil
+		if queue.waiting() {
+			idle = master.idleWorkerChan
+		}
+
+		select {
+		case split, ok = <-splitChan:
+			if !ok {
+				splitChan = nil
+				done = make(chan struct{})
+				go func() {
+					wg.Wait()
+					close(done)
+				}()
+				break
+			}
+
+			operation = newOperation(proc, stage, counter, split)
+			counter++
+
+			master.workersMutex.Lock()
+			master.totalOperations++
+			master.operations = append(master.operations, operation)
+			master.workersMutex.Unlock()
+
+			// Operations completed before the Master restarted aren't run again
+			if master.journal.isOperationDone(task, operation) {
+				log.Printf("Skipping %v (ID: '%v' File: '%v'), completed before restart\n", operation.proc, operation.id, operation.filePath)
+				master.workersMutex.Lock()
+				operation.status = OPERATION_COMPLETED
+				master.numCompletedOperations++
+				master.workersMutex.Unlock()
+				break
+			}
+
+			wg.Add(1)
+			queue.add(operation)
+		case worker = <-idle:
+			queue.addWorker(worker)
+		case operation = <-master.failedOperationChan:
+			queue.add(operation)
+		case <-wake:
+		case <-ticker.C:
+			master.launchBackups(task, &wg)
+		case <-done:
+			log.Printf("%vx %v operations completed\n", counter, proc)
+			return counter, nil
+		case <-master.ctx.Done():
+			return counter, master.failure()
+		}
+
+		wake = queue.match()
+	}
+}
+
+// launchBackups will start a backup copy of every operation that has been running for
+// longer than the speculative delay, as long as the fraction of completed operations
+// reached task.SpeculativeThreshold. Backups only use workers that are already idle, and
+// whichever copy finishes first completes the operation.
+func (master *Master) launchBackups(task *Task, wg *sync.WaitGroup) {
+	var (
+		worker    *RemoteWorker
+		candidate []*Operation
+	)
+
+	if task.SpeculativeThreshold <= 0 {
+		return
+	}
+
+	master.workersMutex.Lock()
+	if float64(master.numCompletedOperations) < task.SpeculativeThreshold*float64(master.totalOperations) {
+		master.workersMutex.Unlock()
+		return
+	}
+
+	for _, operation := range master.operations {
+		if operation.status != OPERATION_COMPLETED && operation.backups == 0 && len(operation.workers) > 0 &&
+			time.Since(operation.startTime) > speculativeDelay(task) {
+			candidate = append(candidate, operation)
+		}
+	}
+	master.workersMutex.Unlock()
+
+	for _, operation := range candidate {
+		if worker = master.tryIdleWorker(); worker == nil {
+			return
+		}
+
+		// Backups run on a worker that isn't running the operation already
+		master.workersMutex.Lock()
+		if operation.status == OPERATION_COMPLETED || !worker.available() || operation.workers[worker.id] != nil {
+			master.workersMutex.Unlock()
+			master.releaseWorker(worker)
+			continue
+		}
+
+		operation.backups++
+		master.assignOperation(worker, operation)
+		master.workersMutex.Unlock()
 
-		worker = <-master.idleWorkerChan
-		wg.Add(1)
-		go master.runOperation(worker, operation, &wg)
+		log.Printf("Launching backup of %v '%v' on worker %v (running for %v)\n", operation.proc, operation.id, worker.id, time.Since(operation.startTime).Round(time.Millisecond))
+		go master.runOperation(worker, operation, wg)
 	}
+}
 
-	wg.Wait()
+// Returns the minimum time an operation should run before a backup is launched.
+func speculativeDelay(task *Task) time.Duration {
+	if task.SpeculativeDelay <= 0 {
+		return DEFAULT_SPECULATIVE_DELAY
+	}
+	return task.SpeculativeDelay
+}
 
-	for operation := range master.failedOperationChan {
-		worker = <-master.idleWorkerChan
-		wg.Add(1)
-		go master.runOperation(worker, operation, &wg)
+// assignOperation runs operation in a slot of the worker. Should be called with
+// workersMutex held.
+func (master *Master) assignOperation(worker *RemoteWorker, operation *Operation) {
+	// Backups don't reset the start time, but retries of failed operations do
+	if len(operation.workers) == 0 {
+		operation.startTime = time.Now()
 	}
 
-	wg.Wait()
+	master.countLocality(operation, worker)
+	worker.addOperation(operation)
+	operation.workers[worker.id] = worker
+}
 
-	log.Printf("%vx %v operations completed\n", counter, proc)
-	return counter
+// releaseWorker puts back in idleWorkerChan the slot of a worker that didn't run anything.
+func (master *Master) releaseWorker(worker *RemoteWorker) {
+	master.idleWorkerChan <- worker
 }
 
 // runOperation start a single operation on a RemoteWorker and wait for it to return or fail.
 func (master *Master) runOperation(remoteWorker *RemoteWorker, operation *Operation, wg *sync.WaitGroup) {
 	var (
-		err  error
-		args *RunArgs
+		err   error
+		args  *RunArgs
+		reply *RunReply
+		lost  []*Operation
 	)
 
+	args = &RunArgs{
+		JobId:    master.task.JobId,
+		Stage:    operation.stage,
+		Id:       operation.id,
+		FilePath: operation.split.Path,
+		Offset:   operation.split.Offset,
+		Length:   operation.split.Length,
+	}
+	reply = new(RunReply)
+
+	// Reduce operations need the output of every map operation
+	if operation.proc == "Worker.RunReduce" {
+		if args.MapOutputs, lost = master.mapOutputs(); len(lost) > 0 {
+			master.deferOperation(remoteWorker, operation, lost, wg)
+			return
+		}
+	}
+
 	log.Printf("Running %v (ID: '%v' File: '%v' Worker: '%v')\n", operation.proc, operation.id, operation.filePath, remoteWorker.id)
 
-	args = &RunArgs{operation.id, operation.filePath}
-	err = remoteWorker.callRemoteWorker(operation.proc, args, new(struct{}))
+	// Workers that don't finish an operation before the deadline are considered failed
+	if remoteWorker.assignments != nil {
+		err = master.handOut(remoteWorker, operation.proc, args, reply)
+	} else if master.task.OperationTimeout > 0 {
+		err = callWithTimeout(remoteWorker.hostname, operation.proc, args, reply, master.task.OperationTimeout)
+	} else {
+		err = remoteWorker.callRemoteWorker(operation.proc, args, reply)
+	}
+
+	if err == nil && len(reply.FetchFailed) > 0 {
+		master.handleFetchFailures(remoteWorker, operation, reply.FetchFailed, wg)
+		return
+	}
+
+	// The result is copied to Master before the operation is completed
+	if err == nil && master.task.LocalStorage && operation.proc == "Worker.RunReduce" {
+		err = master.fetchResult(remoteWorker, operation)
+	}
 
 	if err != nil {
 		log.Printf("Operation %v '%v' Failed. Error: %v\n", operation.proc, operation.id, err)
-		wg.Done()
-		master.failedWorkerChan <- remoteWorker
+
+		// Errors returned by the worker itself don't mean it failed
+		var serverErr rpc.ServerError
+		if errors.As(err, &serverErr) {
+			master.failOperation(remoteWorker, operation, err)
+		} else {
+			master.failedWorkerChan <- remoteWorker
+		}
+		return
+	}
+
+	master.completeOperation(remoteWorker, operation, reply, wg)
+}
+
+// failOperation handles an operation that returned an error on a worker that is still
+// alive. The operation is scheduled again, unless it already failed task.MaxAttempts
+// times, which fails the job.
+func (master *Master) failOperation(remoteWorker *RemoteWorker, operation *Operation, err error) {
+	var (
+		available bool
+		retry     bool
+		exhausted bool
+		failures  int
+	)
+
+	master.workersMutex.Lock()
+
+	delete(operation.workers, remoteWorker.id)
+	remoteWorker.removeOperation(operation)
+	available = remoteWorker.available()
+
+	operation.failures++
+	failures = operation.failures
+	master.recordFailure(remoteWorker, operation, err)
+	exhausted = operation.status != OPERATION_COMPLETED && failures >= maxAttempts(master.task)
+	retry = !exhausted && operation.status != OPERATION_COMPLETED && len(operation.workers) == 0
+
+	master.workersMutex.Unlock()
+
+	if exhausted {
+		master.fail(fmt.Errorf("%v '%v' failed %v times: %w", operation.proc, operation.id, failures, err))
+	} else if retry {
+		master.stats.counters.Add(OPERATION_RETRIES, 1)
 		master.failedOperationChan <- operation
-	} else {
-		wg.Done()
+	}
+
+	if available {
 		master.idleWorkerChan <- remoteWorker
-		master.numCompletedOperations++
+	}
+}
+
+// Returns the number of times an operation can fail before the job fails.
+func maxAttempts(task *Task) int {
+	if task.MaxAttempts <= 0 {
+		return DEFAULT_MAX_ATTEMPTS
+	}
+	return task.MaxAttempts
+}
+
+// completeOperation marks the operation as completed by remoteWorker and makes the
+// worker available again. An operation is only completed once, even if it was also
+// running on other workers, and only the counters of that attempt are kept.
+func (master *Master) completeOperation(remoteWorker *RemoteWorker, operation *Operation, reply *RunReply, wg *sync.WaitGroup) {
+	var (
+		first        bool
+		stageJournal *journal
+		stats        OperationStats
+	)
 
-		if master.numCompletedOperations == master.totalOperations {
-			close(master.failedOperationChan)
+	master.workersMutex.Lock()
+
+	delete(operation.workers, remoteWorker.id)
+	remoteWorker.removeOperation(operation)
+
+	if operation.status != OPERATION_COMPLETED {
+		first = true
+		operation.status = OPERATION_COMPLETED
+		operation.output = remoteWorker
+		operation.partitionSizes = reply.PartitionSizes
+		if operation.rerun {
+			master.numCompletedReruns++
+		} else {
+			master.numCompletedOperations++
+			stageJournal = master.journal
+		}
+		if operation.proc == "Worker.RunMap" && master.task.LocalStorage {
+			master.numChanges++
+		}
+
+		stats = OperationStats{
+			Stage:    operation.stage,
+			Phase:    operationPhase(operation.proc),
+			Id:       operation.id,
+			Worker:   remoteWorker.hostname,
+			Duration: time.Since(operation.startTime),
+			Counters: reply.Counters,
+		}
+	}
+
+	available := remoteWorker.available()
+
+	master.workersMutex.Unlock()
+
+	// The operation is recorded before the phase can move on. The journal already has
+	// map operations that were run again as completed.
+	if first {
+		master.stats.add(stats)
+
+		if stageJournal == nil {
+			wg.Done()
+		} else if err := stageJournal.operationDone(operation); err != nil {
+			master.fail(err)
+		} else {
+			wg.Done()
 		}
 	}
+
+	if available {
+		master.idleWorkerChan <- remoteWorker
+	}
 }
@@ -0,0 +1,106 @@
+package mapreduce
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSchedulerMaster(t *testing.T, task *Task) *Master {
+	master := newMaster(context.Background(), "")
+	t.Cleanup(master.cancel)
+	master.task = task
+	master.stages = []*Task{task}
+	return master
+}
+
+// Operations running for longer than SpeculativeDelay get a backup on an idle worker
+// once SpeculativeThreshold of the phase is completed, and the first copy to finish
+// completes the operation.
+func TestLaunchBackups(t *testing.T) {
+	var wg sync.WaitGroup
+
+	task := &Task{JobId: "job", SpeculativeThreshold: 0.5, SpeculativeDelay: 10 * time.Millisecond}
+	master := newTestSchedulerMaster(t, task)
+
+	straggler := newRemoteWorker(0, "straggler", 1)
+	idle := newPullingWorker(1, "idle", 1)
+	master.workers[straggler.id] = straggler
+	master.workers[idle.id] = idle
+
+	completed := newOperation("Worker.RunMap", 0, 0, InputSplit{Path: "a"})
+	completed.status = OPERATION_COMPLETED
+	slow := newOperation("Worker.RunMap", 0, 1, InputSplit{Path: "b"})
+	master.assignOperation(straggler, slow)
+	slow.startTime = time.Now().Add(-time.Second)
+	wg.Add(1)
+
+	master.operations = []*Operation{completed, slow}
+	master.totalOperations = 2
+
+	// Not enough of the phase is completed
+	master.idleWorkerChan <- idle
+	master.launchBackups(task, &wg)
+	if slow.backups != 0 {
+		t.Fatal("backup launched before the threshold was reached")
+	}
+
+	master.numCompletedOperations = 1
+	master.launchBackups(task, &wg)
+
+	var backup *assignment
+	select {
+	case backup = <-idle.assignments:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no backup launched")
+	}
+
+	master.workersMutex.Lock()
+	if slow.backups != 1 || slow.workers[idle.id] != idle || slow.workers[straggler.id] != straggler {
+		t.Errorf("operation with %v backups on workers %v", slow.backups, slow.workers)
+	}
+	master.workersMutex.Unlock()
+
+	// Backups are only launched once
+	master.idleWorkerChan <- idle
+	master.launchBackups(task, &wg)
+	if slow.backups != 1 {
+		t.Errorf("%v backups launched", slow.backups)
+	}
+	<-master.idleWorkerChan
+
+	if err := master.ReportTask(&ReportTaskArgs{JobId: "job", WorkerId: idle.id, TaskId: backup.id}, nil); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	// The straggler finishing later doesn't complete the operation again
+	master.completeOperation(straggler, slow, &RunReply{}, &wg)
+
+	if slow.status != OPERATION_COMPLETED || slow.output != idle || master.numCompletedOperations != 2 {
+		t.Errorf("operation %v by %v, %v completed operations", slow.status, slow.output, master.numCompletedOperations)
+	}
+}
+
+// A worker that pulls its operations and doesn't report one before OperationTimeout
+// is considered failed.
+func TestHandOutTimeout(t *testing.T) {
+	master := newTestSchedulerMaster(t, &Task{JobId: "job", OperationTimeout: 20 * time.Millisecond})
+	worker := newPullingWorker(0, "worker", 1)
+
+	err := master.handOut(worker, "Worker.RunMap", new(RunArgs), new(RunReply))
+	if err == nil {
+		t.Fatal("operation that was never reported succeeded")
+	}
+	if len(master.assignments) != 0 {
+		t.Errorf("assignments left after the timeout: %v", master.assignments)
+	}
+
+	// Late reports are ignored
+	task := <-worker.assignments
+	master.workers[worker.id] = worker
+	if err = master.ReportTask(&ReportTaskArgs{JobId: "job", WorkerId: worker.id, TaskId: task.id}, nil); err != nil {
+		t.Errorf("late report failed: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package mapreduce
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	FETCH_RETRY_DELAY = time.Second
+	FETCH_TIMEOUT     = 30 * time.Second
+
+	// Bytes read by each call that copies intermediate files between machines
+	FETCH_CHUNK_SIZE = 4 * 1024 * 1024
+)
+
+// Reduce operations are given the location of every map output and merge their
+// partition of each one. Map operations whose output was lost, because a reducer
+// couldn't read it or, with task.LocalStorage, the worker holding it failed, are run
+// again before the reduce operation is retried.
+
+// mapOutputs returns the location of the output of every map operation, and the map
+// operations whose output is no longer available.
+func (master *Master) mapOutputs() (outputs []MapOutput, lost []*Operation) {
+	master.workersMutex.Lock()
+	defer master.workersMutex.Unlock()
+
+	outputs = make([]MapOutput, 0, len(master.mapOperations))
+
+	for _, operation := range master.mapOperations {
+		available := operation.status == OPERATION_COMPLETED
+		if master.task.LocalStorage {
+			available = available && operation.output != nil && operation.output.status != WORKER_DEAD
+		}
+
+		if available {
+			outputs = append(outputs, MapOutput{operation.id, outputHostname(operation)})
+		} else {
+			lost = append(lost, operation)
+		}
+	}
+
+	return outputs, lost
+}
+
+// Returns the hostname of the worker holding the output of operation, if it's known.
+// Should be called with workersMutex held.
+func outputHostname(operation *Operation) string {
+	if operation.output == nil {
+		return ""
+	}
+	return operation.output.hostname
+}
+
+// deferOperation gives up on running operation on worker until the lost map operations
+// are run again. The operation is scheduled again after FETCH_RETRY_DELAY.
+func (master *Master) deferOperation(worker *RemoteWorker, operation *Operation, lost []*Operation, wg *sync.WaitGroup) {
+	var (
+		rerun     []*Operation
+		available bool
+	)
+
+	master.workersMutex.Lock()
+
+	delete(operation.workers, worker.id)
+	worker.removeOperation(operation)
+	available = worker.available()
+
+	// A backup may have completed the operation already, then nothing is missing
+	if operation.status == OPERATION_COMPLETED {
+		master.workersMutex.Unlock()
+		if available {
+			master.idleWorkerChan <- worker
+		}
+		return
+	}
+
+	// Lost operations that are already running again are left alone. The rest are
+	// replaced by a new attempt, which is counted in wg like the operations of the
+	// phase so it can't end before they are done.
+	for _, mapOperation := range lost {
+		if mapOperation.status != OPERATION_COMPLETED || master.mapOperations[mapOperation.id] != mapOperation {
+			continue
+		}
+
+		mapOperation = newOperation(mapOperation.proc, mapOperation.stage, mapOperation.id, mapOperation.split)
+		mapOperation.rerun = true
+		master.mapOperations[mapOperation.id] = mapOperation
+		master.totalReruns++
+		rerun = append(rerun, mapOperation)
+		wg.Add(1)
+	}
+
+	master.workersMutex.Unlock()
+
+	// They wait for a worker along with the operations of the phase
+	for _, mapOperation := range rerun {
+		log.Printf("Output of %v '%v' was lost. Running it again.\n", mapOperation.proc, mapOperation.id)
+		master.stats.counters.Add(OPERATION_RETRIES, 1)
+		master.failedOperationChan <- mapOperation
+	}
+
+	log.Printf("Deferring %v '%v' until the output of %v map operations is available\n", operation.proc, operation.id, len(lost))
+
+	time.AfterFunc(FETCH_RETRY_DELAY, func() {
+		master.failedOperationChan <- operation
+	})
+
+	if available {
+		master.idleWorkerChan <- worker
+	}
+}
+
+// handleFetchFailures treats the map outputs that worker couldn't read while running
+// operation as lost, and defers the operation until they are created again. Failures
+// of outputs that were already created again are ignored.
+func (master *Master) handleFetchFailures(worker *RemoteWorker, operation *Operation, failed []MapOutput, wg *sync.WaitGroup) {
+	var lost, missing []*Operation
+
+	master.workersMutex.Lock()
+	for _, output := range failed {
+		if output.Id < 0 || output.Id >= len(master.mapOperations) {
+			continue
+		}
+
+		mapOperation := master.mapOperations[output.Id]
+		if mapOperation.status == OPERATION_COMPLETED && outputHostname(mapOperation) == output.WorkerHostname {
+			log.Printf("Worker %v failed to read output of map '%v' from '%v'\n", worker.id, output.Id, output.WorkerHostname)
+			lost = append(lost, mapOperation)
+		}
+	}
+	master.workersMutex.Unlock()
+
+	_, missing = master.mapOutputs()
+	master.deferOperation(worker, operation, append(lost, missing...), wg)
+}
+
+// fetchResult copies the result of a reduce operation from the worker that ran it.
+func (master *Master) fetchResult(worker *RemoteWorker, operation *Operation) error {
+	args := FetchArgs{JobId: master.task.JobId, Stage: operation.stage, ReduceId: operation.id}
+
+	return writeFileAtomic(resultFileName(master.stages[operation.stage], operation.id), func(file io.Writer) error {
+		return fetchFile(file, args, func(args *FetchArgs, reply *FetchReply) error {
+			return callWithTimeout(worker.hostname, "Worker.FetchResult", args, reply, FETCH_TIMEOUT)
+		})
+	})
+}
+
+// Returns true if filePath is the input of a map operation of the job.
+func (master *Master) isInputFile(filePath string) bool {
+	master.workersMutex.Lock()
+	defer master.workersMutex.Unlock()
+
+	for _, operations := range [][]*Operation{master.operations, master.mapOperations} {
+		for _, operation := range operations {
+			if operation.proc == "Worker.RunMap" && operation.split.Path == filePath {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,88 @@
+package mapreduce
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// Returns a Master in the reduce phase of a job whose map operations all completed on
+// worker, with a journal in a temporary directory.
+func newTestReduceMaster(t *testing.T, worker *RemoteWorker, numMaps int) *Master {
+	task := journalTestTask(t)
+	task.LocalStorage = true
+
+	master := newMaster(context.Background(), "")
+	t.Cleanup(master.cancel)
+	master.task = task
+	master.stages = []*Task{task}
+	master.phase = PHASE_REDUCE
+	master.workers[worker.id] = worker
+
+	j, _, err := openJournal(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { j.close() })
+	master.journal = j
+
+	for i := 0; i < numMaps; i++ {
+		operation := newOperation("Worker.RunMap", 0, i, InputSplit{Path: "input"})
+		operation.status = OPERATION_COMPLETED
+		operation.output = worker
+		master.mapOperations = append(master.mapOperations, operation)
+	}
+
+	return master
+}
+
+// Map operations run again because their output was lost aren't counted or recorded as
+// operations of the reduce phase.
+func TestRerunLostMapOutput(t *testing.T) {
+	var wg sync.WaitGroup
+
+	holder := newRemoteWorker(0, "holder", 1)
+	reducer := newRemoteWorker(1, "reducer", 1)
+	master := newTestReduceMaster(t, holder, 2)
+	master.workers[reducer.id] = reducer
+
+	reduce := newOperation("Worker.RunReduce", 0, 0, InputSplit{Path: "reduce-0"})
+	master.operations = []*Operation{reduce}
+	master.totalOperations = 1
+	reducer.addOperation(reduce)
+	wg.Add(1)
+
+	// The worker holding the map outputs failed
+	holder.status = WORKER_DEAD
+	outputs, lost := master.mapOutputs()
+	if len(outputs) != 0 || len(lost) != 2 {
+		t.Fatalf("mapOutputs = %v available, %v lost; want 2 lost", len(outputs), len(lost))
+	}
+
+	master.deferOperation(reducer, reduce, lost, &wg)
+
+	if master.totalReruns != 2 || master.totalOperations != 1 {
+		t.Errorf("%v reruns and %v operations, want 2 and 1", master.totalReruns, master.totalOperations)
+	}
+
+	for i := 0; i < 2; i++ {
+		rerun := <-master.failedOperationChan
+		if !rerun.rerun || rerun.proc != "Worker.RunMap" || master.mapOperations[rerun.id] != rerun {
+			t.Fatalf("operation %v %v was scheduled, want a rerun of a map operation", rerun.proc, rerun.id)
+		}
+
+		master.completeOperation(reducer, rerun, &RunReply{}, &wg)
+	}
+
+	if master.numCompletedReruns != 2 || master.numCompletedOperations != 0 {
+		t.Errorf("%v completed reruns and %v completed operations, want 2 and 0", master.numCompletedReruns, master.numCompletedOperations)
+	}
+
+	if len(master.journal.completedOperations) != 0 {
+		t.Errorf("journal recorded %v", master.journal.completedOperations)
+	}
+
+	if outputs, lost = master.mapOutputs(); len(outputs) != 2 || len(lost) != 0 {
+		t.Errorf("mapOutputs = %v available, %v lost; want 2 available", len(outputs), len(lost))
+	}
+}
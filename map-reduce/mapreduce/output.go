@@ -0,0 +1,375 @@
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// OutputFormat writes the result of the last stage of a job to files in its OutputPath.
+// The records of each reduce job are written to their own file, "output-<id><ext>",
+// or all of them to a single "output<ext>" file with MergeOutput.
+type OutputFormat interface {
+	// Extension of the output files, including the dot
+	Extension() string
+
+	// NewWriter returns a writer of records to w.
+	NewWriter(w io.Writer) OutputWriter
+}
+
+// OutputWriter writes records to an output file.
+type OutputWriter interface {
+	Write(kv *KeyValue) error
+
+	// Flush writes any buffered records to the file.
+	Flush() error
+}
+
+// JSONLinesOutput writes a JSON object with the Key and Value of each record per line.
+type JSONLinesOutput struct{}
+
+func (output *JSONLinesOutput) Extension() string { return ".jsonl" }
+
+func (output *JSONLinesOutput) NewWriter(w io.Writer) OutputWriter {
+	return &jsonLinesWriter{json.NewEncoder(w)}
+}
+
+// TSVOutput writes the key and value of each record in a line, separated by a tab.
+// Backslashes, tabs and line breaks in them are escaped as \\, \t, \n and \r.
+type TSVOutput struct{}
+
+func (output *TSVOutput) Extension() string { return ".tsv" }
+
+func (output *TSVOutput) NewWriter(w io.Writer) OutputWriter {
+	return &tsvWriter{w}
+}
+
+// CSVOutput writes the key and value of each record in a row.
+type CSVOutput struct {
+	// Field delimiter. 0 = ','
+	Comma rune
+
+	// Start each file with a "key,value" row
+	Header bool
+}
+
+func (output *CSVOutput) Extension() string { return ".csv" }
+
+func (output *CSVOutput) NewWriter(w io.Writer) OutputWriter {
+	var writer *csv.Writer = csv.NewWriter(w)
+
+	if output.Comma != 0 {
+		writer.Comma = output.Comma
+	}
+
+	// Errors are kept by the writer and returned by Flush
+	if output.Header {
+		_ = writer.Write([]string{"key", "value"})
+	}
+
+	return &csvWriter{writer}
+}
+
+type jsonLinesWriter struct {
+	encoder *json.Encoder
+}
+
+func (writer *jsonLinesWriter) Write(kv *KeyValue) error { return writer.encoder.Encode(kv) }
+
+func (writer *jsonLinesWriter) Flush() error { return nil }
+
+var tsvEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+type tsvWriter struct {
+	w io.Writer
+}
+
+func (writer *tsvWriter) Write(kv *KeyValue) error {
+	_, err := io.WriteString(writer.w, tsvEscaper.Replace(kv.Key)+"\t"+tsvEscaper.Replace(kv.Value)+"\n")
+	return err
+}
+
+func (writer *tsvWriter) Flush() error { return nil }
+
+type csvWriter struct {
+	writer *csv.Writer
+}
+
+func (writer *csvWriter) Write(kv *KeyValue) error {
+	return writer.writer.Write([]string{kv.Key, kv.Value})
+}
+
+func (writer *csvWriter) Flush() error {
+	writer.writer.Flush()
+	return writer.writer.Error()
+}
+
+// Returns the output format of task. Master always writes the output of a job, as
+// JSON lines if the task doesn't set a format.
+func outputFormat(task *Task) OutputFormat {
+	if task.Output == nil {
+		return &JSONLinesOutput{}
+	}
+	return task.Output
+}
+
+// Returns the path of the output file of a reduce job
+func outputFileName(task *Task, id int) string {
+	return filepath.Join(task.OutputPath(), fmt.Sprintf("output-%v%v", id, outputFormat(task).Extension()))
+}
+
+// Returns the path of the output file with the result of every reduce job
+func mergedOutputFileName(task *Task) string {
+	return filepath.Join(task.OutputPath(), "output"+outputFormat(task).Extension())
+}
+
+// outputFile writes records to an output file. Like recordWriter, they are written to
+// a temporary file that is only renamed to its final path when it's closed.
+type outputFile struct {
+	path   string
+	file   *os.File
+	buffer *bufio.Writer
+	writer OutputWriter
+}
+
+// Create an output file that will be moved to path once it's closed.
+func createOutputFile(format OutputFormat, path string) (output *outputFile, err error) {
+	output = new(outputFile)
+	output.path = path
+
+	if output.file, err = os.CreateTemp(filepath.Dir(path), tempFilePattern(path)); err != nil {
+		return nil, err
+	}
+
+	output.buffer = bufio.NewWriter(output.file)
+	output.writer = format.NewWriter(output.buffer)
+	return output, nil
+}
+
+// Write up to limit records of stream to the file (limit < 0 = all of them).
+func (output *outputFile) writeStream(stream recordStream, limit int) error {
+	for n := 0; n != limit; n++ {
+		kv, ok := stream.next()
+		if !ok {
+			return stream.err()
+		}
+
+		if err := output.writer.Write(&kv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write at least limit records of stream to the file, and then the following ones with
+// the same key as the last one written, so a key is never split across two files
+// (limit < 0 = all of them).
+func (output *outputFile) writeKeyRange(stream *peekStream, limit int) error {
+	var last string
+
+	for n := 0; ; n++ {
+		kv, ok := stream.peek()
+		if !ok {
+			return stream.err()
+		}
+
+		if limit >= 0 && n >= limit && (n == 0 || kv.Key != last) {
+			return nil
+		}
+
+		stream.next()
+		if err := output.writer.Write(&kv); err != nil {
+			return err
+		}
+		last = kv.Key
+	}
+}
+
+// Flush the records, sync and close the file, and then commit it by renaming it to its
+// final path.
+func (output *outputFile) close() (err error) {
+	if err = output.writer.Flush(); err == nil {
+		if err = output.buffer.Flush(); err == nil {
+			err = output.file.Sync()
+		}
+	}
+
+	if closeErr := output.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(output.file.Name())
+		return err
+	}
+
+	return os.Rename(output.file.Name(), output.path)
+}
+
+// Close and remove the temporary file without committing it.
+func (output *outputFile) abort() {
+	output.file.Close()
+	os.Remove(output.file.Name())
+}
+
+// Write a stream to a new output file at path. See writeStream for limit.
+func storeOutput(format OutputFormat, path string, stream recordStream, limit int) error {
+	output, err := createOutputFile(format, path)
+	if err != nil {
+		return err
+	}
+
+	if err = output.writeStream(stream, limit); err != nil {
+		output.abort()
+		return err
+	}
+
+	return output.close()
+}
+
+// Write the records of stream with the keys of the next range to a new output file at
+// path. See writeKeyRange for limit.
+func storeKeyRange(format OutputFormat, path string, stream *peekStream, limit int) error {
+	output, err := createOutputFile(format, path)
+	if err != nil {
+		return err
+	}
+
+	if err = output.writeKeyRange(stream, limit); err != nil {
+		output.abort()
+		return err
+	}
+
+	return output.close()
+}
+
+// Write the result partitions of the last stage of a job with the output format of its
+// task. open returns a stream over the records of a partition.
+func writeOutput(task *Task, numPartitions int, open func(partition int) (recordStream, error)) (err error) {
+	var (
+		format OutputFormat = outputFormat(task)
+		output *outputFile
+		stream recordStream
+	)
+
+	if task.SortOutput {
+		return writeSortedOutput(task, numPartitions, open)
+	}
+
+	if !task.MergeOutput {
+		for p := 0; p < numPartitions; p++ {
+			if stream, err = open(p); err != nil {
+				return err
+			}
+
+			err = storeOutput(format, outputFileName(task, p), stream, -1)
+			stream.close()
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if output, err = createOutputFile(format, mergedOutputFileName(task)); err != nil {
+		return err
+	}
+
+	for p := 0; p < numPartitions; p++ {
+		if stream, err = open(p); err != nil {
+			output.abort()
+			return err
+		}
+
+		err = output.writeStream(stream, -1)
+		stream.close()
+
+		if err != nil {
+			output.abort()
+			return err
+		}
+	}
+
+	return output.close()
+}
+
+// Write the result partitions sorted by key across all of them: to a single file with
+// MergeOutput, or else to numPartitions files with consecutive ranges of keys and about
+// the same number of records each. All the records of a key are in the same file. Partitions are sorted in memory one at a time, and
+// kept in sorted runs on disk until they're all merged.
+func writeSortedOutput(task *Task, numPartitions int, open func(partition int) (recordStream, error)) (err error) {
+	var (
+		format  OutputFormat = outputFormat(task)
+		dir     string
+		paths   []string
+		records []KeyValue
+		total   int
+		stream  recordStream
+		perFile int
+	)
+
+	if dir, err = os.MkdirTemp(task.OutputPath(), tempFilePattern("sort")); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for p := 0; p < numPartitions; p++ {
+		if stream, err = open(p); err != nil {
+			return err
+		}
+
+		records = records[:0]
+		for kv, ok := stream.next(); ok; kv, ok = stream.next() {
+			records = append(records, kv)
+		}
+		stream.close()
+
+		if err = stream.err(); err != nil {
+			return err
+		}
+
+		sort.SliceStable(records, func(i, j int) bool {
+			return records[i].Key < records[j].Key
+		})
+
+		paths = append(paths, filepath.Join(dir, fmt.Sprintf("partition-%v", p)))
+		if err = storeRun(task, paths[p], &sliceStream{records}); err != nil {
+			return err
+		}
+
+		total += len(records)
+	}
+
+	if stream, err = openMergeStream(task, paths); err != nil {
+		return err
+	}
+	defer stream.close()
+
+	if task.MergeOutput {
+		return storeOutput(format, mergedOutputFileName(task), stream, -1)
+	}
+
+	// Files are only cut between two keys, so they can hold more than perFile records
+	// and the last ones fewer
+	perFile = (total + numPartitions - 1) / numPartitions
+	ranges := &peekStream{recordStream: stream}
+	for p := 0; p < numPartitions; p++ {
+		if p == numPartitions-1 {
+			perFile = -1
+		}
+		if err = storeKeyRange(format, outputFileName(task, p), ranges, perFile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
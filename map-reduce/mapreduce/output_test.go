@@ -0,0 +1,151 @@
+package mapreduce
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Sorted output files hold about the same number of records, but are only cut between
+// two keys.
+func TestWriteSortedOutputKeyBoundary(t *testing.T) {
+	tests := []struct {
+		name       string
+		partitions [][]KeyValue
+		files      []string
+	}{
+		{
+			name:       "key across cut",
+			partitions: [][]KeyValue{{{"a", "1"}, {"a", "2"}, {"b", "3"}, {"a", "4"}}, {{"c", "5"}, {"a", "6"}}},
+			files:      []string{"a\t1\na\t2\na\t4\na\t6\n", "b\t3\nc\t5\n"},
+		},
+		{
+			name:       "single key",
+			partitions: [][]KeyValue{{{"a", "1"}, {"a", "2"}}, {{"a", "3"}}},
+			files:      []string{"a\t1\na\t2\na\t3\n", ""},
+		},
+		{
+			name:       "cut on boundary",
+			partitions: [][]KeyValue{{{"b", "1"}, {"a", "2"}}, {{"d", "3"}, {"c", "4"}}},
+			files:      []string{"a\t2\nb\t1\n", "c\t4\nd\t3\n"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			task := &Task{JobId: "job", OutputDir: t.TempDir(), Output: &TSVOutput{}, SortOutput: true}
+			if err := os.MkdirAll(task.OutputPath(), os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+
+			err := writeOutput(task, len(test.partitions), func(partition int) (recordStream, error) {
+				return &sliceStream{append([]KeyValue(nil), test.partitions[partition]...)}, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for p, expected := range test.files {
+				data, err := os.ReadFile(outputFileName(task, p))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != expected {
+					t.Errorf("file %v = %q, expected %q", p, data, expected)
+				}
+			}
+
+			entries, _ := os.ReadDir(task.OutputPath())
+			if len(entries) != len(test.files) {
+				names := make([]string, 0, len(entries))
+				for _, entry := range entries {
+					names = append(names, entry.Name())
+				}
+				t.Errorf("output files: %v", strings.Join(names, ", "))
+			}
+		})
+	}
+}
+
+// Every format writes one record per line, with keys and values that hold their
+// separators kept apart.
+func TestOutputFormats(t *testing.T) {
+	records := []KeyValue{{"a", "1"}, {"tab\tkey", "line\nbreak"}, {"comma,key", `quote"d`}, {`back\slash`, ""}}
+
+	tests := []struct {
+		format OutputFormat
+		want   string
+	}{
+		{&JSONLinesOutput{}, `{"Key":"a","Value":"1"}
+{"Key":"tab\tkey","Value":"line\nbreak"}
+{"Key":"comma,key","Value":"quote\"d"}
+{"Key":"back\\slash","Value":""}
+`},
+		{&TSVOutput{}, "a\t1\ntab\\tkey\tline\\nbreak\ncomma,key\tquote\"d\nback\\\\slash\t\n"},
+		{&CSVOutput{}, "a,1\ntab\tkey,\"line\nbreak\"\n\"comma,key\",\"quote\"\"d\"\nback\\slash,\n"},
+		{&CSVOutput{Comma: ';', Header: true}, "key;value\na;1\ntab\tkey;\"line\nbreak\"\ncomma,key;\"quote\"\"d\"\nback\\slash;\n"},
+	}
+
+	for _, test := range tests {
+		var buffer bytes.Buffer
+
+		writer := test.format.NewWriter(&buffer)
+		for i := range records {
+			if err := writer.Write(&records[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if buffer.String() != test.want {
+			t.Errorf("%T%+v wrote %q, want %q", test.format, test.format, buffer.String(), test.want)
+		}
+	}
+}
+
+// With MergeOutput, the partitions are written one after the other to a single file.
+func TestWriteMergedOutput(t *testing.T) {
+	task := &Task{JobId: "job", OutputDir: t.TempDir(), Output: &TSVOutput{}, MergeOutput: true}
+	if err := os.MkdirAll(task.OutputPath(), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	partitions := [][]KeyValue{{{"b", "1"}}, {}, {{"a", "2"}, {"c", "3"}}}
+	err := writeOutput(task, len(partitions), func(partition int) (recordStream, error) {
+		return &sliceStream{partitions[partition]}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(mergedOutputFileName(task)); err != nil || string(data) != "b\t1\na\t2\nc\t3\n" {
+		t.Errorf("merged output %q, %v", data, err)
+	}
+	if names := dirNames(t, task.OutputPath()); len(names) != 1 {
+		t.Errorf("output directory holds %v", names)
+	}
+}
+
+// Local jobs with an OutputFormat write their result to files, one per reduce job.
+func TestJobOutputFiles(t *testing.T) {
+	task := newTestWordCountTask(t, 2)
+	task.Output = &TSVOutput{}
+
+	_, partitions, err := runTestJob(context.Background(), &Job{Task: task, Mode: JOB_SEQUENTIAL}, []string{"b a c a", "d a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partitions) != 2 {
+		t.Errorf("sent %v partitions to OutputChan, want 2", len(partitions))
+	}
+
+	for p, want := range []string{"b\t1\nd\t1\n", "a\t3\nc\t1\n"} {
+		if data, err := os.ReadFile(outputFileName(task, p)); err != nil || string(data) != want {
+			t.Errorf("output %v = %q, %v; want %q", p, data, err, want)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package mapreduce
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A job can run several Tasks as stages of a pipeline. Each reduce job of a stage
+// produces one result partition, and every partition is the input of one map operation
+// of the next stage, which passes its records to MapRecords. Running locally, the
+// partitions are handed over in memory, in the distributed modes they are read from
+// the result files of the previous stage.
+
+// mapInput is the input of a map operation: a chunk of the input data, a split read with
+// the InputFormat of the task, or a result partition of the previous stage of a pipeline.
+type mapInput struct {
+	data       []byte
+	split      *InputSplit // Split that wasn't read yet
+	records    []KeyValue
+	hasRecords bool // The input was read as records, passed to MapRecords
+}
+
+// Run the map function of task on input, passing its records to emit as they're
+// produced, and count them in counters.
+func callMap(task *Task, input mapInput, emit func(KeyValue) error, counters *Counters) (err error) {
+	var (
+		emitter *recordEmitter = &recordEmitter{emit: emit, counters: counters}
+		result  []KeyValue
+	)
+
+	if input.split != nil {
+		if input.records, err = readLocalSplit(task.Input, *input.split); err != nil {
+			return err
+		}
+		input.hasRecords = true
+	}
+
+	if input.hasRecords {
+		counters.Add(MAP_INPUT_RECORDS, int64(len(input.records)))
+		if task.MapRecordsEmit != nil {
+			err = task.MapRecordsEmit(input.records, emitter)
+		} else {
+			result, err = task.MapRecords(input.records)
+		}
+	} else {
+		counters.Add(MAP_INPUT_RECORDS, 1)
+		if task.MapEmit != nil {
+			err = task.MapEmit(input.data, emitter)
+		} else {
+			result, err = task.Map(input.data)
+		}
+	}
+
+	for i := 0; i < len(result) && err == nil; i++ {
+		err = emitter.Emit(result[i])
+	}
+
+	counters.Add(MAP_OUTPUT_RECORDS, emitter.numRecords)
+
+	// A record that couldn't be stored fails the operation, even if the map function
+	// didn't return the error
+	if emitter.err != nil {
+		return emitter.err
+	}
+	return err
+}
+
+// recordEmitter is the Emitter of a map operation, which passes records on to emit
+// until it fails.
+type recordEmitter struct {
+	emit       func(KeyValue) error
+	counters   *Counters
+	numRecords int64
+	err        error
+}
+
+func (emitter *recordEmitter) Emit(kv KeyValue) error {
+	if emitter.err != nil {
+		return emitter.err
+	}
+
+	if emitter.err = emitter.emit(kv); emitter.err != nil {
+		return emitter.err
+	}
+
+	emitter.numRecords++
+	return nil
+}
+
+func (emitter *recordEmitter) Counters() *Counters {
+	return emitter.counters
+}
+
+// localRunner runs a single stage in this process, reading the map inputs from inputs
+// and sending the result of each reduce job to output.
+type localRunner func(ctx context.Context, task *Task, inputs <-chan mapInput, output chan<- []KeyValue) (*Result, error)
+
+// runLocal runs the stages of a job in this process, one after the other. The result
+// partitions of every stage but the last one are kept in memory and passed on to the
+// next one, the ones of the last stage are written with its OutputFormat, if it has one,
+// and sent to its OutputChan, which is closed once the job is over. The last stage
+// needs at least one of them.
+func runLocal(ctx context.Context, tasks []*Task, run localRunner) (result *Result, err error) {
+	var (
+		cancel      context.CancelFunc
+		inputs      <-chan mapInput
+		output      chan []KeyValue
+		partitions  [][]KeyValue
+		stageResult *Result
+		last        int = len(tasks) - 1
+	)
+
+	if tasks[last].OutputChan == nil && tasks[last].Output == nil {
+		return nil, stageError(tasks, last, errors.New("task without an OutputChan or an Output"))
+	}
+
+	if tasks[last].OutputChan != nil {
+		defer close(tasks[last].OutputChan)
+	}
+
+	// Stops reading the input if a stage fails
+	ctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+
+	result = new(Result)
+
+	if tasks[0].Input != nil {
+		if inputs, err = splitInputs(tasks[0]); err != nil {
+			return nil, stageError(tasks, 0, err)
+		}
+	} else {
+		inputs = dataInputs(ctx, tasks[0].InputChan)
+	}
+
+	for stage, task := range tasks {
+		if stage == last && task.Output == nil {
+			output = task.OutputChan
+		} else {
+			// Buffered so the stage doesn't wait for the next one to start
+			output = make(chan []KeyValue, task.NumReduceJobs)
+		}
+
+		if stageResult, err = run(ctx, task, inputs, output); err != nil {
+			return nil, stageError(tasks, stage, err)
+		}
+
+		result.addStage(stage, stageResult)
+
+		if stage == last && task.Output == nil {
+			break
+		}
+
+		close(output)
+		partitions = make([][]KeyValue, 0, task.NumReduceJobs)
+		for records := range output {
+			partitions = append(partitions, records)
+		}
+
+		if stage < last {
+			inputs = partitionInputs(partitions)
+			continue
+		}
+
+		if err = writeLocalOutput(ctx, task, partitions); err != nil {
+			return nil, stageError(tasks, stage, err)
+		}
+	}
+
+	return result, nil
+}
+
+// Write the result partitions of the last stage with its OutputFormat, and send them
+// to its OutputChan if it has one.
+func writeLocalOutput(ctx context.Context, task *Task, partitions [][]KeyValue) error {
+	err := writeOutput(task, len(partitions), func(partition int) (recordStream, error) {
+		return &sliceStream{partitions[partition]}, nil
+	})
+
+	if err != nil || task.OutputChan == nil {
+		return err
+	}
+
+	for _, records := range partitions {
+		select {
+		case task.OutputChan <- records:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Returns err with the stage that failed, if the job has more than one.
+func stageError(tasks []*Task, stage int, err error) error {
+	if len(tasks) == 1 {
+		return err
+	}
+	return fmt.Errorf("stage %v: %w", stage, err)
+}
+
+// Check that the tasks can run as the stages of a pipeline and return copies of them
+// to run, so the settings derived for the job aren't written to the caller's tasks.
+// A job without a JobId gets jobId, or a new one if it's empty, and later stages
+// without one are named after it. Stages that would share the working directories of
+// an earlier one are given their own job id. The intermediate files of stages with a
+// new job id are removed once they're completed, since no later run uses them.
+func prepareStages(tasks []*Task, jobId string) ([]*Task, error) {
+	var generated bool = tasks[0].JobId == "" && jobId == ""
+	var stages []*Task = make([]*Task, 0, len(tasks))
+
+	if generated {
+		jobId = newJobId()
+	}
+
+	for i, task := range tasks {
+		if (i > 0 || task.Input != nil) && task.MapRecords == nil && task.MapRecordsEmit == nil {
+			return nil, fmt.Errorf("stage %v: task without a MapRecords function", i)
+		}
+
+		stage := *task
+		switch {
+		case stage.JobId != "":
+		case i == 0:
+			stage.JobId = jobId
+		default:
+			stage.JobId = stageJobId(stages[0].JobId, i)
+		}
+
+		if generated && task.JobId == "" {
+			stage.CleanupScratch = true
+		}
+
+		for _, previous := range stages {
+			if stage.ScratchPath() == previous.ScratchPath() || stage.OutputPath() == previous.OutputPath() {
+				stage.JobId = stageJobId(stage.JobId, i)
+				break
+			}
+		}
+
+		if err := checkJobId(stage.JobId); err != nil {
+			return nil, fmt.Errorf("stage %v: %w", i, err)
+		}
+
+		stages = append(stages, &stage)
+	}
+
+	return stages, nil
+}
+
+// Returns the job id of a stage of the job jobId, or of one that shares its working
+// directories with another one.
+func stageJobId(jobId string, stage int) string {
+	return fmt.Sprintf("%v-stage-%v", jobId, stage)
+}
+
+// dataInputs will run a goroutine that passes the chunks of data read from input on to
+// the map operations of the first stage, until input is closed. Once ctx is cancelled,
+// the rest of input is discarded, so the caller sending it isn't blocked forever.
+func dataInputs(ctx context.Context, input chan []byte) <-chan mapInput {
+	var inputs chan mapInput = make(chan mapInput)
+
+	go func() {
+		defer close(inputs)
+
+		for data := range input {
+			select {
+			case inputs <- mapInput{data: data}:
+			case <-ctx.Done():
+				for range input {
+				}
+				return
+			}
+		}
+	}()
+
+	return inputs
+}
+
+// Discard the map inputs a stage didn't read before stopping, so the goroutine sending
+// them isn't blocked forever.
+func discardInputs(inputs <-chan mapInput) {
+	go func() {
+		for range inputs {
+		}
+	}()
+}
+
+// Returns the splits of the input of task as the inputs of its map operations.
+func splitInputs(task *Task) (<-chan mapInput, error) {
+	splits, err := task.Input.Splits()
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := make(chan mapInput, len(splits))
+	for i := range splits {
+		inputs <- mapInput{split: &splits[i]}
+	}
+	close(inputs)
+
+	return inputs, nil
+}
+
+// Returns the result partitions of a stage as the inputs of the map operations of the
+// next one.
+func partitionInputs(partitions [][]KeyValue) <-chan mapInput {
+	var inputs chan mapInput = make(chan mapInput, len(partitions))
+
+	for _, records := range partitions {
+		inputs <- mapInput{records: records, hasRecords: true}
+	}
+	close(inputs)
+
+	return inputs
+}
+
+// Decode a result file of task, read by a map operation of the next stage.
+func decodeRecords(task *Task, data []byte) (records []KeyValue, err error) {
+	var (
+		reader *recordReader
+		kv     KeyValue
+	)
+
+	if reader, err = newRecordReader(task, io.NopCloser(bytes.NewReader(data))); err != nil {
+		return nil, err
+	}
+	defer reader.close()
+
+	for {
+		if err = reader.read(&kv); err != nil {
+			if err == io.EOF {
+				return records, nil
+			}
+			return nil, err
+		}
+		records = append(records, kv)
+	}
+}
@@ -0,0 +1,163 @@
+package mapreduce
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Returns a task that can run as a later stage of a pipeline.
+func newTestStage(jobId string) *Task {
+	return &Task{JobId: jobId, MapRecords: func(input []KeyValue) ([]KeyValue, error) { return input, nil }}
+}
+
+func TestPrepareStagesJobIds(t *testing.T) {
+	tasks := []*Task{{Name: "count"}, newTestStage(""), newTestStage("top")}
+
+	stages, err := prepareStages(tasks, defaultJobId(tasks[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"count", "count-stage-1", "top"}
+	for i, stage := range stages {
+		if stage.JobId != want[i] || stage.CleanupScratch {
+			t.Errorf("stage %v: JobId = %q, CleanupScratch = %v; want %q and false", i, stage.JobId, stage.CleanupScratch, want[i])
+		}
+	}
+
+	for i, task := range tasks {
+		if task == stages[i] || (i < 2 && task.JobId != "") {
+			t.Errorf("task %v of the caller was modified", i)
+		}
+	}
+}
+
+// A Master job without a name keeps the same id across runs.
+func TestDefaultJobId(t *testing.T) {
+	tests := map[string]string{"": DEFAULT_JOB_ID, "wordcount": "wordcount", "a/b": DEFAULT_JOB_ID}
+
+	for name, want := range tests {
+		if jobId := defaultJobId(&Task{Name: name}); jobId != want {
+			t.Errorf("defaultJobId(%q) = %q, want %q", name, jobId, want)
+		}
+	}
+}
+
+// Jobs with a new id every run remove their intermediate files, which no later run can
+// resume from.
+func TestPrepareStagesGeneratedJobId(t *testing.T) {
+	tasks := []*Task{{}, newTestStage(""), newTestStage("kept")}
+
+	stages, err := prepareStages(tasks, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(stages[0].JobId, "job-") || stages[1].JobId != stageJobId(stages[0].JobId, 1) {
+		t.Errorf("job ids = %q, %q; want a new one and its stage", stages[0].JobId, stages[1].JobId)
+	}
+	if !stages[0].CleanupScratch || !stages[1].CleanupScratch || stages[2].CleanupScratch {
+		t.Error("only the stages with a new job id should remove their intermediate files")
+	}
+
+	again, err := prepareStages(tasks, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again[0].JobId == stages[0].JobId {
+		t.Errorf("two jobs got the same job id %q", again[0].JobId)
+	}
+}
+
+// Stages never share the working directories of an earlier one.
+func TestPrepareStagesSharedDirs(t *testing.T) {
+	stages, err := prepareStages([]*Task{{JobId: "job"}, newTestStage("job")}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stages[1].JobId != "job-stage-1" {
+		t.Errorf("stage 1 has job id %q, want job-stage-1", stages[1].JobId)
+	}
+
+	if _, err = prepareStages([]*Task{{}, {}}, "job"); err == nil {
+		t.Error("stage without a MapRecords function was accepted")
+	}
+	if _, err = prepareStages([]*Task{{JobId: "../job"}}, ""); err == nil {
+		t.Error("invalid job id was accepted")
+	}
+}
+
+// The result partitions of each stage are the input of the next one, and only the
+// result of the last stage is sent to OutputChan.
+func TestRunPipeline(t *testing.T) {
+	inputs := testWordInputs(30)
+
+	// Words by number of occurrences
+	counts := make(map[string]int)
+	for _, input := range inputs {
+		for _, word := range strings.Fields(input) {
+			counts[word]++
+		}
+	}
+	byCount := make(map[string][]string)
+	for word, count := range counts {
+		byCount[strconv.Itoa(count)] = append(byCount[strconv.Itoa(count)], word)
+	}
+	for _, words := range byCount {
+		sort.Strings(words)
+	}
+
+	for _, mode := range []JobMode{JOB_SEQUENTIAL, JOB_PARALLEL} {
+		group := &Task{
+			ScratchDir:    t.TempDir(),
+			OutputDir:     t.TempDir(),
+			NumReduceJobs: 2,
+			MapRecords: func(input []KeyValue) (result []KeyValue, err error) {
+				for _, kv := range input {
+					result = append(result, KeyValue{kv.Value, kv.Key})
+				}
+				return result, nil
+			},
+			Shuffle: func(task *Task, key string) int { return len(key) % task.NumReduceJobs },
+			Reduce: func(key string, values Iterator) ([]KeyValue, error) {
+				var words []string
+				for word, ok := values.Next(); ok; word, ok = values.Next() {
+					words = append(words, word)
+				}
+				sort.Strings(words)
+				return []KeyValue{{key, strings.Join(words, " ")}}, nil
+			},
+		}
+
+		result, partitions, err := runTestJob(context.Background(), &Job{Task: newTestWordCountTask(t, 3), Stages: []*Task{group}, Mode: mode}, inputs)
+		if err != nil {
+			t.Fatalf("%v: %v", mode, err)
+		}
+
+		if len(partitions) != group.NumReduceJobs {
+			t.Errorf("%v: sent %v partitions, want one per reduce job of the last stage", mode, len(partitions))
+		}
+		numCounts := 0
+		for _, partition := range partitions {
+			for _, kv := range partition {
+				if want := strings.Join(byCount[kv.Key], " "); kv.Value != want {
+					t.Errorf("%v: words counted %v times: %q, want %q", mode, kv.Key, kv.Value, want)
+				}
+				numCounts++
+			}
+		}
+		if numCounts != len(byCount) {
+			t.Errorf("%v: sent %v counts, want %v", mode, numCounts, len(byCount))
+		}
+
+		if result.NumMapOperations != len(inputs)+3 || result.NumReduceOperations != 5 {
+			t.Errorf("%v: %v map and %v reduce operations, want %v and 5", mode, result.NumMapOperations, result.NumReduceOperations, len(inputs)+3)
+		}
+		if result.Counters[MAP_INPUT_RECORDS] != int64(len(inputs)+len(counts)) {
+			t.Errorf("%v: %v map input records, want %v", mode, result.Counters[MAP_INPUT_RECORDS], len(inputs)+len(counts))
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a worker that registers with a Pool waits for a job it doesn't serve yet
+	POOL_WAIT = 10 * time.Second
+)
+
+var errNoJob = errors.New("job is not running")
+
+// Pool is a long-lived Master that runs the jobs submitted with Run on the same workers,
+// started with RunPoolWorker. Jobs submitted concurrently run concurrently, and workers
+// serve all of them. Workers register with every job and build the task of each of its
+// stages from the registry, by the Name of the stage.
+type Pool struct {
+	scheduler Scheduler
+	listener  net.Listener
+	rpcServer *rpc.Server
+
+	// Masters of the running jobs, in the order they started. next is closed once
+	// another job starts, and closed once the Pool is.
+	mutex   sync.Mutex
+	masters []*Master
+	next    chan struct{}
+	closed  chan struct{}
+}
+
+// poolMaster receives the calls of workers to the Pool and passes them on to the Master
+// of their job.
+type poolMaster struct {
+	pool *Pool
+}
+
+// StartPool listens for workers on hostname until the Pool is closed. Every job runs
+// with scheduler, which must also be the one of the workers.
+func StartPool(hostname string, scheduler Scheduler) (pool *Pool, err error) {
+	pool = new(Pool)
+	pool.scheduler = scheduler
+	pool.rpcServer = rpc.NewServer()
+	pool.next = make(chan struct{})
+	pool.closed = make(chan struct{})
+
+	if pool.scheduler == "" {
+		pool.scheduler = SCHEDULER_PUSH
+	}
+
+	if err = pool.rpcServer.RegisterName("Master", &poolMaster{pool}); err != nil {
+		return nil, fmt.Errorf("failed to register RPC server: %w", err)
+	}
+
+	if pool.listener, err = net.Listen("tcp", hostname); err != nil {
+		return nil, fmt.Errorf("failed to start TCP server: %w", err)
+	}
+
+	log.Printf("Running Pool on %v (Scheduler: %v)\n", pool.listener.Addr(), pool.scheduler)
+
+	go pool.acceptMultipleConnections()
+	return pool, nil
+}
+
+// Run runs job on the workers of the Pool, along with the other jobs that are running.
+// Only the Task, Stages and StatusAddress of job are used, and every stage must have the
+// Name of a registered task. Jobs without a JobId get a new one, in Result.JobId, and
+// their intermediate files are removed once they're completed. A JobId can't be used by
+// two running jobs. The tasks of job aren't modified.
+func (pool *Pool) Run(ctx context.Context, job *Job) (result *Result, err error) {
+	var (
+		start  time.Time = time.Now()
+		tasks  []*Task
+		master *Master
+	)
+
+	if job.Task == nil {
+		return nil, errors.New("mapreduce: job without a task")
+	}
+
+	tasks = append([]*Task{job.Task}, job.Stages...)
+
+	for i, task := range tasks {
+		if task.Name == "" {
+			return nil, fmt.Errorf("mapreduce: stage %v: task without a name", i)
+		}
+	}
+
+	if taskScheduler(tasks[0]) != pool.scheduler {
+		return nil, fmt.Errorf("mapreduce: job uses the %v scheduler, pool uses %v", taskScheduler(tasks[0]), pool.scheduler)
+	}
+
+	if tasks, err = prepareStages(tasks, ""); err != nil {
+		return nil, fmt.Errorf("mapreduce: %w", err)
+	}
+
+	if err = checkMasterTasks(tasks); err != nil {
+		return nil, stageError(tasks, 0, err)
+	}
+
+	master = newMaster(ctx, pool.listener.Addr().String())
+	defer master.cancel()
+
+	// Settings of the whole job are taken from the first stage
+	master.task = tasks[0]
+	master.stages = tasks
+
+	if err = pool.start(master); err != nil {
+		return nil, err
+	}
+	defer pool.finish(master)
+
+	log.Printf("Running job '%v' (Stages: %v)\n", tasks[0].JobId, len(tasks))
+
+	if result, err = master.run(job.StatusAddress); err != nil {
+		return nil, err
+	}
+
+	result.JobId = tasks[0].JobId
+	result.Duration = time.Since(start)
+	return result, nil
+}
+
+// start adds the Master of a job to the running ones, and wakes up the workers waiting
+// for a job.
+func (pool *Pool) start(master *Master) error {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for _, running := range pool.masters {
+		if running.task.JobId == master.task.JobId {
+			return fmt.Errorf("mapreduce: job '%v' is already running", master.task.JobId)
+		}
+	}
+
+	pool.masters = append(pool.masters, master)
+	close(pool.next)
+	pool.next = make(chan struct{})
+	return nil
+}
+
+// finish removes the Master of a job from the running ones. The list is replaced, since
+// workers that register go through it without holding the mutex.
+func (pool *Pool) finish(master *Master) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	masters := make([]*Master, 0, len(pool.masters))
+	for _, running := range pool.masters {
+		if running != master {
+			masters = append(masters, running)
+		}
+	}
+	pool.masters = masters
+}
+
+// Close stops listening for workers. Jobs that are running aren't stopped.
+func (pool *Pool) Close() error {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	select {
+	case <-pool.closed:
+		return nil
+	default:
+	}
+
+	close(pool.closed)
+	return pool.listener.Close()
+}
+
+// Returns the Master of the running job jobId.
+func (pool *Pool) job(jobId string) (*Master, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for _, master := range pool.masters {
+		if master.task.JobId == jobId {
+			return master, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: '%v'", errNoJob, jobId)
+}
+
+// Returns the Master of the first running job that isn't over or one of jobIds, for
+// workers that register, waiting up to POOL_WAIT for one to start.
+func (pool *Pool) nextJob(jobIds []string) (*Master, error) {
+	var (
+		timeout <-chan time.Time = time.After(POOL_WAIT)
+		serving map[string]bool  = make(map[string]bool, len(jobIds))
+	)
+
+	for _, jobId := range jobIds {
+		serving[jobId] = true
+	}
+
+	for {
+		pool.mutex.Lock()
+		masters, next := pool.masters, pool.next
+		pool.mutex.Unlock()
+
+		for _, master := range masters {
+			if !serving[master.task.JobId] && !master.isOver() {
+				return master, nil
+			}
+		}
+
+		select {
+		case <-next:
+		case <-pool.closed:
+			return nil, errors.New("pool is closed")
+		case <-timeout:
+			return nil, fmt.Errorf("no job started for %v", POOL_WAIT)
+		}
+	}
+}
+
+// acceptMultipleConnections will handle the connections from multiple workers.
+func (pool *Pool) acceptMultipleConnections() {
+	for {
+		conn, err := pool.listener.Accept()
+		if err != nil {
+			break
+		}
+
+		go func() {
+			pool.rpcServer.ServeConn(conn)
+			conn.Close()
+		}()
+	}
+
+	log.Println("Stopped accepting connections.")
+}
+
+// RPC - Register
+// Registers the worker with its job if it's still running, or else with a job it doesn't
+// serve yet. Workers compare the job they get with theirs.
+func (p *poolMaster) Register(args *RegisterArgs, reply *RegisterReply) error {
+	master, err := p.pool.job(args.JobId)
+	if err != nil || master.isOver() {
+		master, err = p.pool.nextJob(append(args.Jobs, args.JobId))
+	}
+	if err != nil {
+		return err
+	}
+	return master.Register(args, reply)
+}
+
+// RPC - FetchInput
+func (p *poolMaster) FetchInput(args *FetchInputArgs, reply *FetchReply) error {
+	master, err := p.pool.job(args.JobId)
+	if err != nil {
+		return err
+	}
+	return master.FetchInput(args, reply)
+}
+
+// RPC - RequestTask
+func (p *poolMaster) RequestTask(args *RequestTaskArgs, reply *RequestTaskReply) error {
+	master, err := p.pool.job(args.JobId)
+	if err != nil {
+		return err
+	}
+	return master.RequestTask(args, reply)
+}
+
+// RPC - ReportTask
+func (p *poolMaster) ReportTask(args *ReportTaskArgs, _ *struct{}) error {
+	master, err := p.pool.job(args.JobId)
+	if err != nil {
+		return err
+	}
+	return master.ReportTask(args, nil)
+}
+
+// RPC - Heartbeat
+func (p *poolMaster) Heartbeat(args *HeartbeatArgs, _ *struct{}) error {
+	master, err := p.pool.job(args.JobId)
+	if err != nil {
+		return err
+	}
+	return master.Heartbeat(args, nil)
+}
+
+// RPC - Decommission
+// Workers can leave right away once their job is over.
+func (p *poolMaster) Decommission(args *DecommissionArgs, _ *struct{}) error {
+	master, err := p.pool.job(args.JobId)
+	if errors.Is(err, errNoJob) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return master.Decommission(args, nil)
+}
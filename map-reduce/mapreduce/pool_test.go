@@ -0,0 +1,92 @@
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Returns a Pool listening on a free port, closed at the end of the test.
+func newTestPool(t *testing.T) *Pool {
+	pool, err := StartPool("127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Close() })
+	return pool
+}
+
+// Returns the Master of a running job of pool with jobId.
+func startTestPoolJob(t *testing.T, pool *Pool, jobId string) *Master {
+	master := newMaster(context.Background(), "")
+	t.Cleanup(master.cancel)
+	master.task = &Task{JobId: jobId}
+
+	if err := pool.start(master); err != nil {
+		t.Fatal(err)
+	}
+	return master
+}
+
+// A JobId can't be used by two running jobs, and calls for a job that finished fail.
+func TestPoolJobs(t *testing.T) {
+	pool := newTestPool(t)
+	master := startTestPoolJob(t, pool, "job")
+
+	if err := pool.start(&Master{task: &Task{JobId: "job"}}); err == nil {
+		t.Error("a second job started with the same JobId")
+	}
+
+	if running, err := pool.job("job"); err != nil || running != master {
+		t.Errorf("job = %v, %v; want the running job", running, err)
+	}
+
+	pool.finish(master)
+	if _, err := pool.job("job"); !errors.Is(err, errNoJob) {
+		t.Errorf("job of a finished job = %v, want errNoJob", err)
+	}
+
+	if err := (&poolMaster{pool}).Decommission(&DecommissionArgs{JobId: "job"}, nil); err != nil {
+		t.Errorf("Decommission from a finished job = %v, want nil", err)
+	}
+}
+
+// Registering workers get a running job they don't serve yet, waiting for one to start.
+func TestPoolNextJob(t *testing.T) {
+	pool := newTestPool(t)
+	startTestPoolJob(t, pool, "served")
+
+	over := startTestPoolJob(t, pool, "over")
+	close(over.over)
+
+	next := make(chan *Master)
+	go func() {
+		master, err := pool.nextJob([]string{"served"})
+		if err != nil {
+			t.Error(err)
+		}
+		next <- master
+	}()
+
+	select {
+	case master := <-next:
+		t.Fatalf("nextJob = job '%v' before a new job started", master.task.JobId)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	started := startTestPoolJob(t, pool, "started")
+	select {
+	case master := <-next:
+		if master != started {
+			t.Errorf("nextJob = job '%v', want 'started'", master.task.JobId)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("nextJob didn't return once a job started")
+	}
+
+	pool.Close()
+	if _, err := pool.nextJob([]string{"served", "started"}); err == nil {
+		t.Error("nextJob returned a job after the pool was closed")
+	}
+}
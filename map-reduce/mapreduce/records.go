@@ -0,0 +1,204 @@
+package mapreduce
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// recordWriter writes records to a file using the codec and compression of the task.
+// Records are written to a temporary file that is only renamed to its final path
+// when the writer is closed, so readers never see partially written files.
+type recordWriter struct {
+	path       string
+	file       *os.File
+	compressor io.WriteCloser
+	buffer     *bufio.Writer
+	encoder    RecordEncoder
+}
+
+// recordReader reads records from a file using the codec and compression of the task.
+type recordReader struct {
+	file         io.Closer
+	decompressor io.ReadCloser
+	decoder      RecordDecoder
+}
+
+// Create a file to store records, that will be moved to path once it's closed.
+func createRecordFile(task *Task, path string) (writer *recordWriter, err error) {
+	writer = new(recordWriter)
+	writer.path = path
+
+	if writer.file, err = os.CreateTemp(filepath.Dir(path), tempFilePattern(path)); err != nil {
+		return nil, err
+	}
+
+	if writer.compressor, err = newCompressor(taskCompression(task), writer.file); err != nil {
+		writer.abort()
+		return nil, err
+	}
+
+	writer.buffer = bufio.NewWriter(writer.compressor)
+	writer.encoder = recordCodec(task).NewEncoder(writer.buffer)
+	return writer, nil
+}
+
+func (writer *recordWriter) write(kv *KeyValue) error {
+	return writer.encoder.Encode(kv)
+}
+
+// Flush buffered records, sync and close the file, and then commit it by renaming it
+// to its final path. If a previous attempt already committed the same path, it's
+// atomically replaced.
+func (writer *recordWriter) close() (err error) {
+	if err = writer.buffer.Flush(); err != nil {
+		writer.abort()
+		return err
+	}
+
+	if err = writer.compressor.Close(); err != nil {
+		writer.abort()
+		return err
+	}
+
+	if err = writer.file.Sync(); err != nil {
+		writer.abort()
+		return err
+	}
+
+	if err = writer.file.Close(); err != nil {
+		os.Remove(writer.file.Name())
+		return err
+	}
+
+	return os.Rename(writer.file.Name(), writer.path)
+}
+
+// Close and remove the temporary file without committing it.
+func (writer *recordWriter) abort() {
+	writer.file.Close()
+	os.Remove(writer.file.Name())
+}
+
+// Returns the pattern of temporary files created for path. They are hidden and
+// have a random suffix, so concurrent attempts never write to the same file.
+func tempFilePattern(path string) string {
+	return "." + filepath.Base(path) + ".tmp-*"
+}
+
+// commitDir moves a directory with the output of an attempt to path. Only the first
+// attempt to commit is kept: if path already exists, the directory is removed and
+// false is returned.
+func commitDir(dir string, path string) (bool, error) {
+	if err := os.Rename(dir, path); err != nil {
+		if _, statErr := os.Stat(path); statErr == nil {
+			os.RemoveAll(dir)
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Open a file at path to read records.
+func openRecordFile(task *Task, path string) (reader *recordReader, err error) {
+	var file *os.File
+
+	if file, err = os.Open(path); err != nil {
+		return nil, err
+	}
+
+	return newRecordReader(task, file)
+}
+
+// Read records from file. Closing the reader closes the file.
+func newRecordReader(task *Task, file io.ReadCloser) (reader *recordReader, err error) {
+	reader = new(recordReader)
+	reader.file = file
+
+	reader.decompressor, err = newDecompressor(taskCompression(task), bufio.NewReader(file))
+
+	if err == io.EOF {
+		// Empty file, there are no records to read
+		reader.decompressor = io.NopCloser(eofReader{})
+	} else if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	reader.decoder = recordCodec(task).NewDecoder(bufio.NewReader(reader.decompressor))
+	return reader, nil
+}
+
+// Open a file at path to read records. If it fails, it'll retry up to
+// OPEN_FILE_MAX_RETRY times, since the file may still be in transit.
+func openRecordFileWithRetry(task *Task, path string) (reader *recordReader, err error) {
+	for i := 0; i < OPEN_FILE_MAX_RETRY; i++ {
+		if reader, err = openRecordFile(task, path); err == nil {
+			return reader, nil
+		}
+		log.Printf("(%v/%v) Failed to open file %v. Retrying in 1 second...", i+1, OPEN_FILE_MAX_RETRY, path)
+		time.Sleep(time.Second)
+	}
+	return nil, err
+}
+
+// Read the next record into kv. Returns io.EOF when there are no records left.
+func (reader *recordReader) read(kv *KeyValue) error {
+	return reader.decoder.Decode(kv)
+}
+
+func (reader *recordReader) close() error {
+	reader.decompressor.Close()
+	return reader.file.Close()
+}
+
+// eofReader is an io.Reader that is always empty.
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+// Write a file at path atomically with write, using a temporary file like recordWriter does.
+func writeFileAtomic(path string, write func(file io.Writer) error) (err error) {
+	var file *os.File
+
+	if file, err = os.CreateTemp(filepath.Dir(path), tempFilePattern(path)); err != nil {
+		return err
+	}
+
+	if err = write(file); err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// Copy all the records from reader to writer.
+func copyRecords(writer *recordWriter, reader *recordReader) (err error) {
+	var kv KeyValue
+
+	for {
+		if err = reader.read(&kv); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if err = writer.write(&kv); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns the names of the files in dir.
+func dirNames(t *testing.T, dir string) (names []string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// Only the first attempt of a map operation to commit is kept, and attempts that fail
+// or are cancelled leave nothing behind.
+func TestMapCommit(t *testing.T) {
+	task := newTestWordCountTask(t, 1)
+
+	_, first := runTestMap(t, task, 0, "a b")
+	_, second := runTestMap(t, task, 0, "c d")
+
+	if fmt.Sprint(second) != fmt.Sprint(first) {
+		t.Errorf("output %v after a second attempt, want %v of the first one", second, first)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := mapLocal(ctx, task, 1, mapInput{data: []byte("a")}, new(Counters)); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled map returned %v", err)
+	}
+
+	task.Map = func([]byte) ([]KeyValue, error) { return nil, errors.New("map failed") }
+	if err := mapLocal(context.Background(), task, 2, mapInput{data: []byte("a")}, new(Counters)); err == nil {
+		t.Error("failed map returned no error")
+	}
+
+	if names := dirNames(t, task.ScratchPath()); fmt.Sprint(names) != "[map-0]" {
+		t.Errorf("scratch directory holds %v, want [map-0]", names)
+	}
+}
+
+// Files are only replaced once they were completely written.
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "result")
+
+	write := func(data string, err error) error {
+		return writeFileAtomic(path, func(file io.Writer) error {
+			if _, writeErr := io.WriteString(file, data); writeErr != nil {
+				return writeErr
+			}
+			return err
+		})
+	}
+
+	if err := write("first", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("partial", errors.New("write failed")); err == nil {
+		t.Error("failed write returned no error")
+	}
+
+	if data, err := os.ReadFile(path); err != nil || string(data) != "first" {
+		t.Errorf("file holds %q, %v after a failed write, want first", data, err)
+	}
+	if names := dirNames(t, dir); fmt.Sprint(names) != "[result]" {
+		t.Errorf("directory holds %v, want [result]", names)
+	}
+
+	if err := write("second", nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "second" {
+		t.Errorf("file holds %q, want second", data)
+	}
+}
+
+// Record files aren't visible at their path until they're closed, and aborted ones are
+// removed.
+func TestRecordWriterCommit(t *testing.T) {
+	dir := t.TempDir()
+	task := &Task{}
+
+	writer, err := createRecordFile(task, filepath.Join(dir, "aborted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.abort()
+
+	writer, err = createRecordFile(task, filepath.Join(dir, "closed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.write(&KeyValue{"a", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "closed")); err == nil {
+		t.Error("record file visible before it was closed")
+	}
+	if err = writer.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := dirNames(t, dir); fmt.Sprint(names) != "[closed]" {
+		t.Errorf("directory holds %v, want [closed]", names)
+	}
+}
@@ -0,0 +1,61 @@
+package mapreduce
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Pool workers don't get their tasks at startup, they serve jobs whose stages name one
+// of the tasks registered in the process with RegisterTask.
+
+var (
+	registryMutex sync.Mutex
+	registry      map[string]NewTaskFunc = make(map[string]NewTaskFunc)
+)
+
+// NewTaskFunc returns a new Task built with the Params of a stage.
+type NewTaskFunc func(params map[string]string) (*Task, error)
+
+// RegisterTask makes a task available to pool workers under name. newTask returns a
+// new Task with the MapReduce functions and the settings only workers use, like Input,
+// built with the Params of the stage on Master. The rest of the settings are taken
+// from Master. Registering a name again replaces it.
+func RegisterTask(name string, newTask NewTaskFunc) {
+	registryMutex.Lock()
+	registry[name] = newTask
+	registryMutex.Unlock()
+}
+
+// Returns a new Task registered under name, built with params.
+func registeredTask(name string, params map[string]string) (*Task, error) {
+	registryMutex.Lock()
+	newTask, ok := registry[name]
+	registryMutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown task '%v'", name)
+	}
+
+	task, err := newTask(params)
+	if err != nil {
+		return nil, fmt.Errorf("task '%v': %w", name, err)
+	}
+
+	task.Name = name
+	task.Params = params
+	return task, nil
+}
+
+// Returns the names of the registered tasks, in order.
+func registeredTaskNames() []string {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
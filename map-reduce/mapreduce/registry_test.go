@@ -0,0 +1,58 @@
+package mapreduce
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestRegisteredTaskParams(t *testing.T) {
+	RegisterTask("test-params", func(params map[string]string) (*Task, error) {
+		n, err := strconv.Atoi(params["n"])
+		if err != nil {
+			return nil, err
+		}
+		return &Task{NumReduceJobs: n}, nil
+	})
+
+	task, err := registeredTask("test-params", map[string]string{"n": "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Name != "test-params" || task.Params["n"] != "7" || task.NumReduceJobs != 7 {
+		t.Errorf("task = %+v, want one built with n = 7", task)
+	}
+
+	if _, err = registeredTask("test-params", nil); err == nil {
+		t.Error("task was built without its param")
+	}
+
+	if _, err = registeredTask("test-unknown", nil); err == nil {
+		t.Error("unknown task was built")
+	}
+}
+
+// Pool workers build their stages with the params of Master, not their own.
+func TestBuildStagesParams(t *testing.T) {
+	RegisterTask("test-stage", func(params map[string]string) (*Task, error) {
+		return &Task{Params: map[string]string{"local": "ignored"}}, nil
+	})
+
+	reply := &RegisterReply{
+		Scheduler: SCHEDULER_PULL,
+		Stages:    []StageSettings{{Name: "test-stage", Params: map[string]string{"n": "3"}, JobId: "job"}},
+	}
+
+	stages, err := buildStages(&Task{}, nil, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stages[0].Params["n"] != "3" || stages[0].Scheduler != SCHEDULER_PULL {
+		t.Errorf("stage = %+v, want the params and scheduler of Master", stages[0])
+	}
+
+	reply.Stages[0].Name = "test-unknown"
+	if _, err = buildStages(&Task{}, nil, reply); !errors.Is(err, ErrIncompatibleMaster) {
+		t.Errorf("unknown task failed with %v, want ErrIncompatibleMaster", err)
+	}
+}
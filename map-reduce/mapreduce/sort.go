@@ -0,0 +1,501 @@
+package mapreduce
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	DEFAULT_MERGE_FACTOR     = 64
+	DEFAULT_SORT_BUFFER_SIZE = 64 * 1024 * 1024
+
+	// Approximated memory used by a KeyValue besides the bytes of its strings.
+	KEYVALUE_OVERHEAD = 32
+)
+
+// recordStream is a source of KeyValue records that can be read only once.
+type recordStream interface {
+	// next returns the next record of the stream, or false when it's over.
+	next() (KeyValue, bool)
+
+	// err returns the error that ended the stream early, if any.
+	err() error
+
+	// close releases the stream before it's over.
+	close()
+}
+
+// sliceStream is a recordStream over records held in memory.
+type sliceStream struct {
+	data []KeyValue
+}
+
+func (stream *sliceStream) next() (kv KeyValue, ok bool) {
+	if len(stream.data) == 0 {
+		return kv, false
+	}
+
+	kv = stream.data[0]
+	stream.data = stream.data[1:]
+	return kv, true
+}
+
+func (stream *sliceStream) err() error { return nil }
+
+func (stream *sliceStream) close() { stream.data = nil }
+
+// fileStream is a recordStream over records stored in a file.
+type fileStream struct {
+	file    *recordReader
+	failure error
+}
+
+func openFileStream(task *Task, path string) (stream *fileStream, err error) {
+	stream = new(fileStream)
+
+	if stream.file, err = openRecordFile(task, path); err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (stream *fileStream) next() (kv KeyValue, ok bool) {
+	if stream.file == nil {
+		return kv, false
+	}
+
+	if err := stream.file.read(&kv); err != nil {
+		if err != io.EOF {
+			stream.failure = err
+		}
+
+		stream.close()
+		return kv, false
+	}
+
+	return kv, true
+}
+
+func (stream *fileStream) err() error { return stream.failure }
+
+func (stream *fileStream) close() {
+	if stream.file != nil {
+		stream.file.close()
+		stream.file = nil
+	}
+}
+
+// peekStream is a recordStream that can look at its next record before reading it.
+type peekStream struct {
+	recordStream
+	held    KeyValue
+	holding bool
+}
+
+// peek returns the record that next will return, or false when the stream is over.
+func (stream *peekStream) peek() (KeyValue, bool) {
+	if !stream.holding {
+		stream.held, stream.holding = stream.recordStream.next()
+	}
+	return stream.held, stream.holding
+}
+
+func (stream *peekStream) next() (KeyValue, bool) {
+	if stream.holding {
+		stream.holding = false
+		return stream.held, true
+	}
+	return stream.recordStream.next()
+}
+
+// mergeStream is a recordStream that merges multiple sorted streams into a
+// single sorted one. Records with the same key keep the order of their streams.
+type mergeStream struct {
+	items   mergeStreamHeap
+	failure error
+}
+
+type mergeStreamHeap []*mergeStreamItem
+
+type mergeStreamItem struct {
+	kv     KeyValue
+	index  int
+	stream recordStream
+}
+
+func newMergeStream(streams []recordStream) *mergeStream {
+	var merge *mergeStream
+
+	merge = new(mergeStream)
+	merge.items = make(mergeStreamHeap, 0, len(streams))
+
+	for i, stream := range streams {
+		if kv, ok := stream.next(); ok {
+			merge.items = append(merge.items, &mergeStreamItem{kv, i, stream})
+		} else if err := stream.err(); err != nil && merge.failure == nil {
+			merge.failure = err
+		}
+	}
+
+	// A stream that failed leaves the merge incomplete, so it's over already
+	if merge.failure != nil {
+		merge.close()
+	}
+
+	heap.Init(&merge.items)
+	return merge
+}
+
+func (merge *mergeStream) next() (kv KeyValue, ok bool) {
+	if len(merge.items) == 0 {
+		return kv, false
+	}
+
+	item := merge.items[0]
+	kv = item.kv
+
+	if item.kv, ok = item.stream.next(); ok {
+		heap.Fix(&merge.items, 0)
+	} else if merge.failure = item.stream.err(); merge.failure != nil {
+		merge.close()
+		return kv, false
+	} else {
+		heap.Pop(&merge.items)
+	}
+
+	return kv, true
+}
+
+func (merge *mergeStream) err() error { return merge.failure }
+
+func (merge *mergeStream) close() {
+	for _, item := range merge.items {
+		item.stream.close()
+	}
+	merge.items = nil
+}
+
+func (items mergeStreamHeap) Len() int { return len(items) }
+
+func (items mergeStreamHeap) Less(i, j int) bool {
+	if items[i].kv.Key == items[j].kv.Key {
+		return items[i].index < items[j].index
+	}
+	return items[i].kv.Key < items[j].kv.Key
+}
+
+func (items mergeStreamHeap) Swap(i, j int) { items[i], items[j] = items[j], items[i] }
+
+func (items *mergeStreamHeap) Push(x interface{}) { *items = append(*items, x.(*mergeStreamItem)) }
+
+func (items *mergeStreamHeap) Pop() interface{} {
+	old := *items
+	item := old[len(old)-1]
+	*items = old[:len(old)-1]
+	return item
+}
+
+// groupIterator is the Iterator handed to Reduce and Combine functions. It reads
+// values from the underlying stream until the key changes.
+type groupIterator struct {
+	key      string
+	first    *string // First value of the group, already read from the stream
+	stream   recordStream
+	pending  *KeyValue // First record after the group, if already read
+	done     bool
+	counters *Counters
+}
+
+func (iterator *groupIterator) Next() (value string, ok bool) {
+	if iterator.first != nil {
+		value, iterator.first = *iterator.first, nil
+		return value, true
+	}
+
+	if iterator.done {
+		return "", false
+	}
+
+	kv, ok := iterator.stream.next()
+
+	if !ok {
+		iterator.done = true
+		return "", false
+	}
+
+	if kv.Key != iterator.key {
+		iterator.done = true
+		iterator.pending = &kv
+		return "", false
+	}
+
+	return kv.Value, true
+}
+
+func (iterator *groupIterator) Counters() *Counters {
+	return iterator.counters
+}
+
+// Returns the size in bytes a record is expected to use in memory.
+func recordSize(kv *KeyValue) int {
+	return len(kv.Key) + len(kv.Value) + KEYVALUE_OVERHEAD
+}
+
+// Call reduceFunc once per key of a sorted stream and pass all the results to emit.
+// The user-defined counters it increments are added to counters. Stops at the first
+// error returned by reduceFunc, emit or the stream.
+func groupRecords(stream recordStream, reduceFunc func(string, Iterator) ([]KeyValue, error), emit func(KeyValue) error, counters *Counters) error {
+	var (
+		err     error
+		kv      KeyValue
+		ok      bool
+		results []KeyValue
+	)
+
+	kv, ok = stream.next()
+
+	for ok {
+		iterator := &groupIterator{key: kv.Key, first: &kv.Value, stream: stream, counters: counters}
+
+		if results, err = reduceFunc(kv.Key, iterator); err != nil {
+			return fmt.Errorf("key '%v': %w", kv.Key, err)
+		}
+
+		for _, result := range results {
+			if err = emit(result); err != nil {
+				return err
+			}
+		}
+
+		// Skip values the function didn't read
+		for _, more := iterator.Next(); more; _, more = iterator.Next() {
+		}
+
+		if iterator.pending == nil {
+			break
+		}
+
+		kv = *iterator.pending
+	}
+
+	return stream.err()
+}
+
+// Returns the name of the runs created while merging a reduce partition
+func mergeRunName(idReduce int, idRun int) string {
+	return fmt.Sprintf("reduce-%v-run-%v", idReduce, idRun)
+}
+
+// Returns the name of the directory with the merged runs of a reduce partition
+func mergeDirName(idReduce int) string {
+	return fmt.Sprintf("merge-%v", idReduce)
+}
+
+// Write the records of a stream to a new run file.
+func storeRun(task *Task, path string, stream recordStream) error {
+	var (
+		err  error
+		file *recordWriter
+	)
+
+	if file, err = createRecordFile(task, path); err != nil {
+		return err
+	}
+
+	for kv, ok := stream.next(); ok; kv, ok = stream.next() {
+		if err = file.write(&kv); err != nil {
+			file.abort()
+			return err
+		}
+	}
+
+	if err = stream.err(); err != nil {
+		file.abort()
+		return err
+	}
+
+	return file.close()
+}
+
+// Merge the map outputs of a reduce partition, which are already sorted, into a single
+// sorted stream. The first map outputs are read into memory while they fit in
+// task.SortBufferSize and merged without intermediate runs. Of the rest, at most
+// task.MergeFactor files are merged at once, so partitions with more map outputs are
+// merged in several passes into intermediate runs. The returned function closes the
+// stream and removes the runs, and should be called once the stream is consumed.
+func mergePartition(task *Task, idReduce int, paths []string) (recordStream, func(), error) {
+	var (
+		factor  int
+		loaded  []recordStream
+		runDir  string
+		runs    []string
+		numRuns int // Run names are unique across passes
+		stream  recordStream
+		err     error
+	)
+
+	if loaded, paths, err = loadPartition(task, paths); err != nil {
+		return nil, nil, err
+	}
+
+	factor = task.MergeFactor
+	if factor < 2 {
+		factor = DEFAULT_MERGE_FACTOR
+	}
+
+	removeRuns := func() {
+		if runDir != "" {
+			_ = os.RemoveAll(runDir)
+		}
+	}
+
+	for len(paths) > factor {
+		// Runs are private to this attempt, so concurrent attempts don't overwrite them
+		if runDir == "" {
+			if runDir, err = os.MkdirTemp(task.ScratchPath(), tempFilePattern(mergeDirName(idReduce))); err != nil {
+				return nil, nil, err
+			}
+			log.Printf("Merging reduce %v in several passes (%v files)\n", idReduce, len(paths))
+		}
+
+		runs = make([]string, 0, len(paths)/factor+1)
+
+		// Consecutive files are merged together so records with the same key keep
+		// the order of the map operations
+		for start := 0; start < len(paths); start += factor {
+			end := start + factor
+			if end > len(paths) {
+				end = len(paths)
+			}
+
+			runs = append(runs, filepath.Join(runDir, mergeRunName(idReduce, numRuns)))
+			numRuns++
+
+			if stream, err = openMergeStream(task, paths[start:end]); err == nil {
+				err = storeRun(task, runs[len(runs)-1], stream)
+			}
+
+			if err != nil {
+				removeRuns()
+				return nil, nil, err
+			}
+		}
+
+		paths = runs
+	}
+
+	if stream, err = openMergeStream(task, paths); err != nil {
+		removeRuns()
+		return nil, nil, err
+	}
+
+	// Loaded map outputs come first, so records with the same key keep their order
+	if len(loaded) > 0 {
+		stream = newMergeStream(append(loaded, stream))
+	}
+
+	return stream, func() {
+		stream.close()
+		removeRuns()
+	}, nil
+}
+
+// Read the map outputs at the start of paths into memory, in order, while their records
+// fit in task.SortBufferSize. Returns them and the paths that weren't read.
+func loadPartition(task *Task, paths []string) (loaded []recordStream, rest []string, err error) {
+	var (
+		budget int = task.SortBufferSize
+		used   int
+		reader *recordReader
+	)
+
+	if budget <= 0 {
+		budget = DEFAULT_SORT_BUFFER_SIZE
+	}
+
+	for i, path := range paths {
+		var (
+			data []KeyValue
+			kv   KeyValue
+		)
+
+		// Records use at least as much memory as their encoded size
+		if used+int(fileSize(path)) > budget {
+			return loaded, paths[i:], nil
+		}
+
+		if reader, err = openRecordFile(task, path); err != nil {
+			return nil, nil, err
+		}
+
+		for err = reader.read(&kv); err == nil && used <= budget; err = reader.read(&kv) {
+			data = append(data, kv)
+			used += recordSize(&kv)
+		}
+		reader.close()
+
+		if err == nil {
+			return loaded, paths[i:], nil
+		}
+		if err != io.EOF {
+			return nil, nil, err
+		}
+
+		loaded = append(loaded, &sliceStream{data})
+	}
+
+	return loaded, nil, nil
+}
+
+// Open all the files at paths and merge them into a single sorted stream.
+func openMergeStream(task *Task, paths []string) (recordStream, error) {
+	var streams []recordStream
+
+	streams = make([]recordStream, 0, len(paths))
+	for _, path := range paths {
+		stream, err := openFileStream(task, path)
+
+		if err != nil {
+			for _, stream := range streams {
+				stream.close()
+			}
+			return nil, err
+		}
+
+		streams = append(streams, stream)
+	}
+
+	return newMergeStream(streams), nil
+}
+
+// Merge, group and reduce the map outputs at paths of a reduce job, counting the bytes and
+// records it reads and its results in counters.
+func reduceLocal(task *Task, idReduce int, paths []string, counters *Counters) (result []KeyValue, err error) {
+	for _, path := range paths {
+		counters.Add(SHUFFLE_BYTES, fileSize(path))
+	}
+
+	stream, cleanup, err := mergePartition(task, idReduce, paths)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	result = make([]KeyValue, 0)
+	err = groupRecords(&countingStream{stream, counters, REDUCE_INPUT_RECORDS}, task.Reduce, func(kv KeyValue) error {
+		result = append(result, kv)
+		return nil
+	}, counters)
+
+	if err != nil {
+		return nil, fmt.Errorf("reduce %v: %w", idReduce, err)
+	}
+
+	counters.Add(REDUCE_OUTPUT_RECORDS, int64(len(result)))
+	return result, nil
+}
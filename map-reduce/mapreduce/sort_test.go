@@ -0,0 +1,94 @@
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// failingStream is a recordStream that fails after its records.
+type failingStream struct {
+	sliceStream
+	failure error
+}
+
+func (stream *failingStream) err() error {
+	if len(stream.data) == 0 {
+		return stream.failure
+	}
+	return nil
+}
+
+// Read the records of stream until it's over.
+func readStream(stream recordStream) (records []KeyValue) {
+	for {
+		kv, ok := stream.next()
+		if !ok {
+			return records
+		}
+		records = append(records, kv)
+	}
+}
+
+// Records of the same key must come out in the order of their streams, like sort.Stable
+// over the streams concatenated.
+func TestMergeStream(t *testing.T) {
+	var (
+		random  *rand.Rand = rand.New(rand.NewSource(1))
+		streams []recordStream
+		all     []KeyValue
+	)
+
+	for i := 0; i < 7; i++ {
+		records := make([]KeyValue, random.Intn(50))
+		for j := range records {
+			records[j] = KeyValue{fmt.Sprint(random.Intn(20)), fmt.Sprintf("stream %v, record %v", i, j)}
+		}
+		sort.SliceStable(records, func(a, b int) bool { return records[a].Key < records[b].Key })
+
+		all = append(all, records...)
+		streams = append(streams, &sliceStream{records})
+	}
+	streams = append(streams, &sliceStream{})
+
+	sort.SliceStable(all, func(a, b int) bool { return all[a].Key < all[b].Key })
+
+	merge := newMergeStream(streams)
+	got := readStream(merge)
+
+	if merge.err() != nil {
+		t.Fatal(merge.err())
+	}
+	if fmt.Sprint(got) != fmt.Sprint(all) {
+		t.Errorf("merged %v, want %v", got, all)
+	}
+}
+
+func TestMergeStreamFailure(t *testing.T) {
+	failure := errors.New("read failed")
+
+	merge := newMergeStream([]recordStream{
+		&sliceStream{[]KeyValue{{"a", "1"}, {"c", "1"}, {"e", "1"}}},
+		&failingStream{sliceStream{[]KeyValue{{"b", "2"}}}, failure},
+	})
+	got := readStream(merge)
+
+	if !errors.Is(merge.err(), failure) {
+		t.Errorf("merge ended with %v, want %v", merge.err(), failure)
+	}
+	if len(got) != 1 {
+		t.Errorf("merged %v before the failure, want a", got)
+	}
+
+	// A stream that fails before its first record fails the merge right away
+	merge = newMergeStream([]recordStream{
+		&sliceStream{[]KeyValue{{"a", "1"}}},
+		&failingStream{failure: failure},
+	})
+
+	if _, ok := merge.next(); ok || !errors.Is(merge.err(), failure) {
+		t.Errorf("merge of a failed stream = %v, %v", ok, merge.err())
+	}
+}
@@ -0,0 +1,253 @@
+package mapreduce
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	DEFAULT_MAP_BUFFER_SIZE = 32 * 1024 * 1024
+)
+
+// mapOutputBuffer holds the result of a map operation while it's partitioned.
+// Records are assigned to their reduce job once, when they are added. Whenever
+// the buffer goes over its memory budget, its records are sorted by partition and
+// key and spilled to disk, one sorted run per reduce job. When the buffer is closed
+// the runs of each reduce job are merged into the map operation's output files.
+// All the files are created in a directory private to the attempt, which is only
+// made visible when the buffer is committed.
+type mapOutputBuffer struct {
+	task     *Task
+	idMap    int
+	dir      string
+	counters *Counters
+
+	size    int
+	used    int
+	records []partitionedRecord
+
+	numSpills int
+}
+
+type partitionedRecord struct {
+	partition int
+	kv        KeyValue
+}
+
+// Returns the name of the runs spilled by a map operation
+func spillName(idMap int, idSpill int, idReduce int) string {
+	return fmt.Sprintf("spill-%v-%v-%v", idMap, idSpill, idReduce)
+}
+
+// Construct a new mapOutputBuffer for the map operation idMap, which counts the bytes it
+// spills in counters.
+func newMapOutputBuffer(task *Task, idMap int, counters *Counters) (buffer *mapOutputBuffer, err error) {
+	buffer = new(mapOutputBuffer)
+	buffer.task = task
+	buffer.idMap = idMap
+	buffer.counters = counters
+
+	if buffer.dir, err = os.MkdirTemp(task.ScratchPath(), tempFilePattern(mapOutputDir(idMap))); err != nil {
+		return nil, err
+	}
+
+	buffer.size = task.MapBufferSize
+	if buffer.size <= 0 {
+		buffer.size = DEFAULT_MAP_BUFFER_SIZE
+	}
+	buffer.records = make([]partitionedRecord, 0)
+	return buffer, nil
+}
+
+// Add a record to the buffer, spilling it to disk if it's full. Records that Shuffle
+// doesn't send to one of the reduce jobs fail the map operation.
+func (buffer *mapOutputBuffer) add(kv KeyValue) error {
+	partition, err := shufflePartition(buffer.task, kv.Key)
+	if err != nil {
+		return err
+	}
+
+	if partition < 0 || partition >= buffer.task.NumReduceJobs {
+		return fmt.Errorf("shuffle sent key '%v' to reduce job %v, there are %v", kv.Key, partition, buffer.task.NumReduceJobs)
+	}
+
+	buffer.records = append(buffer.records, partitionedRecord{partition, kv})
+	buffer.used += recordSize(&kv)
+
+	if buffer.used >= buffer.size {
+		return buffer.spill()
+	}
+	return nil
+}
+
+// Returns the reduce job Shuffle sends key to, or the error of a typed Shuffle.
+func shufflePartition(task *Task, key string) (int, error) {
+	if task.typedShuffle != nil {
+		return task.typedShuffle(task, key)
+	}
+	return task.Shuffle(task, key), nil
+}
+
+// Sort the buffered records by partition and key, so each partition is a
+// contiguous sorted run. Records with the same key keep their relative order.
+func (buffer *mapOutputBuffer) sort() {
+	sort.SliceStable(buffer.records, func(i, j int) bool {
+		if buffer.records[i].partition == buffer.records[j].partition {
+			return buffer.records[i].kv.Key < buffer.records[j].kv.Key
+		}
+		return buffer.records[i].partition < buffer.records[j].partition
+	})
+}
+
+// Write the buffered records of every partition to the files returned by pathFunc.
+// If the task defines a Combine function, records are combined before being written.
+func (buffer *mapOutputBuffer) store(pathFunc func(idReduce int) string) error {
+	var (
+		start int
+		end   int
+		data  []KeyValue
+	)
+
+	buffer.sort()
+
+	data = make([]KeyValue, 0)
+
+	for r := 0; r < buffer.task.NumReduceJobs; r++ {
+		data = data[:0]
+		for end = start; end < len(buffer.records) && buffer.records[end].partition == r; end++ {
+			data = append(data, buffer.records[end].kv)
+		}
+		start = end
+
+		if err := storeStream(buffer.task, pathFunc(r), &sliceStream{data}, buffer.counters); err != nil {
+			return err
+		}
+	}
+
+	buffer.records = buffer.records[:0]
+	buffer.used = 0
+	return nil
+}
+
+// Spill the buffered records to disk.
+func (buffer *mapOutputBuffer) spill() error {
+	var idSpill int = buffer.numSpills
+
+	log.Printf("Spilling map %v (spill %v, %v records)\n", buffer.idMap, idSpill, len(buffer.records))
+
+	err := buffer.store(func(idReduce int) string {
+		return filepath.Join(buffer.dir, spillName(buffer.idMap, idSpill, idReduce))
+	})
+	buffer.numSpills++
+
+	for r := 0; r < buffer.task.NumReduceJobs && err == nil; r++ {
+		buffer.counters.Add(SPILLED_BYTES, fileSize(filepath.Join(buffer.dir, spillName(buffer.idMap, idSpill, r))))
+	}
+	return err
+}
+
+// Flush the buffer into the output files of the map operation. If records were
+// spilled, the runs of each partition are merged and removed.
+func (buffer *mapOutputBuffer) close() error {
+	var (
+		err    error
+		runs   []string
+		stream recordStream
+	)
+
+	if buffer.numSpills == 0 {
+		return buffer.store(func(idReduce int) string {
+			return filepath.Join(buffer.dir, reduceName(buffer.idMap, idReduce))
+		})
+	}
+
+	if len(buffer.records) > 0 {
+		if err = buffer.spill(); err != nil {
+			return err
+		}
+	}
+
+	for r := 0; r < buffer.task.NumReduceJobs; r++ {
+		runs = make([]string, 0, buffer.numSpills)
+		for s := 0; s < buffer.numSpills; s++ {
+			runs = append(runs, filepath.Join(buffer.dir, spillName(buffer.idMap, s, r)))
+		}
+
+		if stream, err = openMergeStream(buffer.task, runs); err != nil {
+			return err
+		}
+
+		if err = storeStream(buffer.task, filepath.Join(buffer.dir, reduceName(buffer.idMap, r)), stream, buffer.counters); err != nil {
+			stream.close()
+			return err
+		}
+
+		for _, path := range runs {
+			if err = os.Remove(path); err != nil {
+				log.Println("Failed to remove spill file. Error:", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Commit the output files of the map operation, so they become visible to the reduce
+// phase. If another attempt of the same operation already committed, this attempt's
+// files are discarded.
+func (buffer *mapOutputBuffer) commit() error {
+	committed, err := commitDir(buffer.dir, filepath.Join(buffer.task.ScratchPath(), mapOutputDir(buffer.idMap)))
+
+	if err != nil {
+		return err
+	}
+
+	if !committed {
+		log.Printf("Map %v was already committed by another attempt. Discarding output.\n", buffer.idMap)
+	}
+	return nil
+}
+
+// Remove the files of an attempt that won't be committed.
+func (buffer *mapOutputBuffer) discard() {
+	_ = os.RemoveAll(buffer.dir)
+}
+
+// Write a sorted stream of records to path. If the task defines a Combine function,
+// records with the same key are combined before being written, with the user-defined
+// counters it increments added to counters.
+func storeStream(task *Task, path string, stream recordStream, counters *Counters) (err error) {
+	var (
+		file   *recordWriter
+		encode func(KeyValue) error
+	)
+
+	if file, err = createRecordFile(task, path); err != nil {
+		return err
+	}
+
+	encode = func(kv KeyValue) error {
+		return file.write(&kv)
+	}
+
+	if task.Combine != nil {
+		err = groupRecords(stream, task.Combine, encode, counters)
+	} else {
+		for kv, ok := stream.next(); ok && err == nil; kv, ok = stream.next() {
+			err = encode(kv)
+		}
+		if err == nil {
+			err = stream.err()
+		}
+	}
+
+	if err != nil {
+		file.abort()
+		return err
+	}
+
+	return file.close()
+}
@@ -0,0 +1,205 @@
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Returns a word count task whose map operations read lines of words and emit 1 for
+// each, with a Reduce that sums them up.
+func newTestWordCountTask(t *testing.T, numReduceJobs int) *Task {
+	task := &Task{
+		JobId:         "job",
+		ScratchDir:    t.TempDir(),
+		OutputDir:     t.TempDir(),
+		NumReduceJobs: numReduceJobs,
+		Map: func(data []byte) (result []KeyValue, err error) {
+			for _, word := range strings.Fields(string(data)) {
+				result = append(result, KeyValue{word, "1"})
+			}
+			return result, nil
+		},
+		Shuffle: func(task *Task, key string) int {
+			return int(key[0]) % task.NumReduceJobs
+		},
+		Reduce: testSumFunc,
+	}
+
+	if err := createWorkDirs(task); err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+func testSumFunc(key string, values Iterator) ([]KeyValue, error) {
+	var sum int
+
+	for value, ok := values.Next(); ok; value, ok = values.Next() {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		sum += n
+	}
+
+	return []KeyValue{{key, strconv.Itoa(sum)}}, nil
+}
+
+// Runs a map operation of task on data and returns the records of each of its output
+// files.
+func runTestMap(t *testing.T, task *Task, idMap int, data string) (counters *Counters, partitions [][]KeyValue) {
+	counters = new(Counters)
+
+	if err := mapLocal(context.Background(), task, idMap, mapInput{data: []byte(data)}, counters); err != nil {
+		t.Fatal(err)
+	}
+
+	for r := 0; r < task.NumReduceJobs; r++ {
+		stream, err := openFileStream(task, mapOutputPath(task, idMap, r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		partitions = append(partitions, readStream(stream))
+		if err = stream.err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return counters, partitions
+}
+
+// Returns the total size of the output files of a map operation.
+func mapOutputSize(task *Task, idMap int) (size int64) {
+	for r := 0; r < task.NumReduceJobs; r++ {
+		size += fileSize(mapOutputPath(task, idMap, r))
+	}
+	return size
+}
+
+// The records of each map output file are combined by key, and the files get smaller.
+func TestMapCombine(t *testing.T) {
+	const input = "b a c a b a\nc a d"
+
+	plain := newTestWordCountTask(t, 2)
+	_, _ = runTestMap(t, plain, 0, input)
+
+	combined := newTestWordCountTask(t, 2)
+	combined.Combine = testSumFunc
+	_, partitions := runTestMap(t, combined, 0, input)
+
+	expected := [][]KeyValue{{{"b", "2"}, {"d", "1"}}, {{"a", "4"}, {"c", "2"}}}
+	for r := range expected {
+		if fmt.Sprint(partitions[r]) != fmt.Sprint(expected[r]) {
+			t.Errorf("partition %v = %v, want %v", r, partitions[r], expected[r])
+		}
+	}
+
+	if mapOutputSize(combined, 0) >= mapOutputSize(plain, 0) {
+		t.Errorf("combined output of %v bytes, %v without Combine", mapOutputSize(combined, 0), mapOutputSize(plain, 0))
+	}
+}
+
+// Records for which Combine returns nothing are dropped, and its errors fail the map
+// operation without committing it.
+func TestMapCombineErrors(t *testing.T) {
+	task := newTestWordCountTask(t, 1)
+	task.Combine = func(key string, values Iterator) ([]KeyValue, error) {
+		if key == "skip" {
+			return nil, nil
+		}
+		return testSumFunc(key, values)
+	}
+
+	if _, partitions := runTestMap(t, task, 0, "skip a skip"); fmt.Sprint(partitions[0]) != "[{a 1}]" {
+		t.Errorf("partition = %v, want [{a 1}]", partitions[0])
+	}
+
+	task.Combine = func(key string, values Iterator) ([]KeyValue, error) {
+		return nil, errors.New("combine failed")
+	}
+
+	if err := mapLocal(context.Background(), task, 1, mapInput{data: []byte("a")}, new(Counters)); err == nil {
+		t.Error("map succeeded with a failing Combine")
+	}
+	if _, err := os.Stat(mapOutputPath(task, 1, 0)); err == nil {
+		t.Error("output of the failed map was committed")
+	}
+}
+
+// A map operation whose result doesn't fit in MapBufferSize spills it in sorted runs,
+// merged into the same output files as when it fits.
+func TestMapSpill(t *testing.T) {
+	var words []string
+	for i := 0; i < 500; i++ {
+		words = append(words, fmt.Sprintf("w%03d", (i*37)%101))
+	}
+	input := strings.Join(words, " ")
+
+	for _, combine := range []bool{false, true} {
+		inMemory := newTestWordCountTask(t, 3)
+		spilled := newTestWordCountTask(t, 3)
+		spilled.MapBufferSize = 256
+
+		if combine {
+			inMemory.Combine = testSumFunc
+			spilled.Combine = testSumFunc
+		}
+
+		memoryCounters, expected := runTestMap(t, inMemory, 0, input)
+		counters, partitions := runTestMap(t, spilled, 0, input)
+
+		if memoryCounters.Get(SPILLED_BYTES) != 0 {
+			t.Errorf("combine %v: spilled %v bytes with the default buffer", combine, memoryCounters.Get(SPILLED_BYTES))
+		}
+		if counters.Get(SPILLED_BYTES) == 0 {
+			t.Errorf("combine %v: nothing spilled with a %v byte buffer", combine, spilled.MapBufferSize)
+		}
+		if fmt.Sprint(partitions) != fmt.Sprint(expected) {
+			t.Errorf("combine %v: spilled output %v, want %v", combine, partitions, expected)
+		}
+
+		// Only the output files are committed
+		entries, err := os.ReadDir(filepath.Join(spilled.ScratchPath(), mapOutputDir(0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != spilled.NumReduceJobs {
+			t.Errorf("combine %v: %v files committed, want %v", combine, len(entries), spilled.NumReduceJobs)
+		}
+	}
+}
+
+// Records are emitted one at a time with MapEmit, and one that Shuffle sends to a
+// reduce job that doesn't exist fails Emit and the operation.
+func TestMapEmit(t *testing.T) {
+	task := newTestWordCountTask(t, 2)
+	task.Map = nil
+	task.MapBufferSize = 64
+	task.MapEmit = func(data []byte, emitter Emitter) error {
+		for _, word := range strings.Fields(string(data)) {
+			emitter.Counters().Add("WORDS", 1)
+			if err := emitter.Emit(KeyValue{word, "1"}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	counters, partitions := runTestMap(t, task, 0, "b a c a b a c a d")
+	if fmt.Sprint(partitions) != "[[{b 1} {b 1} {d 1}] [{a 1} {a 1} {a 1} {a 1} {c 1} {c 1}]]" {
+		t.Errorf("output %v", partitions)
+	}
+	if counters.Get("WORDS") != 9 || counters.Get(MAP_OUTPUT_RECORDS) != 9 {
+		t.Errorf("counted %v words and %v map output records, want 9", counters.Get("WORDS"), counters.Get(MAP_OUTPUT_RECORDS))
+	}
+
+	task.Shuffle = func(task *Task, key string) int { return task.NumReduceJobs }
+	if err := mapLocal(context.Background(), task, 1, mapInput{data: []byte("a")}, new(Counters)); err == nil {
+		t.Error("map succeeded emitting a record for a reduce job that doesn't exist")
+	}
+}
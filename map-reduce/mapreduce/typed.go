@@ -0,0 +1,304 @@
+package mapreduce
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+)
+
+// TypedTask defines the functions of a Task over typed keys and values. Map functions
+// emit pairs of K and V, which Combine and Reduce functions receive, and Reduce
+// functions emit pairs of OK and OV, the output of the job. Serializers convert them to
+// and from the strings of KeyValue, so Reduce functions receive keys sorted by their
+// encoding.
+type TypedTask[K, V, OK, OV any] struct {
+	// MapReduce functions. Like in Task, MapRecords replaces Map when the input is read
+	// as records.
+	Map        func([]byte) ([]Pair[K, V], error)
+	MapRecords func([]KeyValue) ([]Pair[K, V], error)
+	Combine    func(K, TypedIterator[V]) ([]Pair[K, V], error) // Optional
+	Reduce     func(K, TypedIterator[V]) ([]Pair[OK, OV], error)
+
+	// Optional, replace Map and MapRecords like in Task
+	MapEmit        func([]byte, TypedEmitter[K, V]) error
+	MapRecordsEmit func([]KeyValue, TypedEmitter[K, V]) error
+
+	// Optional, nil = hash of the encoded key
+	Shuffle func(*Task, K) int
+
+	// Optional, nil = chosen by type (see SerializerFor)
+	KeySerializer         Serializer[K]
+	ValueSerializer       Serializer[V]
+	OutputKeySerializer   Serializer[OK]
+	OutputValueSerializer Serializer[OV]
+}
+
+// Pair is a typed KeyValue.
+type Pair[K, V any] struct {
+	Key   K
+	Value V
+}
+
+// TypedIterator goes through the decoded values of a single key.
+type TypedIterator[V any] interface {
+	// Next returns the next value of the key, or false when there are no values left.
+	Next() (V, bool)
+
+	// Counters returns the user-defined counters of the operation, see Counters.
+	Counters() *Counters
+}
+
+// TypedEmitter receives the typed pairs of a map operation, like Emitter.
+type TypedEmitter[K, V any] interface {
+	Emit(Pair[K, V]) error
+
+	// Counters returns the user-defined counters of the operation, see Counters.
+	Counters() *Counters
+}
+
+// Serializer converts values to and from the strings held by KeyValue.
+type Serializer[T any] interface {
+	Encode(T) (string, error)
+	Decode(string) (T, error)
+}
+
+// StringSerializer keeps strings as they are.
+type StringSerializer struct{}
+
+func (StringSerializer) Encode(value string) (string, error) { return value, nil }
+
+func (StringSerializer) Decode(data string) (string, error) { return data, nil }
+
+// IntSerializer writes integers in decimal.
+type IntSerializer struct{}
+
+func (IntSerializer) Encode(value int) (string, error) { return strconv.Itoa(value), nil }
+
+func (IntSerializer) Decode(data string) (int, error) { return strconv.Atoi(data) }
+
+// Float64Serializer writes floats in the shortest decimal form that reads back the
+// same value.
+type Float64Serializer struct{}
+
+func (Float64Serializer) Encode(value float64) (string, error) {
+	return strconv.FormatFloat(value, 'g', -1, 64), nil
+}
+
+func (Float64Serializer) Decode(data string) (float64, error) {
+	return strconv.ParseFloat(data, 64)
+}
+
+// JSONSerializer encodes values as JSON.
+type JSONSerializer[T any] struct{}
+
+func (JSONSerializer[T]) Encode(value T) (string, error) {
+	data, err := json.Marshal(value)
+	return string(data), err
+}
+
+func (JSONSerializer[T]) Decode(data string) (value T, err error) {
+	err = json.Unmarshal([]byte(data), &value)
+	return value, err
+}
+
+// SerializerFor returns serializer, or if it's nil the default one for T:
+// StringSerializer, IntSerializer, Float64Serializer or else JSONSerializer.
+func SerializerFor[T any](serializer Serializer[T]) Serializer[T] {
+	var zero T
+
+	if serializer != nil {
+		return serializer
+	}
+
+	switch any(zero).(type) {
+	case string:
+		return any(StringSerializer{}).(Serializer[T])
+	case int:
+		return any(IntSerializer{}).(Serializer[T])
+	case float64:
+		return any(Float64Serializer{}).(Serializer[T])
+	}
+
+	return JSONSerializer[T]{}
+}
+
+// Apply sets the functions of task to the typed functions, wrapped to encode and decode
+// their keys and values, and returns task.
+func (typed *TypedTask[K, V, OK, OV]) Apply(task *Task) *Task {
+	var (
+		keys         Serializer[K]  = SerializerFor(typed.KeySerializer)
+		values       Serializer[V]  = SerializerFor(typed.ValueSerializer)
+		outputKeys   Serializer[OK] = SerializerFor(typed.OutputKeySerializer)
+		outputValues Serializer[OV] = SerializerFor(typed.OutputValueSerializer)
+	)
+
+	task.Map = nil
+	if typed.Map != nil {
+		task.Map = func(input []byte) ([]KeyValue, error) {
+			pairs, err := typed.Map(input)
+			if err != nil {
+				return nil, err
+			}
+			return encodePairs(pairs, keys, values)
+		}
+	}
+
+	task.MapRecords = nil
+	if typed.MapRecords != nil {
+		task.MapRecords = func(input []KeyValue) ([]KeyValue, error) {
+			pairs, err := typed.MapRecords(input)
+			if err != nil {
+				return nil, err
+			}
+			return encodePairs(pairs, keys, values)
+		}
+	}
+
+	task.MapEmit = nil
+	if typed.MapEmit != nil {
+		task.MapEmit = func(input []byte, emitter Emitter) error {
+			return typed.MapEmit(input, &typedEmitter[K, V]{emitter, keys, values})
+		}
+	}
+
+	task.MapRecordsEmit = nil
+	if typed.MapRecordsEmit != nil {
+		task.MapRecordsEmit = func(input []KeyValue, emitter Emitter) error {
+			return typed.MapRecordsEmit(input, &typedEmitter[K, V]{emitter, keys, values})
+		}
+	}
+
+	task.Combine = nil
+	if typed.Combine != nil {
+		task.Combine = CombineFunc(typedReduce(typed.Combine, keys, values, keys, values))
+	}
+
+	task.Reduce = typedReduce(typed.Reduce, keys, values, outputKeys, outputValues)
+
+	task.typedShuffle = func(task *Task, key string) (int, error) {
+		if typed.Shuffle == nil {
+			return hashShuffle(task, key), nil
+		}
+
+		decoded, err := keys.Decode(key)
+		if err != nil {
+			return -1, fmt.Errorf("shuffle failed to decode key '%v': %w", key, err)
+		}
+		return typed.Shuffle(task, decoded), nil
+	}
+
+	// Keys that can't be decoded are sent to a reduce job that doesn't exist
+	task.Shuffle = func(task *Task, key string) int {
+		partition, _ := task.typedShuffle(task, key)
+		return partition
+	}
+
+	return task
+}
+
+// Send a key to a reduce job by its hash.
+func hashShuffle(task *Task, key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(task.NumReduceJobs))
+}
+
+// Encode typed pairs as KeyValues.
+func encodePairs[K, V any](pairs []Pair[K, V], keys Serializer[K], values Serializer[V]) (result []KeyValue, err error) {
+	result = make([]KeyValue, len(pairs))
+
+	for i, pair := range pairs {
+		if result[i].Key, err = keys.Encode(pair.Key); err != nil {
+			return nil, err
+		}
+		if result[i].Value, err = values.Encode(pair.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// typedEmitter encodes typed pairs and passes them on to an Emitter.
+type typedEmitter[K, V any] struct {
+	emitter Emitter
+	keys    Serializer[K]
+	values  Serializer[V]
+}
+
+func (emitter *typedEmitter[K, V]) Emit(pair Pair[K, V]) (err error) {
+	var kv KeyValue
+
+	if kv.Key, err = emitter.keys.Encode(pair.Key); err != nil {
+		return err
+	}
+	if kv.Value, err = emitter.values.Encode(pair.Value); err != nil {
+		return err
+	}
+
+	return emitter.emitter.Emit(kv)
+}
+
+func (emitter *typedEmitter[K, V]) Counters() *Counters {
+	return emitter.emitter.Counters()
+}
+
+// Returns a ReduceFunc that calls a typed Combine or Reduce function.
+func typedReduce[K, V, OK, OV any](reduce func(K, TypedIterator[V]) ([]Pair[OK, OV], error),
+	keys Serializer[K], values Serializer[V], outputKeys Serializer[OK], outputValues Serializer[OV]) ReduceFunc {
+	return func(key string, iterator Iterator) ([]KeyValue, error) {
+		var (
+			decodedKey  K
+			pairs       []Pair[OK, OV]
+			err         error
+			typedValues *typedIterator[V] = &typedIterator[V]{iterator: iterator, values: values}
+		)
+
+		if decodedKey, err = keys.Decode(key); err != nil {
+			return nil, fmt.Errorf("key '%v': %w", key, err)
+		}
+
+		pairs, err = reduce(decodedKey, typedValues)
+
+		// A value that couldn't be decoded ended the iteration early
+		if typedValues.failure != nil {
+			return nil, fmt.Errorf("key '%v': %w", key, typedValues.failure)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return encodePairs(pairs, outputKeys, outputValues)
+	}
+}
+
+// typedIterator decodes the values of an Iterator.
+type typedIterator[V any] struct {
+	iterator Iterator
+	values   Serializer[V]
+	failure  error
+}
+
+func (iterator *typedIterator[V]) Next() (value V, ok bool) {
+	var data string
+
+	if iterator.failure != nil {
+		return value, false
+	}
+
+	if data, ok = iterator.iterator.Next(); !ok {
+		return value, false
+	}
+
+	if value, iterator.failure = iterator.values.Decode(data); iterator.failure != nil {
+		return value, false
+	}
+
+	return value, true
+}
+
+func (iterator *typedIterator[V]) Counters() *Counters {
+	return iterator.iterator.Counters()
+}
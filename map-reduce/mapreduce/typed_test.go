@@ -0,0 +1,119 @@
+package mapreduce
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type testPoint struct {
+	X, Y int
+}
+
+// Serializers read back the values they write, and SerializerFor picks one by type.
+func TestSerializers(t *testing.T) {
+	for _, value := range []string{"", "word", "tab\t"} {
+		data, _ := SerializerFor[string](nil).Encode(value)
+		if decoded, err := SerializerFor[string](nil).Decode(data); err != nil || decoded != value {
+			t.Errorf("string: read %q back as %q, %v", value, decoded, err)
+		}
+	}
+
+	for _, value := range []int{0, -1, 1 << 40} {
+		data, _ := SerializerFor[int](nil).Encode(value)
+		if decoded, err := SerializerFor[int](nil).Decode(data); err != nil || decoded != value {
+			t.Errorf("int: read %v back as %v, %v", value, decoded, err)
+		}
+	}
+
+	for _, value := range []float64{0, 0.1, -1e300} {
+		data, _ := SerializerFor[float64](nil).Encode(value)
+		if decoded, err := SerializerFor[float64](nil).Decode(data); err != nil || decoded != value {
+			t.Errorf("float64: read %v back as %v, %v", value, decoded, err)
+		}
+	}
+
+	points := SerializerFor[testPoint](nil)
+	if _, ok := points.(JSONSerializer[testPoint]); !ok {
+		t.Errorf("SerializerFor(testPoint) = %T, want JSONSerializer", points)
+	}
+	data, _ := points.Encode(testPoint{1, 2})
+	if decoded, err := points.Decode(data); err != nil || decoded != (testPoint{1, 2}) {
+		t.Errorf("testPoint: read %q back as %v, %v", data, decoded, err)
+	}
+
+	if _, err := SerializerFor[int](nil).Decode("one"); err == nil {
+		t.Error("decoded \"one\" as an int")
+	}
+}
+
+// A typed task runs like the Task it's applied to, with its keys and values encoded
+// by their serializers.
+func TestTypedTask(t *testing.T) {
+	typed := &TypedTask[int, string, int, []string]{
+		Map: func(data []byte) (pairs []Pair[int, string], err error) {
+			for _, word := range strings.Fields(string(data)) {
+				pairs = append(pairs, Pair[int, string]{len(word), word})
+			}
+			return pairs, nil
+		},
+		Shuffle: func(task *Task, length int) int { return length % task.NumReduceJobs },
+		Reduce: func(length int, words TypedIterator[string]) ([]Pair[int, []string], error) {
+			var all []string
+			for word, ok := words.Next(); ok; word, ok = words.Next() {
+				all = append(all, word)
+			}
+			return []Pair[int, []string]{{length * 10, all}}, nil
+		},
+	}
+
+	task := typed.Apply(newTestWordCountTask(t, 2))
+
+	_, partitions, err := runTestJob(context.Background(), &Job{Task: task, Mode: JOB_SEQUENTIAL}, []string{"a bb ccc", "dd e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `[[{20 ["bb","dd"]}] [{10 ["a","e"]} {30 ["ccc"]}]]`
+	if fmt.Sprint(partitions) != want {
+		t.Errorf("sent %v, want %v", partitions, want)
+	}
+}
+
+// Values that can't be decoded fail the operation with the key they belong to.
+func TestTypedTaskDecodeErrors(t *testing.T) {
+	typed := &TypedTask[string, int, string, int]{
+		Map: func(data []byte) ([]Pair[string, int], error) {
+			return []Pair[string, int]{{string(data), 1}}, nil
+		},
+		Reduce: func(key string, values TypedIterator[int]) ([]Pair[string, int], error) {
+			for _, ok := values.Next(); ok; _, ok = values.Next() {
+			}
+			return []Pair[string, int]{{key, 0}}, nil
+		},
+	}
+
+	task := typed.Apply(newTestWordCountTask(t, 1))
+	reduce := task.Reduce
+	task.Reduce = func(key string, values Iterator) ([]KeyValue, error) {
+		return reduce(key, &testBadIterator{values})
+	}
+
+	_, _, err := runTestJob(context.Background(), &Job{Task: task, Mode: JOB_SEQUENTIAL}, []string{"word"})
+	if err == nil || !strings.Contains(err.Error(), "key 'word'") {
+		t.Errorf("job returned %v, want a decoding error of key 'word'", err)
+	}
+}
+
+// testBadIterator returns a value that isn't an int after the values of an Iterator.
+type testBadIterator struct {
+	Iterator
+}
+
+func (iterator *testBadIterator) Next() (string, bool) {
+	if value, ok := iterator.Iterator.Next(); ok {
+		return value, true
+	}
+	return "one", true
+}
@@ -1,53 +1,307 @@
 package mapreduce
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/rpc"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrIncompatibleMaster is returned when a worker can't run operations with the
+// settings of the Master it registers with.
+var ErrIncompatibleMaster = errors.New("incompatible master")
+
+// errJobChanged is returned when the session of a pool worker registers again and its
+// job is over. The pool worker serves the other jobs with new sessions.
+var errJobChanged = errors.New("job changed")
+
 type Worker struct {
 	id int
 
 	// Network
 	hostname       string
 	masterHostname string
+	slots          int // Number of operations Master can run at once on this worker
 	listener       net.Listener
 	rpcServer      *rpc.Server
 
-	// Operation
-	task *Task
-	done chan bool
+	// Operation. task and stages are replaced as a whole when the worker registers,
+	// while operations keep the tasks they started with. Guarded by stagesMutex.
+	stagesMutex sync.Mutex
+	task        *Task   // First stage, which holds the settings of the whole job
+	stages      []*Task // Every stage of the job
+
+	// Directories of the map outputs committed by this worker process, by path. Guarded
+	// by stagesMutex.
+	committedMaps map[string]bool
+
+	pool     *poolWorker     // Set on the sessions of a pool worker, see poolWorker
+	ctx      context.Context // Cancelled when the worker is stopped
+	done     chan bool
+	doneOnce sync.Once
+	failed   chan error // Errors that stop the worker
+	draining int32      // Set atomically once the worker is being decommissioned
+
+	// Completed operations, updated atomically, and their counters
+	numMapOperations    int64
+	numReduceOperations int64
+	counters            Counters
+
+	// Master liveness, updated on every heartbeat
+	masterMutex      sync.Mutex
+	lastPing         time.Time
+	heartbeatTimeout time.Duration
 
-	// Induced failures
-	taskCounter int
-	nOps        int
+	// With SCHEDULER_PULL, the connection every call to Master goes through and how
+	// often to send heartbeats on it. Guarded by masterMutex, like id.
+	client            *rpc.Client
+	heartbeatInterval time.Duration
+
+	// Induced failures. Operations run concurrently, so taskCounter is updated atomically
+	taskCounter int64
+	nOps        int64
 }
 
 // Call RPC Register on Master to notify that this worker is ready to receive operations.
 func (worker *Worker) register() error {
 	var (
-		err   error
-		args  *RegisterArgs
-		reply *RegisterReply
+		err    error
+		args   *RegisterArgs
+		reply  *RegisterReply
+		task   *Task
+		stages []*Task
 	)
 
 	log.Println("Registering with Master")
 
+	task, stages = worker.currentStages()
+
+	// Registering starts a new connection, so operations pulled before can't be
+	// reported to a Master that restarted
+	if taskScheduler(task) == SCHEDULER_PULL {
+		if err = worker.connect(); err != nil {
+			return err
+		}
+	}
+
 	args = new(RegisterArgs)
 	args.WorkerHostname = worker.hostname
+	args.Slots = worker.slots
+	args.Scheduler = taskScheduler(task)
+	args.LocalInputs = localInputs(task)
+
+	if worker.pool != nil {
+		args.Pool = true
+		args.Tasks = registeredTaskNames()
+		args.JobId = task.JobId
+		args.Jobs = worker.pool.jobIds()
+	}
 
 	reply = new(RegisterReply)
 
 	err = worker.callMaster("Master.Register", args, reply)
 
-	if err == nil {
-		worker.id = reply.WorkerId
-		worker.task.NumReduceJobs = reply.ReduceJobs
-		log.Printf("Registered. WorkerId: %v (Settings = (ReduceJobs: %v))\n", worker.id, worker.task.NumReduceJobs)
+	if err != nil {
+		return err
+	}
+
+	if reply.Scheduler != args.Scheduler {
+		return fmt.Errorf("%w: job uses the %v scheduler, worker uses %v", ErrIncompatibleMaster, reply.Scheduler, args.Scheduler)
+	}
+
+	if worker.pool != nil {
+		if stages, err = buildStages(task, stages, reply); err != nil {
+			return err
+		}
+	}
+
+	if len(reply.Stages) != len(stages) {
+		return fmt.Errorf("%w: job has %v stages, worker has %v", ErrIncompatibleMaster, len(reply.Stages), len(stages))
 	}
 
-	return err
+	// Operations from before registering again may still be running with the old tasks
+	stages = append([]*Task(nil), stages...)
+
+	for i, settings := range reply.Stages {
+		if stages[i], err = stageWithSettings(stages[i], settings, reply.LocalStorage); err != nil {
+			return err
+		}
+	}
+
+	for i, settings := range reply.Stages {
+		log.Printf("Stage %v (ReduceJobs: %v, Codec: %v, Compression: %v, JobId: '%v')\n", i, settings.ReduceJobs, settings.Codec, settings.Compression, settings.JobId)
+
+		if err = createWorkDirs(stages[i]); err != nil {
+			return err
+		}
+	}
+
+	worker.stagesMutex.Lock()
+	worker.task = stages[0]
+	worker.stages = stages
+	worker.stagesMutex.Unlock()
+
+	worker.masterMutex.Lock()
+	worker.lastPing = time.Now()
+	worker.heartbeatTimeout = reply.HeartbeatTimeout
+	worker.heartbeatInterval = reply.HeartbeatInterval
+	worker.id = reply.WorkerId
+	worker.masterMutex.Unlock()
+	log.Printf("Registered. WorkerId: %v (Settings = (Stages: %v, LocalStorage: %v))\n", reply.WorkerId, len(reply.Stages), reply.LocalStorage)
+
+	return nil
+}
+
+// Returns the task of the first stage and the tasks of every stage of the job.
+func (worker *Worker) currentStages() (*Task, []*Task) {
+	worker.stagesMutex.Lock()
+	defer worker.stagesMutex.Unlock()
+
+	return worker.task, worker.stages
+}
+
+// Returns true if this worker process committed the output of the map operation id of
+// task, and it's still there.
+func (worker *Worker) hasCommittedMap(task *Task, id int) bool {
+	worker.stagesMutex.Lock()
+	committed := worker.committedMaps[filepath.Join(task.ScratchPath(), mapOutputDir(id))]
+	worker.stagesMutex.Unlock()
+
+	return committed && operationOutputExists(task, "Worker.RunMap", id)
+}
+
+func (worker *Worker) mapCommitted(task *Task, id int) {
+	worker.stagesMutex.Lock()
+	defer worker.stagesMutex.Unlock()
+
+	if worker.committedMaps == nil {
+		worker.committedMaps = make(map[string]bool)
+	}
+	worker.committedMaps[filepath.Join(task.ScratchPath(), mapOutputDir(id))] = true
+}
+
+// buildStages creates the tasks of the stages of the job from the registered ones, the
+// first time a pool worker registers. Registering again with another job returns
+// errJobChanged, since operations of this one may still be running.
+func buildStages(task *Task, stages []*Task, reply *RegisterReply) (tasks []*Task, err error) {
+	if len(reply.Stages) == 0 {
+		return nil, fmt.Errorf("%w: job without stages", ErrIncompatibleMaster)
+	}
+
+	if stages != nil {
+		if reply.Stages[0].JobId != task.JobId {
+			return nil, fmt.Errorf("%w: Master runs job '%v'", errJobChanged, reply.Stages[0].JobId)
+		}
+		return stages, nil
+	}
+
+	for i, settings := range reply.Stages {
+		task, err := registeredTask(settings.Name, settings.Params)
+		if err != nil {
+			return nil, fmt.Errorf("%w: stage %v: %v", ErrIncompatibleMaster, i, err)
+		}
+		tasks = append(tasks, task)
+	}
+
+	// The scheduler is a setting of the worker, not of the registered tasks
+	tasks[0].Scheduler = reply.Scheduler
+
+	log.Printf("Serving job '%v' (Tasks: %v)\n", reply.Stages[0].JobId, len(tasks))
+	return tasks, nil
+}
+
+// Returns a copy of the task of a stage with the settings taken from Master.
+func stageWithSettings(task *Task, settings StageSettings, localStorage bool) (*Task, error) {
+	var stage Task = *task
+
+	// Custom codecs must be set on the worker's task, built-in ones are looked up by name.
+	if recordCodec(&stage).Name() != settings.Codec {
+		codec, ok := CodecByName(settings.Codec)
+
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown codec '%v'", ErrIncompatibleMaster, settings.Codec)
+		}
+
+		stage.Codec = codec
+	}
+
+	if err := checkJobId(settings.JobId); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIncompatibleMaster, err)
+	}
+
+	if settings.SplitInput != (stage.Input != nil) {
+		return nil, fmt.Errorf("%w: input format set on only one of Master and worker", ErrIncompatibleMaster)
+	}
+
+	stage.NumReduceJobs = settings.ReduceJobs
+	stage.Compression = settings.Compression
+	stage.LocalStorage = localStorage
+	stage.JobId = settings.JobId
+	stage.ScratchDir = settings.ScratchDir
+	stage.OutputDir = settings.OutputDir
+	stage.CleanupScratch = settings.CleanupScratch
+
+	return &stage, nil
+}
+
+// registerWithRetry will call register until it succeeds. It gives up if the worker is
+// stopped or can't work with the Master's settings.
+func (worker *Worker) registerWithRetry() error {
+	var (
+		err           error
+		retryDuration time.Duration
+	)
+
+	retryDuration = time.Duration(2) * time.Second
+	for {
+		err = worker.register()
+
+		if err == nil || errors.Is(err, ErrIncompatibleMaster) || errors.Is(err, errJobChanged) {
+			return err
+		}
+
+		log.Printf("Registration failed. Retrying in %v seconds...\n", retryDuration)
+
+		select {
+		case <-time.After(retryDuration):
+		case <-worker.ctx.Done():
+			return worker.ctx.Err()
+		}
+	}
+}
+
+// watchMaster will register the worker again if Master stops sending heartbeats. This
+// happens when Master restarts, or when it removed this worker after missing heartbeats.
+func (worker *Worker) watchMaster() {
+	for {
+		worker.masterMutex.Lock()
+		timeout := worker.heartbeatTimeout
+		lost := time.Since(worker.lastPing) > timeout
+		worker.masterMutex.Unlock()
+
+		if lost {
+			log.Printf("No heartbeats from Master for %v. Registering again.\n", timeout)
+			if err := worker.registerWithRetry(); err != nil {
+				worker.failed <- err
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-worker.done:
+			return
+		case <-worker.ctx.Done():
+			return
+		case <-time.After(timeout / 2):
+		}
+	}
 }
 
 // acceptMultipleConnections will handle the connections from multiple workers.
@@ -63,7 +317,7 @@ func (worker *Worker) acceptMultipleConnections() error {
 		newConn, err = worker.listener.Accept()
 
 		if err == nil {
-			go worker.handleConnection(&newConn)
+			go worker.handleConnection(newConn)
 		} else {
 			log.Println("Failed to accept connection. Error: ", err)
 			break
@@ -75,19 +329,28 @@ func (worker *Worker) acceptMultipleConnections() error {
 }
 
 // Handle a single connection until it's done, then closes it.
-func (worker *Worker) handleConnection(conn *net.Conn) error {
-	worker.rpcServer.ServeConn(*conn)
-	(*conn).Close()
+func (worker *Worker) handleConnection(conn net.Conn) error {
+	worker.rpcServer.ServeConn(conn)
+	conn.Close()
 	return nil
 }
 
-// Connect to Master and call remote procedure.
+// Connect to Master and call remote procedure. Workers that pull their operations use
+// their connection to Master instead.
 func (worker *Worker) callMaster(proc string, args interface{}, reply interface{}) error {
 	var (
 		err    error
 		client *rpc.Client
 	)
 
+	worker.masterMutex.Lock()
+	client = worker.client
+	worker.masterMutex.Unlock()
+
+	if client != nil {
+		return client.Call(proc, args, reply)
+	}
+
 	client, err = rpc.Dial("tcp", worker.masterHostname)
 	if err != nil {
 		return err
@@ -110,6 +373,5 @@ func (worker *Worker) shouldFail(during bool) bool {
 		return false
 	}
 
-	worker.taskCounter++
-	return worker.taskCounter == worker.nOps
+	return atomic.AddInt64(&worker.taskCounter, 1) == worker.nOps
 }
@@ -0,0 +1,62 @@
+package mapreduce
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// drainOnSignal decommissions the worker once the process receives SIGTERM. A second
+// SIGTERM stops the process right away.
+func (worker *Worker) drainOnSignal() {
+	var signals chan os.Signal = make(chan os.Signal, 1)
+
+	signal.Notify(signals, syscall.SIGTERM)
+
+	select {
+	case <-signals:
+		signal.Stop(signals)
+	case <-worker.done:
+		signal.Stop(signals)
+		return
+	case <-worker.ctx.Done():
+		signal.Stop(signals)
+		return
+	}
+
+	if err := worker.decommission(); err != nil {
+		select {
+		case worker.failed <- err:
+		default:
+		}
+	}
+}
+
+// decommission drains the worker: Master stops scheduling operations on it, and once
+// the ones it's running are done and their outputs aren't needed anymore, it removes
+// the worker, which then stops like when the job is over.
+func (worker *Worker) decommission() error {
+	log.Println("Draining...")
+
+	atomic.StoreInt32(&worker.draining, 1)
+
+	worker.masterMutex.Lock()
+	workerId := worker.id
+	worker.masterMutex.Unlock()
+
+	task, _ := worker.currentStages()
+
+	if err := worker.callMaster("Master.Decommission", &DecommissionArgs{JobId: task.JobId, WorkerId: workerId}, new(struct{})); err != nil {
+		return fmt.Errorf("failed to decommission worker: %w", err)
+	}
+
+	log.Println("Decommissioned.")
+
+	worker.doneOnce.Do(func() {
+		close(worker.done)
+	})
+	return nil
+}
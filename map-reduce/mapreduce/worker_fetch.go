@@ -0,0 +1,219 @@
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Read the input of a map operation of stage. Splits of an InputFormat are read as
+// records, and so are the inputs of later stages of a pipeline, which are result files
+// of the previous stage. With LocalStorage, files that aren't found locally are read
+// from Master.
+func (worker *Worker) readInput(stages []*Task, stage int, split InputSplit) (input mapInput, err error) {
+	var (
+		task  *Task = stages[stage]
+		file  *os.File
+		data  []byte
+		reply *FetchReply
+	)
+
+	if stage == 0 && task.Input != nil {
+		if file, err = os.Open(split.Path); err == nil {
+			defer file.Close()
+			input.records, err = readSplit(task.Input, split, file)
+		} else if errors.Is(err, os.ErrNotExist) && task.LocalStorage {
+			input.records, err = readSplit(task.Input, split, &remoteInput{worker, stages[0].JobId, split.Path})
+		}
+
+		input.hasRecords = true
+		return input, err
+	}
+
+	data, err = ioutil.ReadFile(split.Path)
+
+	if errors.Is(err, os.ErrNotExist) && task.LocalStorage {
+		reply = new(FetchReply)
+		if err = worker.callMaster("Master.FetchInput", &FetchInputArgs{JobId: stages[0].JobId, FilePath: split.Path}, reply); err != nil {
+			return input, err
+		}
+		data = reply.Data
+	} else if err != nil {
+		return input, err
+	}
+
+	if stage == 0 {
+		return mapInput{data: data}, nil
+	}
+
+	input.records, err = decodeRecords(stages[stage-1], data)
+	input.hasRecords = true
+	return input, err
+}
+
+// remoteInput reads an input file from Master, for workers that don't share a filesystem
+// with it.
+type remoteInput struct {
+	worker *Worker
+	jobId  string
+	path   string
+}
+
+func (input *remoteInput) ReadAt(p []byte, offset int64) (int, error) {
+	var reply *FetchReply = new(FetchReply)
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if err := input.worker.callMaster("Master.FetchInput", &FetchInputArgs{input.jobId, input.path, offset, len(p)}, reply); err != nil {
+		return 0, err
+	}
+
+	n := copy(p, reply.Data)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Returns the input files of the job that are on this worker, so Master can run their
+// map operations here. Only input read with an InputFormat is known beforehand. The
+// paths of the built-in formats are matched one by one, so a worker that holds only
+// some of the input files advertises those.
+func localInputs(task *Task) (paths []string) {
+	var (
+		seen    map[string]bool = make(map[string]bool)
+		matches []string
+		err     error
+	)
+
+	if task.Input == nil {
+		return nil
+	}
+
+	patterns, ok := task.Input.(pathInput)
+	if !ok {
+		return splitPaths(task.Input)
+	}
+
+	for _, pattern := range patterns.inputPaths() {
+		if matches, err = filepath.Glob(pattern); err != nil {
+			log.Printf("Failed to list local input files '%v'. Error: %v\n", pattern, err)
+			continue
+		}
+
+		for _, path := range matches {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths
+}
+
+// Returns the files of the splits of an InputFormat, if they can all be found.
+func splitPaths(input InputFormat) (paths []string) {
+	splits, err := input.Splits()
+	if err != nil {
+		log.Println("Failed to list local input files. Error:", err)
+		return nil
+	}
+
+	for i, split := range splits {
+		if i == 0 || split.Path != splits[i-1].Path {
+			paths = append(paths, split.Path)
+		}
+	}
+	return paths
+}
+
+// Returns the task of a stage of the job, and the tasks of all its stages. Operations of
+// other jobs, like the previous one of a pool worker, are rejected.
+func (worker *Worker) stageTask(jobId string, stage int) (*Task, []*Task, error) {
+	task, stages := worker.currentStages()
+
+	if jobId != task.JobId {
+		return nil, nil, fmt.Errorf("unknown job '%v'", jobId)
+	}
+	if stage < 0 || stage >= len(stages) {
+		return nil, nil, fmt.Errorf("unknown stage %v", stage)
+	}
+	return stages[stage], stages, nil
+}
+
+// Returns the name of the directory with the partitions fetched by a reduce operation
+func fetchDirName(idReduce int) string {
+	return fmt.Sprintf("fetch-%v", idReduce)
+}
+
+// partitionFiles returns the paths of the partition idReduce of every map output. With
+// LocalStorage, partitions stored on other workers are fetched into a directory private
+// to this attempt, which is removed by cleanup. Returns the map outputs that couldn't
+// be read.
+func (worker *Worker) partitionFiles(stages []*Task, stage int, idReduce int, outputs []MapOutput) (paths []string, cleanup func(), failed []MapOutput, err error) {
+	var (
+		task   *Task = stages[stage]
+		dir    string
+		path   string
+		reader *recordReader
+	)
+
+	cleanup = func() {
+		if dir != "" {
+			_ = os.RemoveAll(dir)
+		}
+	}
+
+	paths = make([]string, 0, len(outputs))
+
+	for _, output := range outputs {
+		path = mapOutputPath(task, output.Id, idReduce)
+
+		if task.LocalStorage && output.WorkerHostname != worker.hostname {
+			if dir == "" {
+				if dir, err = os.MkdirTemp(task.ScratchPath(), tempFilePattern(fetchDirName(idReduce))); err != nil {
+					return nil, nil, nil, err
+				}
+			}
+
+			// Fetched files are kept as they are, encoded and compressed
+			path = filepath.Join(dir, reduceName(output.Id, idReduce))
+			err = worker.fetchPartition(path, output.WorkerHostname, FetchArgs{JobId: stages[0].JobId, Stage: stage, MapId: output.Id, ReduceId: idReduce})
+		} else if reader, err = openRecordFileWithRetry(task, path); err == nil {
+			reader.close()
+		}
+
+		if err != nil {
+			log.Printf("Failed to read map %v from '%v'. Error: %v\n", output.Id, output.WorkerHostname, err)
+			failed = append(failed, output)
+			continue
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths, cleanup, failed, nil
+}
+
+// Copy a partition of a map output from the worker at hostname to path.
+func (worker *Worker) fetchPartition(path string, hostname string, args FetchArgs) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = fetchFile(file, args, func(args *FetchArgs, reply *FetchReply) error {
+		return callWithTimeout(hostname, "Worker.FetchPartition", args, reply, FETCH_TIMEOUT)
+	})
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
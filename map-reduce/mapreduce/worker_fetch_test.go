@@ -0,0 +1,110 @@
+package mapreduce
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns a worker of the job of task listening on a local address, closed with the
+// test.
+func startTestFetchWorker(t *testing.T, task *Task) *Worker {
+	worker := &Worker{task: task, stages: []*Task{task}}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Worker", worker); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go server.Accept(listener)
+	worker.hostname = listener.Addr().String()
+	return worker
+}
+
+// Files are copied one chunk at a time, including the ones that end at a chunk
+// boundary.
+func TestFetchFile(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, size := range []int{0, 10, FETCH_CHUNK_SIZE, 2*FETCH_CHUNK_SIZE + 1} {
+		data := bytes.Repeat([]byte("x"), size)
+		path := filepath.Join(dir, fmt.Sprint(size))
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var copied bytes.Buffer
+		calls := 0
+		err := fetchFile(&copied, FetchArgs{}, func(args *FetchArgs, reply *FetchReply) (err error) {
+			calls++
+			reply.Data, err = readChunk(path, args.Offset, args.Length)
+			return err
+		})
+
+		if err != nil || !bytes.Equal(copied.Bytes(), data) {
+			t.Errorf("size %v: copied %v bytes, %v", size, copied.Len(), err)
+		}
+		if calls != size/FETCH_CHUNK_SIZE+1 {
+			t.Errorf("size %v: %v calls, want %v", size, calls, size/FETCH_CHUNK_SIZE+1)
+		}
+	}
+}
+
+// With LocalStorage, reducers fetch the partitions held by other workers, and report
+// the map outputs they couldn't read.
+func TestPartitionFilesFetch(t *testing.T) {
+	mapper := newTestWordCountTask(t, 2)
+	mapper.LocalStorage = true
+	_, partitions := runTestMap(t, mapper, 0, "b a c a b a c a d")
+
+	holder := startTestFetchWorker(t, mapper)
+
+	reducerTask := *mapper
+	reducerTask.ScratchDir = t.TempDir()
+	if err := createWorkDirs(&reducerTask); err != nil {
+		t.Fatal(err)
+	}
+	reducer := &Worker{hostname: "reducer", task: &reducerTask, stages: []*Task{&reducerTask}}
+
+	outputs := []MapOutput{{Id: 0, WorkerHostname: holder.hostname}, {Id: 1, WorkerHostname: holder.hostname}, {Id: 2, WorkerHostname: closedTestAddress(t)}}
+	paths, cleanup, failed, err := reducer.partitionFiles(reducer.stages, 0, 1, outputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(failed) != fmt.Sprint(outputs[1:]) {
+		t.Errorf("failed outputs %v, want %v", failed, outputs[1:])
+	}
+	if len(paths) != 1 {
+		t.Fatalf("fetched %v, want the partition of map 0", paths)
+	}
+
+	stream, err := openFileStream(&reducerTask, paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := readStream(stream); fmt.Sprint(records) != fmt.Sprint(partitions[1]) {
+		t.Errorf("fetched %v, want %v", records, partitions[1])
+	}
+
+	cleanup()
+	if names := dirNames(t, reducerTask.ScratchPath()); len(names) != 0 {
+		t.Errorf("scratch directory holds %v after cleanup", names)
+	}
+
+	// Partitions of other jobs aren't served
+	reply := new(FetchReply)
+	if err = holder.FetchPartition(&FetchArgs{JobId: "other", Length: 10}, reply); err == nil {
+		t.Error("served a partition of another job")
+	}
+}
@@ -0,0 +1,340 @@
+package mapreduce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// poolWorker is a long-lived worker that serves the jobs of a Pool. It runs a Worker for
+// each job it serves, a session, which registers with the job and keeps its own tasks
+// and counters. With SCHEDULER_PUSH, the sessions share the RPC server of the pool
+// worker, which passes the calls of every Master on to the session of their job.
+type poolWorker struct {
+	ctx            context.Context
+	stop           context.CancelFunc // Stops the pool worker and its sessions
+	hostname       string
+	masterHostname string
+	slots          int // Slots of each session
+	scheduler      Scheduler
+
+	// Sessions by JobId. registered is closed once the session that is registering
+	// knows its job, and cancelRegistration stops it.
+	mutex              sync.Mutex
+	sessions           map[string]*Worker
+	registered         chan struct{}
+	cancelRegistration context.CancelFunc
+	draining           bool
+
+	// Jobs served, and the error that stopped the pool worker. Guarded by mutex.
+	result   Result
+	counters Counters
+	err      error
+}
+
+// workerMux receives the calls of Masters to a pool worker, registered as Worker, and
+// passes them on to the session of their job.
+type workerMux struct {
+	pool *poolWorker
+}
+
+// runPoolWorker serves jobs until ctx is cancelled or the worker is decommissioned. A new
+// session registers with every job the worker doesn't serve yet, and starts with new
+// tasks and counters. Its result adds up the jobs it served.
+func runPoolWorker(ctx context.Context, settings *Task, hostname string, masterHostname string, slots int) (*Result, error) {
+	var (
+		pool     *poolWorker = new(poolWorker)
+		rpcs     *rpc.Server
+		listener net.Listener
+		err      error
+		wg       sync.WaitGroup
+	)
+
+	pool.ctx, pool.stop = context.WithCancel(ctx)
+	defer pool.stop()
+
+	pool.hostname = hostname
+	pool.masterHostname = masterHostname
+	pool.slots = slots
+	pool.scheduler = SCHEDULER_PUSH
+	pool.sessions = make(map[string]*Worker)
+
+	if settings != nil {
+		pool.scheduler = taskScheduler(settings)
+	}
+
+	// Workers that pull their operations don't accept connections
+	if pool.scheduler == SCHEDULER_PUSH {
+		rpcs = rpc.NewServer()
+
+		if err = rpcs.RegisterName("Worker", &workerMux{pool}); err != nil {
+			return nil, fmt.Errorf("failed to register RPC server: %w", err)
+		}
+
+		if listener, err = net.Listen("tcp", hostname); err != nil {
+			return nil, fmt.Errorf("starting RPC listener failed: %w", err)
+		}
+		defer listener.Close()
+
+		go acceptConnections(listener, rpcs)
+	}
+
+	log.Println("Running pool worker on", hostname)
+
+	for {
+		session, cancel, err := pool.register()
+		if err != nil {
+			pool.fail(err)
+			break
+		}
+		if session == nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+			pool.serve(session)
+		}()
+	}
+
+	wg.Wait()
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if pool.err != nil {
+		return nil, pool.err
+	}
+
+	pool.result.Counters = pool.counters.Values()
+	return &pool.result, nil
+}
+
+// register starts a session for a job the worker doesn't serve yet, and returns it once
+// it's registered with the job, with the function that cancels its context. Returns no
+// session once the worker is being decommissioned.
+func (pool *poolWorker) register() (session *Worker, cancel context.CancelFunc, err error) {
+	var ctx context.Context
+
+	pool.mutex.Lock()
+	if pool.draining {
+		pool.mutex.Unlock()
+		return nil, nil, nil
+	}
+	ctx, cancel = context.WithCancel(pool.ctx)
+	pool.registered = make(chan struct{})
+	pool.cancelRegistration = cancel
+	pool.mutex.Unlock()
+
+	session = newWorker(ctx, pool.hostname, pool.masterHostname, pool.slots)
+	session.pool = pool
+	session.task = &Task{Scheduler: pool.scheduler}
+
+	err = session.registerWithRetry()
+
+	pool.mutex.Lock()
+	if err == nil {
+		task, _ := session.currentStages()
+		pool.sessions[task.JobId] = session
+	}
+	close(pool.registered)
+	pool.registered = nil
+	pool.cancelRegistration = nil
+	draining := pool.draining
+	pool.mutex.Unlock()
+
+	if err != nil {
+		session.disconnect()
+		cancel()
+
+		// Registering is cancelled when the worker is decommissioned
+		if draining {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	// The worker was decommissioned while the session was registering
+	if draining {
+		go session.decommission()
+	}
+
+	return session, cancel, nil
+}
+
+// serve runs the operations of the job of a session until it's over.
+func (pool *poolWorker) serve(session *Worker) {
+	defer session.disconnect()
+
+	jobResult, err := session.serve()
+
+	task, _ := session.currentStages()
+
+	pool.mutex.Lock()
+	delete(pool.sessions, task.JobId)
+	pool.mutex.Unlock()
+
+	if errors.Is(err, errJobChanged) {
+		log.Printf("Stopped serving job '%v'. Error: %v\n", task.JobId, err)
+		return
+	}
+	if err != nil {
+		pool.fail(err)
+		return
+	}
+
+	log.Printf("Served job '%v' (Map operations: %v, Reduce operations: %v)\n", task.JobId, jobResult.NumMapOperations, jobResult.NumReduceOperations)
+
+	pool.mutex.Lock()
+	pool.result.NumMapOperations += jobResult.NumMapOperations
+	pool.result.NumReduceOperations += jobResult.NumReduceOperations
+	pool.counters.addAll(jobResult.Counters)
+	pool.mutex.Unlock()
+
+	// Every session is decommissioned at once, and no new ones register
+	if atomic.LoadInt32(&session.draining) == 1 {
+		pool.drain()
+	}
+}
+
+// drain stops registering sessions for new jobs.
+func (pool *poolWorker) drain() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.draining = true
+	if pool.cancelRegistration != nil {
+		pool.cancelRegistration()
+	}
+}
+
+// fail stops the pool worker with err. Only the first error is kept, and none once it's
+// being decommissioned.
+func (pool *poolWorker) fail(err error) {
+	pool.mutex.Lock()
+	if err != nil && pool.err == nil && !pool.draining {
+		pool.err = err
+	}
+	pool.mutex.Unlock()
+
+	if err != nil {
+		pool.stop()
+	}
+}
+
+// Returns the jobs served by the sessions of the worker.
+func (pool *poolWorker) jobIds() (jobIds []string) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for jobId := range pool.sessions {
+		jobIds = append(jobIds, jobId)
+	}
+	return jobIds
+}
+
+// Returns the session serving jobId. Master can call a session before it learns that it
+// was registered, so the session that is registering is waited for, up to POOL_WAIT
+// since it may be registering with another job or retrying.
+func (pool *poolWorker) session(jobId string) (*Worker, error) {
+	pool.mutex.Lock()
+	session, registered := pool.sessions[jobId], pool.registered
+	pool.mutex.Unlock()
+
+	if session == nil && registered != nil {
+		select {
+		case <-registered:
+		case <-time.After(POOL_WAIT):
+		case <-pool.ctx.Done():
+			return nil, pool.ctx.Err()
+		}
+
+		pool.mutex.Lock()
+		session = pool.sessions[jobId]
+		pool.mutex.Unlock()
+	}
+
+	if session == nil {
+		return nil, fmt.Errorf("unknown job '%v'", jobId)
+	}
+	return session, nil
+}
+
+// Handle the connections accepted by listener with rpcs until it's closed.
+func acceptConnections(listener net.Listener, rpcs *rpc.Server) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+
+		go func() {
+			rpcs.ServeConn(conn)
+			conn.Close()
+		}()
+	}
+
+	log.Println("Stopped accepting connections.")
+}
+
+// RPC - RunMap
+func (mux *workerMux) RunMap(args *RunArgs, reply *RunReply) error {
+	session, err := mux.pool.session(args.JobId)
+	if err != nil {
+		return err
+	}
+	return session.RunMap(args, reply)
+}
+
+// RPC - RunReduce
+func (mux *workerMux) RunReduce(args *RunArgs, reply *RunReply) error {
+	session, err := mux.pool.session(args.JobId)
+	if err != nil {
+		return err
+	}
+	return session.RunReduce(args, reply)
+}
+
+// RPC - FetchPartition
+func (mux *workerMux) FetchPartition(args *FetchArgs, reply *FetchReply) error {
+	session, err := mux.pool.session(args.JobId)
+	if err != nil {
+		return err
+	}
+	return session.FetchPartition(args, reply)
+}
+
+// RPC - FetchResult
+func (mux *workerMux) FetchResult(args *FetchArgs, reply *FetchReply) error {
+	session, err := mux.pool.session(args.JobId)
+	if err != nil {
+		return err
+	}
+	return session.FetchResult(args, reply)
+}
+
+// RPC - Ping
+func (mux *workerMux) Ping(args *PingArgs, reply *struct{}) error {
+	session, err := mux.pool.session(args.JobId)
+	if err != nil {
+		return err
+	}
+	return session.Ping(args, reply)
+}
+
+// RPC - Done
+func (mux *workerMux) Done(args *DoneArgs, reply *struct{}) error {
+	session, err := mux.pool.session(args.JobId)
+	if err != nil {
+		return err
+	}
+	return session.Done(args, reply)
+}
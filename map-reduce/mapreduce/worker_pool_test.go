@@ -0,0 +1,74 @@
+package mapreduce
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestPoolWorker() *poolWorker {
+	pool := &poolWorker{sessions: make(map[string]*Worker)}
+	pool.ctx, pool.stop = context.WithCancel(context.Background())
+	return pool
+}
+
+func TestPoolWorkerSession(t *testing.T) {
+	pool := newTestPoolWorker()
+	defer pool.stop()
+
+	served := &Worker{}
+	pool.sessions["served"] = served
+
+	if session, err := pool.session("served"); err != nil || session != served {
+		t.Errorf("session(served) = %v, %v", session, err)
+	}
+	if _, err := pool.session("other"); err == nil {
+		t.Error("found a session for a job that isn't served")
+	}
+}
+
+// Calls wait for the session that is registering, and fail if it registered with
+// another job.
+func TestPoolWorkerSessionRegistering(t *testing.T) {
+	pool := newTestPoolWorker()
+	defer pool.stop()
+
+	pool.registered = make(chan struct{})
+	registering := &Worker{}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+
+		pool.mutex.Lock()
+		pool.sessions["new"] = registering
+		close(pool.registered)
+		pool.registered = nil
+		pool.mutex.Unlock()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := pool.session("other"); err == nil {
+			t.Error("found a session for another job than the one registered")
+		}
+	}()
+
+	if session, err := pool.session("new"); err != nil || session != registering {
+		t.Errorf("session(new) = %v, %v", session, err)
+	}
+	<-done
+}
+
+// A call waiting for a registration that never ends is released when the pool worker
+// stops.
+func TestPoolWorkerSessionStopped(t *testing.T) {
+	pool := newTestPoolWorker()
+	pool.registered = make(chan struct{})
+
+	time.AfterFunc(10*time.Millisecond, pool.stop)
+
+	if _, err := pool.session("job"); err == nil {
+		t.Error("found a session for a job that never registered")
+	}
+}
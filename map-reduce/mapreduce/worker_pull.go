@@ -0,0 +1,148 @@
+package mapreduce
+
+import (
+	"log"
+	"net/rpc"
+	"sync/atomic"
+	"time"
+)
+
+// pullOperations asks Master for an operation whenever the worker has a free slot, and
+// runs it, until Master tells the worker to exit. The worker registers again when it
+// loses its connection to Master or Master doesn't know it anymore, unless it's being
+// decommissioned.
+func (worker *Worker) pullOperations() {
+	var (
+		err      error
+		slots    chan struct{} = make(chan struct{}, workerSlots(worker.slots))
+		client   *rpc.Client
+		workerId int
+	)
+
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-worker.done:
+			return
+		case <-worker.ctx.Done():
+			return
+		}
+
+		worker.masterMutex.Lock()
+		client, workerId = worker.client, worker.id
+		worker.masterMutex.Unlock()
+
+		task, _ := worker.currentStages()
+		jobId := task.JobId
+		reply := new(RequestTaskReply)
+
+		if err = client.Call("Master.RequestTask", &RequestTaskArgs{JobId: jobId, WorkerId: workerId}, reply); err != nil {
+			<-slots
+
+			// Master removed the worker once it was drained
+			if atomic.LoadInt32(&worker.draining) == 1 {
+				return
+			}
+
+			log.Println("Failed to request an operation. Error:", err)
+
+			if err = worker.registerWithRetry(); err != nil {
+				worker.failed <- err
+				return
+			}
+			continue
+		}
+
+		switch reply.Kind {
+		case TASK_WAIT:
+			<-slots
+		case TASK_EXIT:
+			worker.Done(&DoneArgs{JobId: jobId, JobCompleted: reply.JobCompleted}, nil)
+			return
+		default:
+			go func(client *rpc.Client, workerId int) {
+				defer func() { <-slots }()
+				worker.runAssignment(client, workerId, reply)
+			}(client, workerId)
+		}
+	}
+}
+
+// runAssignment runs an operation pulled from Master and reports it on the connection
+// it came from.
+func (worker *Worker) runAssignment(client *rpc.Client, workerId int, task *RequestTaskReply) {
+	var (
+		err    error
+		report *ReportTaskArgs = &ReportTaskArgs{JobId: task.Args.JobId, WorkerId: workerId, TaskId: task.TaskId}
+	)
+
+	if task.Kind == TASK_MAP {
+		err = worker.RunMap(&task.Args, &report.Reply)
+	} else {
+		err = worker.RunReduce(&task.Args, &report.Reply)
+	}
+
+	if err != nil {
+		log.Printf("Operation %v '%v' failed. Error: %v\n", task.Kind, task.Args.Id, err)
+		report.Error = err.Error()
+	}
+
+	if err = client.Call("Master.ReportTask", report, new(struct{})); err != nil {
+		log.Printf("Failed to report %v '%v'. Error: %v\n", task.Kind, task.Args.Id, err)
+	}
+}
+
+// sendHeartbeats calls Master.Heartbeat every heartbeat interval, since Master can't ping
+// workers that pull their operations. Failed calls are left to pullOperations.
+func (worker *Worker) sendHeartbeats() {
+	for {
+		worker.masterMutex.Lock()
+		interval := worker.heartbeatInterval
+		worker.masterMutex.Unlock()
+
+		select {
+		case <-worker.done:
+			return
+		case <-worker.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		worker.masterMutex.Lock()
+		client, workerId := worker.client, worker.id
+		worker.masterMutex.Unlock()
+
+		task, _ := worker.currentStages()
+
+		if err := client.Call("Master.Heartbeat", &HeartbeatArgs{JobId: task.JobId, WorkerId: workerId}, new(struct{})); err != nil {
+			log.Println("Heartbeat failed. Error:", err)
+		}
+	}
+}
+
+// Open a new connection to Master for a worker that pulls its operations, closing the
+// previous one.
+func (worker *Worker) connect() error {
+	client, err := rpc.Dial("tcp", worker.masterHostname)
+	if err != nil {
+		return err
+	}
+
+	worker.masterMutex.Lock()
+	if worker.client != nil {
+		worker.client.Close()
+	}
+	worker.client = client
+	worker.masterMutex.Unlock()
+
+	return nil
+}
+
+// Close the connection to Master, if there's one.
+func (worker *Worker) disconnect() {
+	worker.masterMutex.Lock()
+	if worker.client != nil {
+		worker.client.Close()
+	}
+	worker.masterMutex.Unlock()
+}
@@ -1,88 +1,212 @@
 package mapreduce
 
 import (
-	"encoding/json"
-	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 )
 
 // RPC - RunMap
-// Run the map operation defined in the task and return when it's done.
-func (worker *Worker) RunMap(args *RunArgs, _ *struct{}) error {
+// Run the map operation defined in the task and return when it's done. Errors
+// returned by the Map function or while storing its result fail the operation.
+func (worker *Worker) RunMap(args *RunArgs, reply *RunReply) error {
 	var (
-		err       error
-		buffer    []byte
-		mapResult []KeyValue
+		err      error
+		task     *Task
+		stages   []*Task
+		input    mapInput
+		start    time.Time = time.Now()
+		counters *Counters = new(Counters)
 	)
 
+	if task, stages, err = worker.stageTask(args.JobId, args.Stage); err != nil {
+		return err
+	}
+
 	if worker.shouldFail(false) {
-		mapResult = make([]KeyValue, 0)
-		storeLocal(worker.task, args.Id, mapResult)
+		// Leave the files of this attempt behind without committing them
+		if output, err := newMapOutputBuffer(task, args.Id, counters); err == nil {
+			output.close()
+		}
 		// Allow descriptors to be closed.
 		time.Sleep(time.Duration(100) * time.Millisecond)
 		panic("Induced failure.")
 	}
 
-	log.Printf("Running map id: %v, path: %v\n", args.Id, args.FilePath)
+	if err = worker.ctx.Err(); err != nil {
+		return err
+	}
+
+	log.Printf("Running map id: %v, stage: %v, path: %v\n", args.Id, args.Stage, args.FilePath)
 
-	if buffer, err = ioutil.ReadFile(args.FilePath); err != nil {
-		log.Fatal(err)
+	// A map output this worker committed for the job is complete and reducers may be
+	// reading it, so an attempt run here again keeps it. Output left by an earlier job
+	// with the same id, or by an earlier worker process, would win the commit instead.
+	if task.LocalStorage && worker.hasCommittedMap(task, args.Id) {
+		log.Printf("Keeping the committed output of map %v\n", args.Id)
+	} else {
+		if input, err = worker.readInput(stages, args.Stage, InputSplit{args.FilePath, args.Offset, args.Length}); err != nil {
+			return err
+		}
+
+		if task.LocalStorage {
+			if err = os.RemoveAll(filepath.Join(task.ScratchPath(), mapOutputDir(args.Id))); err != nil {
+				return err
+			}
+		}
+
+		// Operations still running when the worker is stopped aren't committed
+		if err = mapLocal(worker.ctx, task, args.Id, input, counters); err != nil {
+			return err
+		}
+		worker.mapCommitted(task, args.Id)
 	}
 
-	mapResult = worker.task.Map(buffer)
-	storeLocal(worker.task, args.Id, mapResult)
+	// Tells Master where most of the data of each reduce operation is
+	reply.PartitionSizes = make([]int64, task.NumReduceJobs)
+	for r := range reply.PartitionSizes {
+		reply.PartitionSizes[r] = fileSize(mapOutputPath(task, args.Id, r))
+	}
+
+	reply.Counters = worker.operationDone(operationStats(PHASE_MAP, args.Id, start, counters))
+	atomic.AddInt64(&worker.numMapOperations, 1)
 	return nil
 }
 
-// RPC - RunMap
-// Run the reduce operation defined in the task and return when it's done.
-func (worker *Worker) RunReduce(args *RunArgs, _ *struct{}) error {
-	log.Printf("Running reduce id: %v, path: %v\n", args.Id, args.FilePath)
+// RPC - RunReduce
+// Run the reduce operation defined in the task and return when it's done. The
+// partition of every map output is merged directly, fetching it from other workers
+// with LocalStorage. Map outputs that couldn't be read are reported back to Master.
+func (worker *Worker) RunReduce(args *RunArgs, reply *RunReply) error {
+	log.Printf("Running reduce id: %v, stage: %v, path: %v\n", args.Id, args.Stage, args.FilePath)
 
 	var (
 		err          error
+		task         *Task
+		stages       []*Task
 		reduceResult []KeyValue
-		file         *os.File
-		fileEncoder  *json.Encoder
+		file         *recordWriter
+		paths        []string
+		cleanup      func()
+		start        time.Time = time.Now()
+		counters     *Counters = new(Counters)
 	)
 
+	if task, stages, err = worker.stageTask(args.JobId, args.Stage); err != nil {
+		return err
+	}
+
 	if worker.shouldFail(false) {
-		if file, err = os.Create(resultFileName(args.Id)); err != nil {
-			log.Fatal(err)
+		// Leave a temporary file behind without committing it
+		if file, err = createRecordFile(task, resultFileName(task, args.Id)); err != nil {
+			return err
 		}
-		file.Sync()
-		file.Close()
 		// Allow descriptors to be closed.
 		time.Sleep(time.Duration(100) * time.Millisecond)
 		panic("Induced failure.")
 	}
 
-	data := loadLocal(args.Id)
+	if err = worker.ctx.Err(); err != nil {
+		return err
+	}
+
+	if paths, cleanup, reply.FetchFailed, err = worker.partitionFiles(stages, args.Stage, args.Id, args.MapOutputs); err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if len(reply.FetchFailed) > 0 {
+		return nil
+	}
+
+	if reduceResult, err = reduceLocal(task, args.Id, paths, counters); err != nil {
+		return err
+	}
 
-	reduceResult = worker.task.Reduce(data)
+	// Operations still running when the worker is stopped aren't committed
+	if err = worker.ctx.Err(); err != nil {
+		return err
+	}
 
-	if file, err = os.Create(resultFileName(args.Id)); err != nil {
-		log.Fatal(err)
+	if file, err = createRecordFile(task, resultFileName(task, args.Id)); err != nil {
+		return err
 	}
 
-	fileEncoder = json.NewEncoder(file)
+	for i := range reduceResult {
+		if err = file.write(&reduceResult[i]); err != nil {
+			file.abort()
+			return err
+		}
+	}
 
-	for _, value := range reduceResult {
-		fileEncoder.Encode(value)
+	if err = file.close(); err != nil {
+		return err
 	}
 
-	file.Close()
+	reply.Counters = worker.operationDone(operationStats(PHASE_REDUCE, args.Id, start, counters))
+	atomic.AddInt64(&worker.numReduceOperations, 1)
+	return nil
+}
+
+// Add the counters of an operation that was completed to the ones of the worker, and
+// return them to be sent to Master.
+func (worker *Worker) operationDone(stats OperationStats) map[string]int64 {
+	worker.counters.addAll(stats.Counters)
+	return stats.Counters
+}
+
+// RPC - FetchPartition
+// Called by reducers to read a chunk of the partition of a map operation that ran on
+// this worker.
+func (worker *Worker) FetchPartition(args *FetchArgs, reply *FetchReply) error {
+	task, _, err := worker.stageTask(args.JobId, args.Stage)
+	if err != nil {
+		return err
+	}
+
+	reply.Data, err = readChunk(mapOutputPath(task, args.MapId, args.ReduceId), args.Offset, args.Length)
+	return err
+}
+
+// RPC - FetchResult
+// Called by Master to read a chunk of the result of a reduce operation that ran on this
+// worker.
+func (worker *Worker) FetchResult(args *FetchArgs, reply *FetchReply) error {
+	task, _, err := worker.stageTask(args.JobId, args.Stage)
+	if err != nil {
+		return err
+	}
+
+	reply.Data, err = readChunk(resultFileName(task, args.ReduceId), args.Offset, args.Length)
+	return err
+}
+
+// RPC - Ping
+// Called periodically by Master to check that this worker is still alive.
+func (worker *Worker) Ping(_ *PingArgs, _ *struct{}) error {
+	worker.masterMutex.Lock()
+	worker.lastPing = time.Now()
+	worker.masterMutex.Unlock()
 	return nil
 }
 
 // RPC - Done
 // Will be called by Master when the task is done.
-func (worker *Worker) Done(_ *struct{}, _ *struct{}) error {
+func (worker *Worker) Done(args *DoneArgs, _ *struct{}) error {
 	log.Println("Done.")
-	defer func() {
+
+	// With LocalStorage, Master can't remove the intermediate files kept on this worker
+	if task, stages := worker.currentStages(); args.JobCompleted && task.LocalStorage {
+		for _, task := range stages {
+			cleanupScratch(task)
+		}
+	}
+
+	// Workers that pull their operations may be told more than once
+	defer worker.doneOnce.Do(func() {
 		close(worker.done)
-	}()
+	})
 	return nil
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"map-reduce/mapreduce"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var benchmarkCodecs = []string{"json", "gob", "binary"}
+
+// runBenchmark runs the sequential mode once for each of the built-in codecs, so the
+// throughput of the different intermediate encodings can be compared. Only the stage
+// of task runs, not the later ones set by -top.
+func runBenchmark(task *mapreduce.Task) {
+	var (
+		err       error
+		splits    []mapreduce.InputSplit
+		inputSize int64
+		jobId     string = task.JobId
+		start     time.Time
+		elapsed   []time.Duration
+		sizes     []int64
+	)
+
+	if splits, err = task.Input.Splits(); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, split := range splits {
+		inputSize += split.Length
+	}
+
+	// Intermediate files are kept to report their size
+	task.CleanupScratch = false
+
+	for _, name := range benchmarkCodecs {
+		task.Codec, _ = mapreduce.CodecByName(name)
+
+		// Each codec keeps its files in a directory of its own
+		task.JobId = "benchmark-" + name
+		if jobId != "" {
+			task.JobId = jobId + "-" + name
+		}
+
+		// The result is only sent to OutputChan, unless the task also has an Output,
+		// like when it's the only stage of the job
+		output := make(chan []mapreduce.KeyValue)
+		task.OutputChan = output
+		go func() {
+			for range output {
+			}
+		}()
+
+		start = time.Now()
+		mapreduce.RunSequential(task)
+
+		elapsed = append(elapsed, time.Since(start))
+		sizes = append(sizes, directorySize(task.ScratchPath()))
+	}
+
+	fmt.Printf("%-8v %12v %12v %16v\n", "codec", "time", "MB/s", "intermediate")
+	for i, name := range benchmarkCodecs {
+		fmt.Printf("%-8v %12v %12.2f %16v\n", name, elapsed[i].Round(time.Millisecond),
+			float64(inputSize)/elapsed[i].Seconds()/(1024*1024), sizes[i])
+	}
+}
+
+// Returns the total size in bytes of the files in dir.
+func directorySize(dir string) (size int64) {
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.Println("Failed to read directory size. Error:", err)
+	}
+
+	return size
+}
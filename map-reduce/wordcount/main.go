@@ -1,27 +1,59 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"map-reduce/mapreduce"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
 )
 
 var (
 	// Run mode settings
-	mode       = flag.String("mode", "distributed", "Run mode: distributed or sequential")
-	nodeType   = flag.String("type", "worker", "Node type: master or worker")
-	reduceJobs = flag.Int("reducejobs", 5, "Number of reduce jobs that should be run")
+	mode        = flag.String("mode", "distributed", "Run mode: distributed, sequential, parallel or benchmark")
+	numWorkers  = flag.Int("workers", 0, "Number of goroutines running operations in parallel mode (0 = number of CPUs)")
+	slots       = flag.Int("slots", 1, "Number of operations a worker runs at once in distributed mode")
+	nodeType    = flag.String("type", "worker", "Node type: master, worker, pool (runs a job for each argument, a list of input files, all at once) or poolworker")
+	reduceJobs  = flag.Int("reducejobs", 5, "Number of reduce jobs that should be run")
+	combine     = flag.Bool("combine", true, "Pre-aggregate map results before storing them")
+	codec       = flag.String("codec", "json", "Encoding of intermediate and result files: json, gob or binary")
+	compress    = flag.String("compress", "none", "Compression of intermediate and result files: none, gzip, zlib or fast")
+	mapBuffer   = flag.Int("mapbuffer", 0, "Memory budget to buffer a map result before spilling it (in bytes, 0 = default)")
+	sortBuffer  = flag.Int("sortbuffer", 0, "Memory budget to merge a reduce partition in memory (in bytes, 0 = default)")
+	mergeFactor = flag.Int("mergefactor", 0, "Maximum number of files merged at once by a reduce job (0 = default)")
+	localStore  = flag.Bool("localstorage", false, "Keep intermediate files on workers and fetch them over RPC (no shared filesystem)")
+	scheduler   = flag.String("scheduler", "push", "How workers get operations: push (master calls workers) or pull (workers ask master)")
+	jobId       = flag.String("jobid", "", "Name of the job, intermediate and result files are kept in a directory with this name")
+	cleanup     = flag.Bool("cleanup", false, "Remove intermediate files once the job is completed")
+	numTop      = flag.Int("top", 0, "Run a second stage that keeps the N most frequent words (0 = disabled)")
+
+	// Output settings
+	output     = flag.String("output", "json", "Format of the output files: json, tsv or csv")
+	merge      = flag.Bool("merge", true, "Write the output to a single file instead of one per reduce job")
+	sortOutput = flag.Bool("sort", false, "Sort the output by key across all the output files")
 
 	// Input data settings
-	file      = flag.String("file", "files/pg1342.txt", "File to use as input")
-	chunkSize = flag.Int("chunksize", 100*1024, "Size of data chunks that should be passed to map jobs(in bytes)")
+	file      = flag.String("file", "files/pg1342.txt", "Files to use as input, separated by commas (glob patterns are allowed)")
+	chunkSize = flag.Int("chunksize", 100*1024, "Maximum size of the input split read by a map job (in bytes)")
 
 	// Network settings
 	addr   = flag.String("addr", "localhost", "IP address to listen on")
 	port   = flag.Int("port", 5000, "TCP port to listen on")
 	master = flag.String("master", "localhost:5000", "Master address")
+	status = flag.String("status", "", "Address of the HTTP status server of the master, e.g. localhost:8080 (empty = disabled)")
+
+	// Fault tolerance settings
+	heartbeat        = flag.Duration("heartbeat", 0, "Interval between heartbeats sent to workers (0 = default)")
+	heartbeatTimeout = flag.Duration("heartbeattimeout", 0, "Time without heartbeats before a worker is removed (0 = default)")
+	opTimeout        = flag.Duration("optimeout", 0, "Deadline of a single map or reduce operation (0 = no deadline)")
+	backupThreshold  = flag.Float64("backupthreshold", 0, "Fraction of completed operations before launching backups of slow ones (0 = disabled)")
+	backupDelay      = flag.Duration("backupdelay", 0, "Running time before an operation gets a backup (0 = default)")
+	localityWait     = flag.Duration("localitywait", 0, "Time an operation waits for a worker holding its data (0 = default)")
 
 	// Induced failure on Worker
 	nOps = flag.Int("fail", 0, "Number of operations to run before failure")
@@ -30,68 +62,55 @@ var (
 // Code Entry Point
 func main() {
 	var (
-		err      error
 		task     *mapreduce.Task
-		numFiles int
+		stages   []*mapreduce.Task
 		hostname string
+		ctx      context.Context
+		stop     context.CancelFunc
+		job      *mapreduce.Job
 	)
 
 	flag.Parse()
 
-	_ = os.Mkdir(MAP_PATH, os.ModePerm)
+	// Interrupting the process cancels the job
+	ctx, stop = signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	_ = os.Mkdir(RESULT_PATH, os.ModePerm)
 
-	// Initialize mapreduce.Task object with the channels created above and functions
-	// mapFunc, shufflerFunc and reduceFunc defined in wordcount.go
-	task = &mapreduce.Task{
-		Map:           mapFunc,
-		Shuffle:       shuffleFunc,
-		Reduce:        reduceFunc,
-		NumReduceJobs: *reduceJobs,
-	}
+	registerTasks()
+
+	task, stages = newJobTasks(*file, *jobId)
 
 	log.Println("Running in", *mode, "mode.")
 
 	switch *mode {
-	case "sequential":
+	case "sequential", "parallel":
 		// Sequential runs all map and reduce operations in a single core
 		// in order. Its used to test Map and Reduce implementations.
-		var (
-			waitForIt chan bool
-			fanIn     chan []byte
-			fanOut    chan []mapreduce.KeyValue
-		)
-
-		_ = RemoveContents(MAP_PATH)
+		// Parallel runs them on a pool of goroutines in this process.
 		_ = RemoveContents(RESULT_PATH)
 
-		// Splits data into chunks with size up to chunkSize
-		if numFiles, err = splitData(*file, *chunkSize); err != nil {
-			log.Fatal(err)
+		job = &mapreduce.Job{Task: task, Stages: stages, Mode: mapreduce.JOB_SEQUENTIAL}
+		if *mode == "parallel" {
+			job.Mode = mapreduce.JOB_PARALLEL
+			job.NumWorkers = *numWorkers
 		}
 
-		fanIn = fanInData(numFiles)
-		fanOut, waitForIt = fanOutData()
+		runJob(ctx, job)
 
-		task.InputChan = fanIn
-		task.OutputChan = fanOut
-
-		mapreduce.RunSequential(task)
+	case "benchmark":
+		// Benchmark runs the sequential mode once for each codec and reports
+		// their throughput.
+		_ = RemoveContents(RESULT_PATH)
 
-		// Wait for fanOut to finish writing data to storage.
-		// Legen..
-		<-waitForIt
-		// ..dary!
+		runBenchmark(task)
 
 	case "distributed":
 		// Distributed runs the map and reduce operations in remote workers
 		// that are registered with a master.
 		switch *nodeType {
 		case "master":
-			var (
-				fanIn chan string
-			)
-
 			log.Println("NodeType:", *nodeType)
 			log.Println("Reduce Jobs:", *reduceJobs)
 			log.Println("Address:", *addr)
@@ -99,21 +118,13 @@ func main() {
 			log.Println("File:", *file)
 			log.Println("Chunk Size:", *chunkSize)
 
-			_ = RemoveContents(MAP_PATH)
-			_ = RemoveContents(RESULT_PATH)
+			// The result of the job is kept in a directory of its own, which a restarted
+			// master resumes from instead of removing it
 
 			hostname = *addr + ":" + strconv.Itoa(*port)
 
-			// Splits data into chunks with size up to chunkSize
-			if numFiles, err = splitData(*file, *chunkSize); err != nil {
-				log.Fatal(err)
-			}
-
-			// Create fan in and out channels for mapreduce.Task
-			fanIn = fanInFilePath(numFiles, hostname)
-			task.InputFilePathChan = fanIn
-
-			mapreduce.RunMaster(task, hostname)
+			job = &mapreduce.Job{Task: task, Stages: stages, Mode: mapreduce.JOB_MASTER, Hostname: hostname, StatusAddress: *status}
+			runJob(ctx, job)
 
 		case "worker":
 			log.Println("NodeType:", *nodeType)
@@ -128,7 +139,190 @@ func main() {
 
 			hostname = *addr + ":" + strconv.Itoa(*port)
 
-			mapreduce.RunWorker(task, hostname, *master, *nOps)
+			job = &mapreduce.Job{Task: task, Stages: stages, Mode: mapreduce.JOB_WORKER, Hostname: hostname, MasterHostname: *master, Slots: *slots, FailAfter: *nOps}
+			runJob(ctx, job)
+
+		case "pool":
+			// A pool master keeps its workers between the jobs it runs
+			log.Println("NodeType:", *nodeType)
+			log.Println("Address:", *addr)
+			log.Println("Port:", *port)
+
+			_ = RemoveContents(RESULT_PATH)
+
+			hostname = *addr + ":" + strconv.Itoa(*port)
+
+			runPool(ctx, hostname)
+
+		case "poolworker":
+			log.Println("NodeType:", *nodeType)
+			log.Println("Address:", *addr)
+			log.Println("Port:", *port)
+			log.Println("Master:", *master)
+
+			hostname = *addr + ":" + strconv.Itoa(*port)
+
+			job = &mapreduce.Job{Task: task, Mode: mapreduce.JOB_POOL_WORKER, Hostname: hostname, MasterHostname: *master, Slots: *slots}
+			runJob(ctx, job)
+		}
+	}
+}
+
+// Returns the tasks of a wordcount job that reads paths, separated by commas, with the
+// settings of the flags. Errors are fatal.
+func newJobTasks(paths string, jobId string) (task *mapreduce.Task, stages []*mapreduce.Task) {
+	var (
+		err  error
+		last *mapreduce.Task
+		ok   bool
+	)
+
+	// Initialize mapreduce.Task object with the lines of the input files and functions
+	// mapFunc, combineFunc, shufflerFunc and reduceFunc defined in wordcount.go
+	task = newWordCountFuncs(*combine).Apply(&mapreduce.Task{
+		Name:   WORDCOUNT_TASK,
+		Params: map[string]string{COMBINE_PARAM: strconv.FormatBool(*combine)},
+		Input: &mapreduce.TextInput{
+			Paths:     strings.Split(paths, ","),
+			SplitSize: int64(*chunkSize),
+		},
+		NumReduceJobs:  *reduceJobs,
+		MapBufferSize:  *mapBuffer,
+		SortBufferSize: *sortBuffer,
+		MergeFactor:    *mergeFactor,
+
+		HeartbeatInterval: *heartbeat,
+		HeartbeatTimeout:  *heartbeatTimeout,
+
+		OperationTimeout:     *opTimeout,
+		SpeculativeThreshold: *backupThreshold,
+		SpeculativeDelay:     *backupDelay,
+		LocalityWait:         *localityWait,
+
+		Scheduler:    mapreduce.Scheduler(*scheduler),
+		LocalStorage: *localStore,
+
+		JobId:          jobId,
+		CleanupScratch: *cleanup,
+	})
+
+	if task.Codec, ok = mapreduce.CodecByName(*codec); !ok {
+		log.Fatalf("Unknown codec '%v'.\n", *codec)
+	}
+
+	if task.Compression, err = mapreduce.ParseCompression(*compress); err != nil {
+		log.Fatal(err)
+	}
+
+	if task.Scheduler != mapreduce.SCHEDULER_PUSH && task.Scheduler != mapreduce.SCHEDULER_PULL {
+		log.Fatalf("Unknown scheduler '%v'.\n", *scheduler)
+	}
+
+	// The top words stage reads the counts of wordcount and writes the final result
+	last = task
+	if *numTop > 0 {
+		last = newTopWordsTask(task, *numTop)
+		stages = append(stages, last)
+	}
+
+	if last.Output, ok = outputByName(*output); !ok {
+		log.Fatalf("Unknown output format '%v'.\n", *output)
+	}
+	last.MergeOutput = *merge
+	last.SortOutput = *sortOutput
+
+	return task, stages
+}
+
+// Register the tasks of wordcount, so pool workers can run the jobs of a pool master.
+// They're built with the params of the job, the settings of the pool worker aren't used.
+func registerTasks() {
+	mapreduce.RegisterTask(WORDCOUNT_TASK, func(params map[string]string) (*mapreduce.Task, error) {
+		combine, err := strconv.ParseBool(params[COMBINE_PARAM])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v param: %w", COMBINE_PARAM, err)
+		}
+
+		return newWordCountFuncs(combine).Apply(&mapreduce.Task{Input: &mapreduce.TextInput{}}), nil
+	})
+
+	mapreduce.RegisterTask(TOP_WORDS_TASK, func(params map[string]string) (*mapreduce.Task, error) {
+		n, err := strconv.Atoi(params[TOP_WORDS_PARAM])
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid %v param '%v'", TOP_WORDS_PARAM, params[TOP_WORDS_PARAM])
+		}
+
+		return newTopWordsTask(&mapreduce.Task{}, n), nil
+	})
+}
+
+// Runs a wordcount job on the workers of a pool for each list of input files given as
+// an argument, or for -file if there are none, all at once. With -jobid, the jobs are
+// numbered after it. Only the first job serves -status. Errors are fatal.
+func runPool(ctx context.Context, hostname string) {
+	var (
+		pool   *mapreduce.Pool
+		inputs []string = flag.Args()
+		wg     sync.WaitGroup
+		err    error
+	)
+
+	if pool, err = mapreduce.StartPool(hostname, mapreduce.Scheduler(*scheduler)); err != nil {
+		log.Fatal(err)
+	}
+	defer pool.Close()
+
+	if len(inputs) == 0 {
+		inputs = []string{*file}
+	}
+
+	for i, paths := range inputs {
+		id := *jobId
+		if id != "" {
+			id = fmt.Sprintf("%v-%v", id, i+1)
 		}
+
+		task, stages := newJobTasks(paths, id)
+		job := &mapreduce.Job{Task: task, Stages: stages}
+		if i == 0 {
+			job.StatusAddress = *status
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			result, err := pool.Run(ctx, job)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			log.Print(result.Summary())
+		}()
+	}
+
+	wg.Wait()
+}
+
+// Runs a job and logs how it went. Errors are fatal.
+func runJob(ctx context.Context, job *mapreduce.Job) {
+	result, err := job.Run(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print(result.Summary())
+}
+
+// Returns the output format named by the -output flag.
+func outputByName(name string) (mapreduce.OutputFormat, bool) {
+	switch name {
+	case "json":
+		return &mapreduce.JSONLinesOutput{}, true
+	case "tsv":
+		return &mapreduce.TSVOutput{}, true
+	case "csv":
+		return &mapreduce.CSVOutput{}, true
 	}
+	return nil, false
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"map-reduce/mapreduce"
+	"sort"
+	"strconv"
+)
+
+// The top words stage runs after wordcount when the -top flag is set. Its map operations
+// read the result partitions of wordcount, and a single reduce job keeps the words that
+// appear the most.
+
+const (
+	TOP_WORDS_KEY   = "top"
+	TOP_WORDS_TASK  = "topwords" // Name of the registered task
+	TOP_WORDS_PARAM = "top"      // Param of the task with the number of words kept
+)
+
+// wordCount is a word and the number of times it appears, encoded as JSON between the
+// map and reduce operations of the top words stage.
+type wordCount struct {
+	Word  string
+	Count int
+}
+
+// Construct the Task of the top words stage, which keeps the n most frequent words,
+// using the same encoding as task.
+func newTopWordsTask(task *mapreduce.Task, n int) *mapreduce.Task {
+	typed := &mapreduce.TypedTask[string, wordCount, string, int]{
+		MapRecordsEmit: topMapFunc,
+		Combine:        topCombineFunc(n),
+		Shuffle:        shuffleFunc,
+		Reduce:         topReduceFunc(n),
+	}
+
+	return typed.Apply(&mapreduce.Task{
+		Name:          TOP_WORDS_TASK,
+		Params:        map[string]string{TOP_WORDS_PARAM: strconv.Itoa(n)},
+		NumReduceJobs: 1,
+		Codec:         task.Codec,
+		Compression:   task.Compression,
+		JobId:         task.JobId,
+
+		CleanupScratch: task.CleanupScratch,
+	})
+}
+
+// topMapFunc is called with the words and counts of a result partition of wordcount. All
+// of them are sent to the same key.
+func topMapFunc(input []mapreduce.KeyValue, emitter mapreduce.TypedEmitter[string, wordCount]) (err error) {
+	var count int
+
+	for _, kv := range input {
+		if count, err = strconv.Atoi(kv.Value); err != nil {
+			return err
+		}
+
+		err = emitter.Emit(mapreduce.Pair[string, wordCount]{
+			Key:   TOP_WORDS_KEY,
+			Value: wordCount{kv.Key, count},
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// topCombineFunc keeps the n most frequent words of a single map job, in the same
+// format as topMapFunc so they can be reduced again.
+func topCombineFunc(n int) func(string, mapreduce.TypedIterator[wordCount]) ([]mapreduce.Pair[string, wordCount], error) {
+	return func(key string, values mapreduce.TypedIterator[wordCount]) (result []mapreduce.Pair[string, wordCount], err error) {
+		for _, w := range topWords(values, n) {
+			result = append(result, mapreduce.Pair[string, wordCount]{
+				Key:   key,
+				Value: w,
+			})
+		}
+
+		return result, nil
+	}
+}
+
+// topReduceFunc returns the n most frequent words with their counts, from the most to
+// the least frequent.
+func topReduceFunc(n int) func(string, mapreduce.TypedIterator[wordCount]) ([]wordCountPair, error) {
+	return func(key string, values mapreduce.TypedIterator[wordCount]) (result []wordCountPair, err error) {
+		for _, w := range topWords(values, n) {
+			result = append(result, wordCountPair{
+				Key:   w.Word,
+				Value: w.Count,
+			})
+		}
+
+		return result, nil
+	}
+}
+
+// Returns the n words with the highest counts, sorted by count. Ties are broken by word,
+// so the result doesn't depend on the order of the values.
+func topWords(values mapreduce.TypedIterator[wordCount], n int) (words []wordCount) {
+	byCount := func() {
+		sort.Slice(words, func(i, j int) bool {
+			if words[i].Count != words[j].Count {
+				return words[i].Count > words[j].Count
+			}
+			return words[i].Word < words[j].Word
+		})
+	}
+
+	for w, ok := values.Next(); ok; w, ok = values.Next() {
+		words = append(words, w)
+
+		// Only the top n words are kept in memory
+		if len(words) >= 2*n {
+			byCount()
+			words = words[:n]
+		}
+	}
+
+	byCount()
+	if len(words) > n {
+		words = words[:n]
+	}
+
+	return words
+}
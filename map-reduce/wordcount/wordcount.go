@@ -5,66 +5,94 @@ import (
 
 	"hash/fnv"
 	"map-reduce/mapreduce"
-	"strconv"
 
 	//"strconv"
 	"strings"
 	"unicode"
 )
 
-// mapFunc is called for each array of bytes read from the splitted files. For wordcount
-// it should convert it into an array and parses it into an array of KeyValue that have
-// all the words in the input.
-func mapFunc(input []byte) (result []mapreduce.KeyValue) {
+// Words and their counts, encoded by the framework
+type wordCountPair = mapreduce.Pair[string, int]
+
+const (
+	EMPTY_LINES    = "EMPTY_LINES"
+	WORDCOUNT_TASK = "wordcount" // Name of the registered task
+	COMBINE_PARAM  = "combine"   // Param of the task, set if combineFunc is used
+)
+
+// Returns the functions of wordcount, which count words of type string with counts of
+// type int. combine sets combineFunc.
+func newWordCountFuncs(combine bool) *mapreduce.TypedTask[string, int, string, int] {
+	typed := &mapreduce.TypedTask[string, int, string, int]{
+		MapRecordsEmit: mapFunc,
+		Shuffle:        shuffleFunc,
+		Reduce:         reduceFunc,
+	}
+
+	if combine {
+		typed.Combine = combineFunc
+	}
+
+	return typed
+}
+
+// mapFunc is called with the lines of each split of the input files. For wordcount it
+// parses them into pairs for all the words in the input, sent to emitter one at a time.
+func mapFunc(input []mapreduce.KeyValue, emitter mapreduce.TypedEmitter[string, int]) (err error) {
 	var (
-		text          string
 		delimiterFunc func(c rune) bool
 		words         []string
 	)
 
-	text = string(input)
-
 	delimiterFunc = func(c rune) bool {
 		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
 	}
 
-	words = strings.FieldsFunc(text, delimiterFunc)
+	for _, line := range input {
+		words = strings.FieldsFunc(line.Value, delimiterFunc)
+
+		if len(words) == 0 {
+			emitter.Counters().Add(EMPTY_LINES, 1)
+		}
 
-	result = make([]mapreduce.KeyValue, 0)
+		for _, word := range words {
+			err = emitter.Emit(wordCountPair{
+				Key:   strings.ToLower(word),
+				Value: 1,
+			})
 
-	for _, word := range words {
-		result = append(result, mapreduce.KeyValue{
-			Key:   strings.ToLower(word),
-			Value: "1",
-		})
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	return result
+	return nil
 }
 
-// reduceFunc is called for each merged array of KeyValue resulted from all map jobs.
-// It should return a similar array that summarizes all similar keys in the input.
-func reduceFunc(input []mapreduce.KeyValue) (result []mapreduce.KeyValue) {
-	var mapAux map[string]int = make(map[string]int)
+// combineFunc is called for each word in the result of a single map job, before it's
+// stored locally. For wordcount it has the same semantics of reduceFunc, so the counts
+// of repeated words are summed up early and the intermediate files get much smaller.
+func combineFunc(key string, values mapreduce.TypedIterator[int]) (result []wordCountPair, err error) {
+	return reduceFunc(key, values)
+}
 
-	for _, item := range input {
-		_, ok := mapAux[item.Key]
+// reduceFunc is called once for each word resulted from all map jobs, with all of its
+// counts. It should return a single pair that summarizes them.
+// Values are summed instead of counted, since they may have been pre-aggregated by combineFunc.
+func reduceFunc(key string, values mapreduce.TypedIterator[int]) (result []wordCountPair, err error) {
+	var total int
 
-		if ok {
-			mapAux[item.Key]++
-		} else {
-			mapAux[item.Key] = 1
-		}
+	for count, ok := values.Next(); ok; count, ok = values.Next() {
+		total += count
 	}
 
-	for key, value := range mapAux {
-		result = append(result, mapreduce.KeyValue{
-			Key:   key,
-			Value: strconv.Itoa(value),
-		})
-	}
+	result = append(result, wordCountPair{
+		Key:   key,
+		Value: total,
+	})
 
-	return result
+	return result, nil
 }
 
 // shuffleFunc will shuffle map job results into different job tasks. It should assert that